@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL decides which senders a listener accepts packets from. Deny rules are
+// checked first. If there are allow rules, the sender must match one of
+// them, otherwise everything which isn't denied is accepted.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseACL parses comma delimited lists of CIDR networks, eg.
+// "10.0.0.0/8,192.168.1.0/24". Plain addresses are accepted as single host
+// networks. Returns nil if both lists are empty.
+func ParseACL(allow string, deny string) (*ACL, error) {
+	acl := &ACL{}
+	var err error
+
+	acl.Allow, err = parseNetworks(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	acl.Deny, err = parseNetworks(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(acl.Allow) == 0 && len(acl.Deny) == 0 {
+		return nil, nil
+	}
+
+	return acl, nil
+}
+
+func parseNetworks(str string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address '%s'", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network '%s': %s", part, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Allowed checks if packets from the ip are accepted. A nil ACL accepts
+// everything.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+
+	for _, network := range a.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(a.Allow) == 0 {
+		return true
+	}
+
+	for _, network := range a.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SourceFields names the message fields where the sender address of a
+// packet is stored. Empty names leave the field out.
+type SourceFields struct {
+	IP   string
+	Port string
+}
+
+func (f SourceFields) Set(m *Message, addr *net.UDPAddr) {
+	if addr == nil || m.ParseFields() != nil {
+		return
+	}
+
+	if f.IP != "" {
+		m.SetField(f.IP, addr.IP.String())
+	}
+	if f.Port != "" {
+		m.SetField(f.Port, float64(addr.Port))
+	}
+}
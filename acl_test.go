@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL("", "")
+	assert.Nil(t, err)
+	assert.Nil(t, acl)
+	assert.Equal(t, true, acl.Allowed(net.ParseIP("10.1.2.3")))
+
+	acl, err = ParseACL("10.0.0.0/8, 127.0.0.1", "10.1.0.0/16")
+	assert.Nil(t, err)
+	assert.Equal(t, true, acl.Allowed(net.ParseIP("10.2.3.4")))
+	assert.Equal(t, true, acl.Allowed(net.ParseIP("127.0.0.1")))
+	assert.Equal(t, false, acl.Allowed(net.ParseIP("127.0.0.2")))
+	assert.Equal(t, false, acl.Allowed(net.ParseIP("10.1.2.3")))
+	assert.Equal(t, false, acl.Allowed(net.ParseIP("192.168.1.1")))
+
+	acl, err = ParseACL("", "192.168.0.0/16,::1")
+	assert.Nil(t, err)
+	assert.Equal(t, true, acl.Allowed(net.ParseIP("10.2.3.4")))
+	assert.Equal(t, false, acl.Allowed(net.ParseIP("192.168.1.1")))
+	assert.Equal(t, false, acl.Allowed(net.ParseIP("::1")))
+
+	_, err = ParseACL("10.0.0.0/33", "")
+	assert.NotNil(t, err)
+	_, err = ParseACL("", "foo")
+	assert.NotNil(t, err)
+}
+
+func TestSyslogSourceFieldsAndACL(t *testing.T) {
+	statsd := newTestStatsd()
+	acl, _ := ParseACL("127.0.0.0/8", "")
+
+	s := Syslog{}
+	s.Messages = make(chan Message, 10)
+	s.Statsd = statsd
+	s.ACL = acl
+	s.SourceFields = SourceFields{IP: "source_ip", Port: "source_port"}
+
+	packet := []byte("<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:12341234[9103]: Hello from Docker.")
+
+	s.HandlePacket(packet, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000})
+	m := <-s.Messages
+	value, _ := m.FieldString("source_ip")
+	assert.Equal(t, "127.0.0.1", value)
+	value, _ = m.FieldString("source_port")
+	assert.Equal(t, "40000", value)
+
+	s.HandlePacket(packet, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000})
+	assert.Equal(t, 0, len(s.Messages))
+	assert.Equal(t, int64(1), statsd.Counter("logs2kafka.rejected_packets,input=syslog"))
+}
+
+func TestGraylogSourceFieldsAndACL(t *testing.T) {
+	statsd := newTestStatsd()
+	acl, _ := ParseACL("", "10.0.0.0/8")
+
+	s := Graylog{}
+	s.ReceivedChunks = make(map[string]*Chunk)
+	s.Messages = make(chan Message, 10)
+	s.Statsd = statsd
+	s.ACL = acl
+	s.SourceFields = SourceFields{IP: "source_ip"}
+
+	sender := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 40000}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 40000}
+
+	err := s.ParseGraylogMessageFrom([]byte(`{"version":"1.1","short_message":"hello","source_ip":"1.2.3.4"}`), sender)
+	assert.Nil(t, err)
+	m := <-s.Messages
+	value, _ := m.FieldString("source_ip")
+	assert.Equal(t, "192.168.1.1", value)
+	_, ok := m.FieldString("source_port")
+	assert.Equal(t, false, ok)
+
+	// Chunks from different senders are not joined even if the message id is the same
+	s.ParseGraylogMessageFrom([]byte("\x1e\x0f\x00\x00\x00\x00\xDE\xAD\xBE\xEF\x00\x02{\"short_message\":\"hello\""), sender)
+	s.ParseGraylogMessageFrom([]byte("\x1e\x0f\x00\x00\x00\x00\xDE\xAD\xBE\xEF\x01\x02,\"test\":\"other\"}"), other)
+	assert.Equal(t, 0, len(s.Messages))
+	s.ParseGraylogMessageFrom([]byte("\x1e\x0f\x00\x00\x00\x00\xDE\xAD\xBE\xEF\x01\x02,\"test\":\"same\"}"), sender)
+	m = <-s.Messages
+	value, _ = m.FieldString("test")
+	assert.Equal(t, "same", value)
+	value, _ = m.FieldString("source_ip")
+	assert.Equal(t, "192.168.1.1", value)
+
+	err = s.ParseGraylogMessageFrom([]byte(`{"version":"1.1","short_message":"hello"}`), &net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 40000})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(s.Messages))
+	assert.Equal(t, int64(1), statsd.Counter("logs2kafka.rejected_packets,input=gelf"))
+}
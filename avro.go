@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogMessageAvroSchema is the Avro schema used for all topics. Fields other
+// than the well known ones are carried in the "fields" map, with non-string
+// values encoded as JSON.
+const LogMessageAvroSchema = `{
+  "type": "record",
+  "name": "LogMessage",
+  "namespace": "logs2kafka",
+  "fields": [
+    {"name": "ts", "type": "string"},
+    {"name": "service", "type": ["null", "string"], "default": null},
+    {"name": "level", "type": ["null", "string"], "default": null},
+    {"name": "host", "type": ["null", "string"], "default": null},
+    {"name": "msg", "type": ["null", "string"], "default": null},
+    {"name": "fields", "type": {"type": "map", "values": "string"}, "default": {}}
+  ]
+}`
+
+// SchemaRegistry is a minimal client for the Confluent schema registry REST
+// API. Schema ids are cached per subject.
+type SchemaRegistry struct {
+	URL string
+
+	Client *http.Client
+
+	// How long to wait before trying to register a schema again after a failure
+	RetryInterval time.Duration
+
+	mutex    sync.Mutex
+	ids      map[string]int32
+	failures map[string]time.Time
+}
+
+func NewSchemaRegistry(url string) *SchemaRegistry {
+	return &SchemaRegistry{
+		URL:           strings.TrimRight(url, "/"),
+		Client:        &http.Client{Timeout: 5 * time.Second},
+		RetryInterval: 30 * time.Second,
+		ids:           make(map[string]int32),
+		failures:      make(map[string]time.Time),
+	}
+}
+
+// Register registers the schema under the subject (or looks up the existing
+// registration) and returns the schema id.
+//
+// The request is made without holding the lock, so that a slow registry
+// doesn't hold up the encoders of the subjects which are already cached.
+// Registering the same schema again returns the same id, so concurrent
+// first registrations of a subject are harmless.
+func (r *SchemaRegistry) Register(subject string, schema string) (int32, error) {
+	r.mutex.Lock()
+	if id, ok := r.ids[subject]; ok {
+		r.mutex.Unlock()
+		return id, nil
+	}
+	if failed, ok := r.failures[subject]; ok && time.Since(failed) < r.RetryInterval {
+		r.mutex.Unlock()
+		return 0, fmt.Errorf("Schema registration for subject %s failed recently, not retrying yet", subject)
+	}
+	r.mutex.Unlock()
+
+	id, err := r.register(subject, schema)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err != nil {
+		r.failures[subject] = time.Now()
+		return 0, err
+	}
+
+	delete(r.failures, subject)
+	r.ids[subject] = id
+
+	return id, nil
+}
+
+func (r *SchemaRegistry) register(subject string, schema string) (int32, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := r.Client.Post(r.URL+"/subjects/"+url.PathEscape(subject)+"/versions", "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Schema registry returned %d for subject %s: %s", resp.StatusCode, subject, string(data))
+	}
+
+	result := struct {
+		Id int32 `json:"id"`
+	}{}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Id, nil
+}
+
+// AvroEncoder encodes messages with LogMessageAvroSchema using the schema
+// registry wire format: a zero magic byte, the schema id as a 4 byte big
+// endian integer and the Avro binary encoded record.
+type AvroEncoder struct {
+	Registry *SchemaRegistry
+}
+
+func NewAvroEncoder(registry *SchemaRegistry) *AvroEncoder {
+	return &AvroEncoder{Registry: registry}
+}
+
+func (e *AvroEncoder) Encode(m *Message) ([]byte, error) {
+	// Subjects follow the default TopicNameStrategy
+	id, err := e.Registry.Register(m.Topic+"-value", LogMessageAvroSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := newLogEnvelope(m)
+
+	buf := make([]byte, 5, 256)
+	buf[0] = 0
+	binary.BigEndian.PutUint32(buf[1:5], uint32(id))
+
+	buf = appendAvroString(buf, envelope.Timestamp)
+	buf = appendAvroOptionalString(buf, envelope.Service)
+	buf = appendAvroOptionalString(buf, envelope.Level)
+	buf = appendAvroOptionalString(buf, envelope.Host)
+	buf = appendAvroOptionalString(buf, envelope.Msg)
+
+	// Maps are encoded as a single block followed by an empty block
+	if len(envelope.Keys) > 0 {
+		buf = appendAvroLong(buf, int64(len(envelope.Keys)))
+		for _, key := range envelope.Keys {
+			buf = appendAvroString(buf, key)
+			buf = appendAvroString(buf, envelope.Fields[key])
+		}
+	}
+	buf = appendAvroLong(buf, 0)
+
+	return buf, nil
+}
+
+func appendAvroLong(buf []byte, v int64) []byte {
+	// zig-zag encoding followed by a variable length integer
+	u := uint64((v << 1) ^ (v >> 63))
+	for u >= 0x80 {
+		buf = append(buf, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(buf, byte(u))
+}
+
+func appendAvroString(buf []byte, s string) []byte {
+	buf = appendAvroLong(buf, int64(len(s)))
+	return append(buf, s...)
+}
+
+// appendAvroOptionalString encodes a ["null", "string"] union, where empty
+// strings are sent as null.
+func appendAvroOptionalString(buf []byte, s string) []byte {
+	if s == "" {
+		return appendAvroLong(buf, 0)
+	}
+	buf = appendAvroLong(buf, 1)
+	return appendAvroString(buf, s)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSchemaRegistry(t *testing.T, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/subjects/service.foo-value/versions", r.URL.Path)
+
+		body := map[string]string{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.Nil(t, err)
+		assert.Equal(t, LogMessageAvroSchema, body["schema"])
+
+		w.Write([]byte(`{"id":7}`))
+	}))
+}
+
+func TestAvroEncoder(t *testing.T) {
+	requests := 0
+	server := newTestSchemaRegistry(t, &requests)
+	defer server.Close()
+
+	e := NewAvroEncoder(NewSchemaRegistry(server.URL))
+
+	m := JSONToMessage(`{"ts":"t","service":"s","msg":"hi","n":1}`)
+	m.ParseJSON()
+	m.Topic = "service.foo"
+
+	value, err := e.Encode(&m)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0, 0, 0, 0, 7, // magic byte and schema id
+		2, 't', // ts
+		2, 2, 's', // service
+		0,              // level
+		0,              // host
+		2, 4, 'h', 'i', // msg
+		2, 2, 'n', 2, '1', 0, // fields
+	}, value)
+
+	// Schema id is cached
+	_, err = e.Encode(&m)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestAvroEncoderRegistryFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	e := NewAvroEncoder(NewSchemaRegistry(server.URL))
+
+	m := JSONToMessage(`{"ts":"t"}`)
+	m.ParseJSON()
+	m.Topic = "service.foo"
+
+	_, err := e.Encode(&m)
+	assert.NotNil(t, err)
+}
+
+func TestSchemaRegistryConcurrentSubjects(t *testing.T) {
+	arrived := make(chan bool, 1)
+	release := make(chan bool)
+	var uris []string
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		uris = append(uris, r.RequestURI)
+		mutex.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/subjects/slow") {
+			arrived <- true
+			<-release
+		}
+		w.Write([]byte(`{"id":7}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	r := NewSchemaRegistry(server.URL)
+	id, err := r.Register("fast", LogMessageAvroSchema)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(7), id)
+
+	// A slow registration doesn't hold up the cached subjects
+	go r.Register("slow/one two", LogMessageAvroSchema)
+	<-arrived
+	done := make(chan bool)
+	go func() {
+		r.Register("fast", LogMessageAvroSchema)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Register was blocked by another subject")
+	}
+
+	// The subject is escaped in the path
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"/subjects/fast/versions", "/subjects/slow%2Fone%20two/versions"}, uris)
+}
+
+func TestAppendAvroLong(t *testing.T) {
+	assert.Equal(t, []byte{0x00}, appendAvroLong(nil, 0))
+	assert.Equal(t, []byte{0x01}, appendAvroLong(nil, -1))
+	assert.Equal(t, []byte{0x02}, appendAvroLong(nil, 1))
+	assert.Equal(t, []byte{0x7f}, appendAvroLong(nil, -64))
+	assert.Equal(t, []byte{0x80, 0x01}, appendAvroLong(nil, 64))
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// BenchFormats are the kinds of traffic the bench command can generate.
+var BenchFormats = []string{"rfc3164", "rfc5424", "gelf", "gelf-chunked", "gelf-gzip", "gelf-zlib"}
+
+// The chunk size the Docker GELF driver uses
+const DefaultBenchChunkSize = 1420
+
+// Bench sends generated log messages to a running logs2kafka at a target
+// rate and matches the messages it forwards back to the sent ones to
+// measure loss and latency.
+//
+// Each message is a JSON document with the fields "bench_run", "bench_seq",
+// "bench_sent" (unix time in nanoseconds) and "bench_format", so forwarded
+// messages can be fed to Receive from any output.
+type Bench struct {
+	SyslogAddr  string
+	GraylogAddr string
+
+	// Formats are sent in turns, see BenchFormats
+	Formats []string
+
+	// Messages per second
+	Rate     int
+	Duration time.Duration
+
+	// Size of the "msg" field in bytes
+	Size int
+
+	// Messages are spread evenly over services bench-0 ... bench-<Services-1>
+	Services int
+
+	// Maximum size of a GELF chunk
+	ChunkSize int
+
+	// RunID separates the messages of this run from other runs
+	RunID string
+
+	mutex     sync.Mutex
+	sent      map[string]int64
+	sentBytes int64
+	received  map[string]int64
+	latencies map[string][]time.Duration
+	seen      map[int64]bool
+	duplicate int64
+	lastSeen  time.Time
+}
+
+// BenchResult is the outcome of one format, or all of them when Format is
+// empty.
+type BenchResult struct {
+	Format    string
+	Sent      int64
+	Received  int64
+	Latencies []time.Duration
+}
+
+func (r BenchResult) Lost() int64 {
+	return r.Sent - r.Received
+}
+
+// Percentile returns the latency of the given percentile, eg. 0.99.
+func (r BenchResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(r.Latencies))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// BenchReport is returned by Run.
+type BenchReport struct {
+	Rate       int
+	Sending    time.Duration
+	SentBytes  int64
+	Total      BenchResult
+	Formats    []BenchResult
+	Duplicates int64
+
+	// Time from the start of the run to the last received message
+	Elapsed time.Duration
+}
+
+// ParseBenchFormats parses a comma delimited list of formats, "all"
+// selects every format.
+func ParseBenchFormats(str string) ([]string, error) {
+	if str == "all" {
+		return BenchFormats, nil
+	}
+
+	formats := []string{}
+	for _, format := range strings.Split(str, ",") {
+		format = strings.TrimSpace(format)
+		if format == "" {
+			continue
+		}
+		known := false
+		for _, f := range BenchFormats {
+			if f == format {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown format %s, valid formats are %s", format, strings.Join(BenchFormats, ", "))
+		}
+		formats = append(formats, format)
+	}
+
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("No formats given")
+	}
+	return formats, nil
+}
+
+// NewBenchRunID returns a random id for a run.
+func NewBenchRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Init checks the configuration and prepares a run. It must be called
+// before Run and before messages are passed to Receive.
+func (b *Bench) Init() error {
+	if b.Rate <= 0 {
+		return fmt.Errorf("Rate must be positive")
+	}
+	if b.Services <= 0 {
+		b.Services = 1
+	}
+	if b.ChunkSize <= 0 {
+		b.ChunkSize = DefaultBenchChunkSize
+	}
+	if b.ChunkSize <= graylogChunkHeaderSize {
+		return fmt.Errorf("Chunk size must be over %d bytes", graylogChunkHeaderSize)
+	}
+	if b.RunID == "" {
+		b.RunID = NewBenchRunID()
+	}
+
+	b.sent = make(map[string]int64)
+	b.received = make(map[string]int64)
+	b.latencies = make(map[string][]time.Duration)
+	b.seen = make(map[int64]bool)
+
+	// Check the largest messages up front instead of failing in the middle
+	// of the run
+	for _, format := range b.Formats {
+		packets, err := b.Packets(format, 0, time.Now())
+		if err != nil {
+			return err
+		}
+		max := maxGraylogPacketSize
+		if isSyslogBenchFormat(format) {
+			max = maxSyslogPacketSize
+		}
+		if len(packets[0]) > max {
+			return fmt.Errorf("%s packets are %d bytes with size %d, over the %d bytes the input reads", format, len(packets[0]), b.Size, max)
+		}
+	}
+	return nil
+}
+
+func isSyslogBenchFormat(format string) bool {
+	return format == "rfc3164" || format == "rfc5424"
+}
+
+// Service returns the service of a message.
+func (b *Bench) Service(seq int64) string {
+	return "bench-" + strconv.FormatInt(seq%int64(b.Services), 10)
+}
+
+// Payload returns the JSON document of a message, which is sent as the
+// syslog payload or GELF short_message as applications log it.
+func (b *Bench) Payload(format string, seq int64, now time.Time) []byte {
+	buf := make([]byte, 0, b.Size+200)
+	buf = append(buf, `{"service":`...)
+	buf = appendJSONString(buf, b.Service(seq))
+	buf = append(buf, `,"level":"INFO","bench_run":`...)
+	buf = appendJSONString(buf, b.RunID)
+	buf = append(buf, `,"bench_seq":`...)
+	buf = strconv.AppendInt(buf, seq, 10)
+	buf = append(buf, `,"bench_sent":"`...)
+	buf = strconv.AppendInt(buf, now.UnixNano(), 10)
+	buf = append(buf, `","bench_format":`...)
+	buf = appendJSONString(buf, format)
+	buf = append(buf, `,"msg":"`...)
+	buf = appendBenchWords(buf, b.Size, uint64(seq))
+	buf = append(buf, `"}`...)
+	return buf
+}
+
+var benchWords = []string{"request", "handled", "user", "session", "error", "timeout",
+	"connection", "retry", "cache", "miss", "hit", "query", "took", "ms", "status",
+	"ok", "failed", "id", "upstream", "response", "bytes", "worker", "started", "done"}
+
+// appendBenchWords appends size bytes of pseudo random words, so that the
+// messages compress about as well as real log lines.
+func appendBenchWords(buf []byte, size int, seed uint64) []byte {
+	x := seed*2654435761 + 1
+	end := len(buf) + size
+	for len(buf) < end {
+		// xorshift
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		word := benchWords[x%uint64(len(benchWords))]
+		if x&0x30 == 0 {
+			word = strconv.FormatUint(x%10000, 10)
+		}
+		buf = append(buf, word...)
+		buf = append(buf, ' ')
+	}
+	return buf[:end]
+}
+
+// Packets returns the UDP packets of a message in the given format.
+func (b *Bench) Packets(format string, seq int64, now time.Time) ([][]byte, error) {
+	payload := b.Payload(format, seq, now)
+	service := b.Service(seq)
+	tag := "docker/" + service + "/0123456789ab/logs2kafka/bench:latest"
+
+	switch format {
+	case "rfc3164":
+		packet := fmt.Sprintf("<14>%s logs2kafka-bench %s[1]: %s", now.Format(time.Stamp), tag, payload)
+		return [][]byte{[]byte(packet)}, nil
+	case "rfc5424":
+		// As written by the Docker syslog driver: the tag is both the
+		// APP-NAME and the MSGID, and the STRUCTURED-DATA is always "-"
+		tag = strings.TrimPrefix(tag, "docker/")
+		packet := fmt.Sprintf("<14>1 %s logs2kafka-bench %s 1 %s - %s", now.UTC().Format(time.RFC3339Nano), tag, tag, payload)
+		return [][]byte{[]byte(packet)}, nil
+	}
+
+	doc := make([]byte, 0, len(payload)+300)
+	doc = append(doc, `{"version":"1.1","host":"logs2kafka-bench","short_message":`...)
+	doc = appendJSONString(doc, string(payload))
+	doc = append(doc, `,"timestamp":`...)
+	doc = appendJSONFloat(doc, float64(now.UnixNano())/1e9)
+	doc = append(doc, `,"level":6,"_container_name":`...)
+	doc = appendJSONString(doc, service)
+	doc = append(doc, `,"_container_id":"0123456789ab","_image_name":"logs2kafka/bench:latest"}`...)
+
+	switch format {
+	case "gelf":
+		return [][]byte{doc}, nil
+	case "gelf-chunked":
+		return b.chunk(doc, seq, true)
+	case "gelf-gzip", "gelf-zlib":
+		var compressed bytes.Buffer
+		var w io.WriteCloser
+		if format == "gelf-gzip" {
+			w = gzip.NewWriter(&compressed)
+		} else {
+			w = zlib.NewWriter(&compressed)
+		}
+		w.Write(doc)
+		w.Close()
+		return b.chunk(compressed.Bytes(), seq, false)
+	}
+
+	return nil, fmt.Errorf("Unknown format %s", format)
+}
+
+// chunk splits a message into GELF chunks. Messages which fit into one
+// packet are only chunked if always is set.
+func (b *Bench) chunk(doc []byte, seq int64, always bool) ([][]byte, error) {
+	if !always && len(doc) <= b.ChunkSize {
+		return [][]byte{doc}, nil
+	}
+
+	size := b.ChunkSize - graylogChunkHeaderSize
+	count := (len(doc) + size - 1) / size
+	if count > MaxGraylogChunks {
+		return nil, fmt.Errorf("GELF messages of %d bytes need %d chunks of %d bytes, at most %d are allowed", len(doc), count, b.ChunkSize, MaxGraylogChunks)
+	}
+
+	id := make([]byte, 8)
+	copy(id, b.RunID)
+	binary.BigEndian.PutUint32(id[4:], uint32(seq))
+
+	packets := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(doc) {
+			end = len(doc)
+		}
+		packet := make([]byte, 0, graylogChunkHeaderSize+end-i*size)
+		packet = append(packet, 0x1e, 0x0f)
+		packet = append(packet, id...)
+		packet = append(packet, byte(i), byte(count))
+		packet = append(packet, doc[i*size:end]...)
+		packets = append(packets, packet)
+	}
+	return packets, nil
+}
+
+// Run sends messages for the duration and then waits until wait has passed
+// without receiving messages of the run.
+func (b *Bench) Run(wait time.Duration) (*BenchReport, error) {
+	// One socket for each address, formats to the same address share it
+	conns := make(map[string]*net.UDPConn)
+	formatConns := make(map[string]*net.UDPConn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, format := range b.Formats {
+		addr := b.GraylogAddr
+		if isSyslogBenchFormat(format) {
+			addr = b.SyslogAddr
+		}
+		if conns[addr] == nil {
+			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := net.DialUDP("udp", nil, udpAddr)
+			if err != nil {
+				return nil, err
+			}
+			conns[addr] = conn
+		}
+		formatConns[format] = conns[addr]
+	}
+
+	// The messages are sent in bursts every millisecond so that high rates
+	// don't depend on the resolution of sleeping
+	start := time.Now()
+	var seq int64
+	for {
+		now := time.Now()
+		elapsed := now.Sub(start)
+		if elapsed >= b.Duration {
+			break
+		}
+
+		target := int64(elapsed.Seconds() * float64(b.Rate))
+		for ; seq < target; seq++ {
+			format := b.Formats[seq%int64(len(b.Formats))]
+			packets, err := b.Packets(format, seq, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			for _, packet := range packets {
+				// Send errors, eg. ICMP port unreachable, are counted as loss
+				formatConns[format].Write(packet)
+				b.sentBytes += int64(len(packet))
+			}
+			b.mutex.Lock()
+			b.sent[format]++
+			b.mutex.Unlock()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sending := time.Since(start)
+
+	b.mutex.Lock()
+	b.lastSeen = time.Now()
+	b.mutex.Unlock()
+	for wait > 0 {
+		time.Sleep(wait / 10)
+		b.mutex.Lock()
+		idle := time.Since(b.lastSeen)
+		done := int64(len(b.seen)) >= seq
+		b.mutex.Unlock()
+		if idle >= wait || done {
+			break
+		}
+	}
+
+	return b.Report(sending, start), nil
+}
+
+// Receive matches a forwarded message to the sent ones. Messages of other
+// runs and other services are ignored.
+func (b *Bench) Receive(data []byte) {
+	now := time.Now()
+
+	m := Message{Data: data}
+	run, ok := m.FieldString("bench_run")
+	if !ok || run != b.RunID {
+		return
+	}
+	seq, ok := m.Float("bench_seq")
+	if !ok {
+		return
+	}
+	format, _ := m.FieldString("bench_format")
+
+	var latency time.Duration
+	if sent, ok := m.FieldString("bench_sent"); ok {
+		ns, err := strconv.ParseInt(sent, 10, 64)
+		if err == nil {
+			latency = now.Sub(time.Unix(0, ns))
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastSeen = now
+	if b.seen[int64(seq)] {
+		b.duplicate++
+		return
+	}
+	b.seen[int64(seq)] = true
+	b.received[format]++
+	b.latencies[format] = append(b.latencies[format], latency)
+}
+
+// Report returns the results so far.
+func (b *Bench) Report(sending time.Duration, start time.Time) *BenchReport {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	r := &BenchReport{
+		Rate:       b.Rate,
+		Sending:    sending,
+		SentBytes:  b.sentBytes,
+		Duplicates: b.duplicate,
+		Elapsed:    b.lastSeen.Sub(start),
+	}
+
+	for _, format := range b.Formats {
+		// A format can be given twice to send more of it
+		dup := false
+		for _, f := range r.Formats {
+			if f.Format == format {
+				dup = true
+			}
+		}
+		if dup {
+			continue
+		}
+
+		result := BenchResult{
+			Format:    format,
+			Sent:      b.sent[format],
+			Received:  b.received[format],
+			Latencies: append([]time.Duration(nil), b.latencies[format]...),
+		}
+		sortDurations(result.Latencies)
+		r.Formats = append(r.Formats, result)
+
+		r.Total.Sent += result.Sent
+		r.Total.Received += result.Received
+		r.Total.Latencies = append(r.Total.Latencies, result.Latencies...)
+	}
+	sortDurations(r.Total.Latencies)
+
+	return r
+}
+
+func sortDurations(d []time.Duration) {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+}
+
+// Print writes the report in a human readable form.
+func (r *BenchReport) Print(w io.Writer) {
+	seconds := r.Sending.Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	fmt.Fprintf(w, "Sent %d messages in %.1fs: %.0f messages/s (target %d/s), %.2f MB/s\n",
+		r.Total.Sent, seconds, float64(r.Total.Sent)/seconds, r.Rate, float64(r.SentBytes)/seconds/1e6)
+
+	lossPercent := 0.0
+	if r.Total.Sent > 0 {
+		lossPercent = float64(r.Total.Lost()) / float64(r.Total.Sent) * 100
+	}
+	fmt.Fprintf(w, "Received %d messages, lost %d (%.2f%%), %d duplicates\n", r.Total.Received, r.Total.Lost(), lossPercent, r.Duplicates)
+	if r.Total.Received > 0 && r.Elapsed > 0 {
+		fmt.Fprintf(w, "Forwarded %.0f messages/s\n", float64(r.Total.Received)/r.Elapsed.Seconds())
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "format\tsent\treceived\tlost\tp50\tp95\tp99\tmax\t\n")
+	for _, result := range append(r.Formats, BenchResult{}) {
+		if result.Format == "" {
+			result = r.Total
+			result.Format = "total"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t\n", result.Format, result.Sent, result.Received, result.Lost(),
+			formatLatency(result.Percentile(0.5)), formatLatency(result.Percentile(0.95)),
+			formatLatency(result.Percentile(0.99)), formatLatency(result.Percentile(1)))
+	}
+	tw.Flush()
+}
+
+func formatLatency(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", d.Seconds()*1000)
+}
+
+// ServeHTTP receives the messages posted by a logs2kafka http output, eg.
+// --output 'http?url=http://localhost:8090/', as a stand-in for Kafka.
+func (b *Bench) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.Receive(data)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BenchFileReceiver follows the local log files the daemon writes for the
+// bench services in --disable-kafka mode and passes the new lines to the
+// bench.
+type BenchFileReceiver struct {
+	Dir   string
+	Bench *Bench
+
+	// The topic prefix of the daemon, the files are <prefix>.<service>.log
+	Prefix string
+
+	// How often the files are checked for new lines
+	Interval time.Duration
+
+	files map[string]*benchFile
+	close chan bool
+	done  sync.WaitGroup
+}
+
+type benchFile struct {
+	file    *os.File
+	partial []byte
+}
+
+// Start skips the existing content of the files and starts following them.
+func (r *BenchFileReceiver) Start(services int) {
+	if r.Interval <= 0 {
+		r.Interval = 10 * time.Millisecond
+	}
+	r.files = make(map[string]*benchFile)
+	r.close = make(chan bool)
+
+	for i := 0; i < services; i++ {
+		path := filepath.Join(r.Dir, r.Prefix+".bench-"+strconv.Itoa(i)+".log")
+		f := &benchFile{}
+		if file, err := os.Open(path); err == nil {
+			file.Seek(0, os.SEEK_END)
+			f.file = file
+		}
+		r.files[path] = f
+	}
+
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.close:
+				r.poll()
+				return
+			case <-ticker.C:
+				r.poll()
+			}
+		}
+	}()
+}
+
+func (r *BenchFileReceiver) poll() {
+	for path, f := range r.files {
+		if f.file != nil {
+			r.read(f)
+		}
+
+		// Files are created by the first message and replaced when they
+		// are rotated. The rest of the old file has been read above.
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if f.file != nil {
+			current, err := f.file.Stat()
+			if err == nil && os.SameFile(info, current) {
+				continue
+			}
+			f.file.Close()
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			f.file = nil
+			continue
+		}
+		f.file = file
+		f.partial = nil
+		r.read(f)
+	}
+}
+
+func (r *BenchFileReceiver) read(f *benchFile) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.file.Read(buf)
+		data := append(f.partial, buf[:n]...)
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i == -1 {
+				break
+			}
+			r.Bench.Receive(data[:i])
+			data = data[i+1:]
+		}
+		f.partial = append([]byte(nil), data...)
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+// Close stops following the files.
+func (r *BenchFileReceiver) Close() {
+	close(r.close)
+	r.done.Wait()
+	for _, f := range r.files {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBenchFormats(t *testing.T) {
+	formats, err := ParseBenchFormats("all")
+	assert.Nil(t, err)
+	assert.Equal(t, BenchFormats, formats)
+
+	formats, err = ParseBenchFormats("rfc3164, gelf-gzip")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"rfc3164", "gelf-gzip"}, formats)
+
+	_, err = ParseBenchFormats("rfc3164,json")
+	assert.NotNil(t, err)
+	_, err = ParseBenchFormats("")
+	assert.NotNil(t, err)
+}
+
+// The generated packets go through the inputs and the forwarded messages
+// are matched back.
+func TestBenchPackets(t *testing.T) {
+	b := &Bench{Formats: BenchFormats, Rate: 1, Size: 3000, Services: 3, ChunkSize: 1000, RunID: "test"}
+	assert.Nil(t, b.Init())
+
+	syslog := Syslog{Messages: make(chan Message, 10)}
+	graylog := Graylog{Messages: make(chan Message, 10)}
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+
+	for seq, format := range BenchFormats {
+		packets, err := b.Packets(format, int64(seq), time.Now())
+		assert.Nil(t, err)
+		b.sent[format]++
+
+		var m Message
+		if isSyslogBenchFormat(format) {
+			assert.Equal(t, 1, len(packets))
+			syslog.HandlePacket(packets[0], addr)
+			m = <-syslog.Messages
+		} else {
+			if format == "gelf" {
+				assert.Equal(t, 1, len(packets))
+			} else {
+				// Also the compressed messages are over the chunk size
+				assert.True(t, len(packets) > 1, format)
+			}
+			for _, packet := range packets {
+				assert.Nil(t, graylog.ParseGraylogMessageFrom(packet, addr), format)
+			}
+			m = <-graylog.Messages
+		}
+
+		EnsureMessageFormat(ServerInfo{}, &m)
+		assert.Equal(t, "bench-"+strconv.Itoa(seq%3), m.Topic, format)
+		value, _ := m.FieldString("msg")
+		assert.Equal(t, 3000, len(value), format)
+
+		b.Receive(m.Bytes())
+	}
+
+	// Duplicates and messages of other runs are not counted
+	packets, _ := b.Packets("gelf", 0, time.Now())
+	b.Receive(packets[0])
+	b.Receive(b.Payload("gelf", 0, time.Now()))
+	other := &Bench{Services: 1, RunID: "other"}
+	b.Receive(other.Payload("gelf", 100, time.Now()))
+
+	report := b.Report(time.Second, time.Now())
+	assert.Equal(t, int64(len(BenchFormats)), report.Total.Sent)
+	assert.Equal(t, int64(len(BenchFormats)), report.Total.Received)
+	assert.Equal(t, int64(0), report.Total.Lost())
+	assert.Equal(t, int64(1), report.Duplicates)
+	assert.Equal(t, len(BenchFormats), len(report.Formats))
+	assert.True(t, report.Total.Percentile(0.99) > 0)
+}
+
+func TestBenchLimits(t *testing.T) {
+	b := &Bench{Formats: []string{"rfc3164"}, Rate: 1, Size: 9000}
+	assert.NotNil(t, b.Init())
+
+	b = &Bench{Formats: []string{"gelf-chunked"}, Rate: 1, Size: 20000, ChunkSize: 100}
+	assert.NotNil(t, b.Init())
+
+	b = &Bench{Formats: []string{"gelf-chunked"}, Rate: 1, Size: 20000}
+	assert.Nil(t, b.Init())
+}
+
+func TestBenchRun(t *testing.T) {
+	syslog := Syslog{Messages: make(chan Message, 100)}
+	assert.Nil(t, syslog.Init(0))
+	defer syslog.Close()
+
+	graylog := Graylog{Messages: syslog.Messages}
+	assert.Nil(t, graylog.Init(0))
+	defer graylog.Close()
+
+	b := &Bench{
+		SyslogAddr:  "127.0.0.1:" + strconv.Itoa(syslog.listener.Port()),
+		GraylogAddr: "127.0.0.1:" + strconv.Itoa(graylog.listener.Port()),
+		Formats:     BenchFormats,
+		Rate:        300,
+		Duration:    200 * time.Millisecond,
+		Services:    2,
+	}
+
+	assert.Nil(t, b.Init())
+	go func() {
+		for m := range syslog.Messages {
+			EnsureMessageFormat(ServerInfo{}, &m)
+			b.Receive(m.Bytes())
+		}
+	}()
+
+	report, err := b.Run(time.Second)
+	assert.Nil(t, err)
+	close(syslog.Messages)
+
+	assert.True(t, report.Total.Sent > 30)
+	assert.Equal(t, report.Total.Sent, report.Total.Received)
+
+	out := &bytes.Buffer{}
+	report.Print(out)
+	assert.Contains(t, out.String(), "lost 0 (0.00%)")
+	assert.Contains(t, out.String(), "gelf-zlib")
+}
+
+func TestBenchFileReceiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	b := &Bench{Formats: []string{"gelf"}, Rate: 1, Services: 2, RunID: "test"}
+	assert.Nil(t, b.Init())
+
+	line := func(seq int64) string {
+		return string(b.Payload("gelf", seq, time.Now())) + "\n"
+	}
+
+	// Lines written before the start are skipped
+	assert.Nil(t, ioutil.WriteFile(dir+"/service.bench-0.log", []byte(line(0)), 0644))
+
+	r := &BenchFileReceiver{Dir: dir, Prefix: "service", Bench: b, Interval: time.Millisecond}
+	r.Start(2)
+
+	// Waits until the receiver has matched the given number of messages
+	waitReceived := func(n int64) {
+		for i := 0; i < 500 && b.Report(time.Second, time.Now()).Total.Received < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	f, err := os.OpenFile(dir+"/service.bench-0.log", os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	l := line(2)
+	f.WriteString(l[:10])
+	time.Sleep(10 * time.Millisecond)
+	f.WriteString(l[10:])
+	f.Close()
+	waitReceived(1)
+
+	// New and rotated files are read from the beginning
+	assert.Nil(t, ioutil.WriteFile(dir+"/service.bench-1.log", []byte(line(1)+line(3)), 0644))
+	waitReceived(3)
+	assert.Nil(t, os.Rename(dir+"/service.bench-1.log", dir+"/service.bench-1-2017-05-19T06-05-22.000.log"))
+	assert.Nil(t, ioutil.WriteFile(dir+"/service.bench-1.log", []byte(line(5)), 0644))
+	waitReceived(4)
+
+	r.Close()
+
+	report := b.Report(time.Second, time.Now())
+	assert.Equal(t, int64(4), report.Total.Received)
+}
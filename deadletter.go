@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Jeffail/gabs"
+)
+
+// Suffix of the dead-letter topics and files, eg. service.foo.dead-letter.log
+const DeadLetterSuffix = ".dead-letter"
+
+// DeadLetterLog stores messages which couldn't be produced into Kafka into
+// local log files, one per topic, next to the local copies of the messages.
+// The files have the same format as the other local log files, so they can
+// be viewed with tail and search and produced again with "replay
+// --dead-letter". The failure is recorded into a "dead_letter" field.
+type DeadLetterLog struct {
+	Output *FileOutput
+
+	mutex sync.Mutex
+}
+
+func NewDeadLetterLog(path string) *DeadLetterLog {
+	return &DeadLetterLog{Output: NewFileOutput(path)}
+}
+
+// Write stores the message with the reason why it failed.
+func (s *DeadLetterLog) Write(m *Message, reason error, attempts int) error {
+	// The message may still be shared with the other outputs, so it's
+	// copied instead of modified
+	container, err := gabs.ParseJSON(m.Bytes())
+	if err != nil {
+		return err
+	}
+
+	container.Set(reason.Error(), "dead_letter", "reason")
+	container.Set(float64(attempts), "dead_letter", "attempts")
+	container.Set(time.Now().UTC().Format(time.RFC3339Nano), "dead_letter", "ts")
+
+	dead := Message{
+		Topic:     m.Topic + DeadLetterSuffix,
+		Container: container,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Output.Write(&dead)
+}
+
+func (s *DeadLetterLog) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Output.Close()
+}
+
+// DeadLetterLogFiles returns the directory and the dead-letter log files of
+// a service in chronological order, as LocalLogFiles does for the local
+// copies. The files are in deadLetterPath, or in fileLogsPath if it's empty.
+func DeadLetterLogFiles(deadLetterPath string, fileLogsPath string, service string) (string, []string, error) {
+	dir := deadLetterPath
+	if dir == "" {
+		dir = fileLogsPath
+	}
+
+	files, err := LocalLogFiles(dir, service+DeadLetterSuffix)
+	return dir, files, err
+}
+
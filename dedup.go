@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Jeffail/gabs"
+)
+
+// Deduplicator collapses repeated identical messages, such as the log
+// storms of crash looping containers. Messages are identical when they
+// have the same service, level and normalised msg.
+//
+// The first occurrence is forwarded as is and the repeats within Window
+// are suppressed. When the window ends, a summary message with the fields
+// of the first occurrence and "repeat_count" (the number of suppressed
+// repeats), "first_ts" and "last_ts" is emitted by Flush.
+type Deduplicator struct {
+	Window time.Duration
+
+	// Maximum number of distinct messages tracked at once. Messages which
+	// don't fit are forwarded without deduplication.
+	MaxKeys int
+
+	Statsd StatisticsSender
+
+	entries map[string]*dedupEntry
+
+	// Summaries of the windows which ended when a new one was started,
+	// returned by the next Flush
+	ended []Message
+
+	now func() time.Time
+}
+
+type dedupEntry struct {
+	// The first occurrence is serialised because the message itself is
+	// shared with the outputs once forwarded
+	first  []byte
+	topic  string
+	source string
+
+	firstTs string
+	lastTs  string
+
+	count int
+
+	expiration time.Time
+}
+
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		Window:  window,
+		MaxKeys: 10000,
+		entries: make(map[string]*dedupEntry),
+		now:     time.Now,
+	}
+}
+
+// Process returns false if the message is a repeat and must be dropped.
+func (s *Deduplicator) Process(m *Message) bool {
+	if m.ParseFields() != nil {
+		return true
+	}
+
+	service, _ := m.FieldString("service")
+	level, _ := m.FieldString("level")
+	msg, ok := m.FieldString("msg")
+	if !ok {
+		return true
+	}
+	ts, _ := m.FieldString("ts")
+
+	key := service + "\x00" + level + "\x00" + NormaliseMessage(msg)
+	now := s.now()
+
+	e, found := s.entries[key]
+	if found && now.Before(e.expiration) {
+		e.count++
+		e.lastTs = ts
+		if s.Statsd != nil {
+			s.Statsd.Inc(fmt.Sprintf("logs2kafka.dedup.suppressed,service=%s", service), 1, 0.1)
+		}
+		return false
+	}
+
+	if !found && len(s.entries) >= s.MaxKeys {
+		return true
+	}
+
+	// The window has expired but hasn't been flushed yet
+	if found && e.count > 0 {
+		summary, err := e.summary(now)
+		if err == nil {
+			s.ended = append(s.ended, summary)
+		}
+	}
+
+	s.entries[key] = &dedupEntry{
+		first:      m.Bytes(),
+		topic:      m.Topic,
+		source:     m.Source,
+		firstTs:    ts,
+		lastTs:     ts,
+		expiration: now.Add(s.Window),
+	}
+
+	return true
+}
+
+// Flush ends the windows which have expired, or all of them if all is
+// true, and returns a summary message for each of them which had repeats.
+func (s *Deduplicator) Flush(all bool) []Message {
+	summaries := s.ended
+	s.ended = nil
+	now := s.now()
+
+	for key, e := range s.entries {
+		if !all && now.Before(e.expiration) {
+			continue
+		}
+		delete(s.entries, key)
+
+		if e.count == 0 {
+			continue
+		}
+
+		summary, err := e.summary(now)
+		if err != nil {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries
+}
+
+func (e *dedupEntry) summary(now time.Time) (Message, error) {
+	container, err := gabs.ParseJSON(e.first)
+	if err != nil {
+		return Message{}, err
+	}
+
+	m := Message{
+		Topic:      e.topic,
+		Container:  container,
+		Source:     e.source,
+		ReceivedAt: now,
+	}
+
+	m.Container.Set(now.UTC().Format(time.RFC3339Nano), "ts")
+	m.Container.Set(float64(e.count), "repeat_count")
+	m.Container.Set(e.firstTs, "first_ts")
+	m.Container.Set(e.lastTs, "last_ts")
+
+	return m, nil
+}
+
+// NormaliseMessage makes messages which only differ by numbers (such as
+// timestamps, ids and durations) or surrounding whitespace identical.
+func NormaliseMessage(msg string) string {
+	msg = strings.TrimSpace(msg)
+
+	var b bytes.Buffer
+	b.Grow(len(msg))
+	digits := false
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if IsDigit(c) {
+			if !digits {
+				b.WriteByte('#')
+			}
+			digits = true
+			continue
+		}
+		digits = false
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
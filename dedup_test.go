@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseMessage(t *testing.T) {
+	assert.Equal(t, "Request # took #.#ms", NormaliseMessage(" Request 1234 took 12.5ms\n"))
+	assert.Equal(t, "no numbers", NormaliseMessage("no numbers"))
+}
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Date(2017, 5, 19, 6, 5, 22, 0, time.UTC)
+
+	s := NewDeduplicator(10 * time.Second)
+	s.now = func() time.Time { return now }
+
+	message := func(ts string, level string, msg string) *Message {
+		m := JSONToMessage(`{"service":"foo","host":"bar"}`)
+		m.ParseJSON()
+		m.Topic = "foo"
+		m.Container.Set(ts, "ts")
+		m.Container.Set(level, "level")
+		m.Container.Set(msg, "msg")
+		return &m
+	}
+
+	assert.Equal(t, true, s.Process(message("2017-05-19T06:05:22Z", "ERROR", "Crashed after 5 seconds")))
+	assert.Equal(t, false, s.Process(message("2017-05-19T06:05:23Z", "ERROR", "Crashed after 6 seconds")))
+	assert.Equal(t, false, s.Process(message("2017-05-19T06:05:24Z", "ERROR", "Crashed after 7 seconds")))
+
+	// Different level or message is not a repeat
+	assert.Equal(t, true, s.Process(message("2017-05-19T06:05:24Z", "INFO", "Crashed after 7 seconds")))
+	assert.Equal(t, true, s.Process(message("2017-05-19T06:05:24Z", "ERROR", "Started")))
+
+	assert.Equal(t, 0, len(s.Flush(false)))
+
+	now = now.Add(11 * time.Second)
+	summaries := s.Flush(false)
+	assert.Equal(t, 1, len(summaries))
+	assert.Equal(t, "foo", summaries[0].Topic)
+
+	value, _ := summaries[0].FieldString("msg")
+	assert.Equal(t, "Crashed after 5 seconds", value)
+	value, _ = summaries[0].FieldString("repeat_count")
+	assert.Equal(t, "2", value)
+	value, _ = summaries[0].FieldString("first_ts")
+	assert.Equal(t, "2017-05-19T06:05:22Z", value)
+	value, _ = summaries[0].FieldString("last_ts")
+	assert.Equal(t, "2017-05-19T06:05:24Z", value)
+	value, _ = summaries[0].FieldString("ts")
+	assert.Equal(t, "2017-05-19T06:05:33Z", value)
+	value, _ = summaries[0].FieldString("host")
+	assert.Equal(t, "bar", value)
+
+	assert.Equal(t, 0, len(s.entries))
+
+	// A new window starts after the previous one has ended
+	assert.Equal(t, true, s.Process(message("2017-05-19T06:05:33Z", "ERROR", "Crashed after 8 seconds")))
+	assert.Equal(t, false, s.Process(message("2017-05-19T06:05:34Z", "ERROR", "Crashed after 9 seconds")))
+}
+
+func TestDeduplicatorRepeatAfterExpiry(t *testing.T) {
+	now := time.Date(2017, 5, 19, 6, 5, 22, 0, time.UTC)
+
+	s := NewDeduplicator(10 * time.Second)
+	s.now = func() time.Time { return now }
+
+	message := func(ts string) *Message {
+		m := JSONToMessage(`{"service":"foo","level":"ERROR","msg":"Crashed"}`)
+		m.ParseJSON()
+		m.Container.Set(ts, "ts")
+		return &m
+	}
+
+	assert.Equal(t, true, s.Process(message("2017-05-19T06:05:22Z")))
+	assert.Equal(t, false, s.Process(message("2017-05-19T06:05:23Z")))
+	assert.Equal(t, false, s.Process(message("2017-05-19T06:05:24Z")))
+
+	// The repeat after the window starts a new one before Flush has ended
+	// the old one, whose summary must not be lost
+	now = now.Add(11 * time.Second)
+	assert.Equal(t, true, s.Process(message("2017-05-19T06:05:33Z")))
+	assert.Equal(t, false, s.Process(message("2017-05-19T06:05:34Z")))
+
+	summaries := s.Flush(false)
+	assert.Equal(t, 1, len(summaries))
+	value, _ := summaries[0].FieldString("repeat_count")
+	assert.Equal(t, "2", value)
+	value, _ = summaries[0].FieldString("last_ts")
+	assert.Equal(t, "2017-05-19T06:05:24Z", value)
+	assert.Equal(t, 0, len(s.Flush(false)))
+
+	now = now.Add(11 * time.Second)
+	summaries = s.Flush(false)
+	assert.Equal(t, 1, len(summaries))
+	value, _ = summaries[0].FieldString("repeat_count")
+	assert.Equal(t, "1", value)
+}
+
+func TestDeduplicatorFlushAll(t *testing.T) {
+	s := NewDeduplicator(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		m := JSONToMessage(`{"service":"foo","msg":"Crashed"}`)
+		m.ParseJSON()
+		s.Process(&m)
+	}
+	m := JSONToMessage(`{"service":"foo","msg":"Started"}`)
+	m.ParseJSON()
+	s.Process(&m)
+
+	assert.Equal(t, 0, len(s.Flush(false)))
+
+	summaries := s.Flush(true)
+	assert.Equal(t, 1, len(summaries))
+	value, _ := summaries[0].FieldString("repeat_count")
+	assert.Equal(t, "2", value)
+	assert.Equal(t, 0, len(s.entries))
+}
+
+func TestDeduplicatorMaxKeys(t *testing.T) {
+	s := NewDeduplicator(10 * time.Second)
+	s.MaxKeys = 1
+
+	m := JSONToMessage(`{"service":"foo","msg":"first"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, s.Process(&m))
+
+	m = JSONToMessage(`{"service":"foo","msg":"second"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, s.Process(&m))
+	assert.Equal(t, true, s.Process(&m))
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DockerEnricher adds container metadata to messages which carry a
+// container_id, such as the syslog messages sent by the Docker syslog log
+// driver. The container is looked up from the Docker Engine API over its
+// unix socket and the results are cached. The lookups are done in the
+// background, so the messages of a container are forwarded without the
+// metadata until its lookup has finished.
+//
+// Labels and environment variables are added with the same "_" prefixed
+// names the GELF log driver uses, eg. "_io.kubernetes.pod.name", so that
+// messages look the same regardless of which driver sent them.
+type DockerEnricher struct {
+	// Path of the Docker Engine API socket, eg. /var/run/docker.sock
+	Socket string
+
+	// Labels to copy into the message. Each entry is either a label name or
+	// "label=field" to use a different field name.
+	Labels []string
+
+	// Allowlist of environment variables to copy into the message, with the
+	// same "name=field" syntax as Labels.
+	Env []string
+
+	// How long a lookup result is cached. Failed lookups are cached for the
+	// same time so that an unknown container doesn't cause a request for
+	// each of its messages.
+	CacheTTL time.Duration
+
+	Statsd StatisticsSender
+
+	client *http.Client
+
+	mutex   sync.Mutex
+	cache   map[string]*dockerContainerInfo
+	pending map[string]bool
+	lookups sync.WaitGroup
+}
+
+// Maximum number of containers looked up at the same time. Messages of
+// other uncached containers are forwarded as is until there is room.
+const maxPendingDockerLookups = 16
+
+// Kubernetes labels which the kubelet sets on each container
+var DefaultDockerLabels = []string{
+	"io.kubernetes.pod.namespace",
+	"io.kubernetes.pod.name",
+	"io.kubernetes.container.name",
+}
+
+type dockerContainerInfo struct {
+	// Fields to add to the messages of the container, nil if the lookup failed
+	fields map[string]string
+
+	expiration time.Time
+}
+
+// Subset of the GET /containers/{id}/json response
+type dockerInspectResponse struct {
+	Id     string
+	Name   string
+	Config struct {
+		Image  string
+		Labels map[string]string
+		Env    []string
+	}
+}
+
+func NewDockerEnricher(socket string) *DockerEnricher {
+	return &DockerEnricher{
+		Socket:   socket,
+		Labels:   DefaultDockerLabels,
+		CacheTTL: 5 * time.Minute,
+		client: &http.Client{
+			Timeout: time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		cache:   make(map[string]*dockerContainerInfo),
+		pending: make(map[string]bool),
+	}
+}
+
+// Enrich adds the metadata of the message's container. Fields which
+// already exist in the message are not overwritten.
+func (s *DockerEnricher) Enrich(m *Message) {
+	id, err := m.GetString("container_id")
+	if err != nil || id == "" {
+		return
+	}
+
+	info := s.lookup(id)
+	if info == nil {
+		return
+	}
+	for field, value := range info.fields {
+		if !m.HasField(field) {
+			m.SetField(field, value)
+		}
+	}
+}
+
+// lookup returns the cached info of the container, nil if it isn't known
+// yet. An unknown or expired container is looked up in the background.
+func (s *DockerEnricher) lookup(id string) *dockerContainerInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	info, found := s.cache[id]
+	if found && now.Before(info.expiration) {
+		return info
+	}
+
+	// An expired info is used until it has been refreshed
+	if !s.pending[id] && len(s.pending) < maxPendingDockerLookups {
+		s.pending[id] = true
+		s.lookups.Add(1)
+		go s.fetch(id)
+	}
+
+	return info
+}
+
+func (s *DockerEnricher) fetch(id string) {
+	defer s.lookups.Done()
+
+	info := &dockerContainerInfo{}
+	container, err := s.Inspect(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error looking up container %s from docker: %s\n", id, err)
+		if s.Statsd != nil {
+			s.Statsd.Inc("logs2kafka.docker.lookup_errors", 1, 1)
+		}
+	} else {
+		info.fields = s.fields(container)
+		if s.Statsd != nil {
+			s.Statsd.Inc("logs2kafka.docker.lookups", 1, 1)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if len(s.cache) > 10000 {
+		s.expire(now)
+	}
+	info.expiration = now.Add(s.CacheTTL)
+	s.cache[id] = info
+	delete(s.pending, id)
+}
+
+// Close waits for the lookups in progress to finish.
+func (s *DockerEnricher) Close() {
+	s.lookups.Wait()
+}
+
+func (s *DockerEnricher) expire(now time.Time) {
+	for id, info := range s.cache {
+		if now.After(info.expiration) {
+			delete(s.cache, id)
+		}
+	}
+}
+
+// Inspect fetches the container details from the Docker Engine API. The id
+// can also be the short 12 character form used in syslog tags.
+func (s *DockerEnricher) Inspect(id string) (*dockerInspectResponse, error) {
+	resp, err := s.client.Get("http://docker/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("docker returned status %d", resp.StatusCode)
+	}
+
+	container := &dockerInspectResponse{}
+	err = json.NewDecoder(resp.Body).Decode(container)
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+func (s *DockerEnricher) fields(container *dockerInspectResponse) map[string]string {
+	fields := make(map[string]string)
+
+	if container.Name != "" {
+		fields["container_name"] = strings.TrimPrefix(container.Name, "/")
+	}
+	if container.Config.Image != "" {
+		fields["docker_image"] = container.Config.Image
+	}
+
+	for _, label := range s.Labels {
+		name, field := dockerFieldName(label)
+		if value, ok := container.Config.Labels[name]; ok {
+			fields[field] = value
+		}
+	}
+
+	env := make(map[string]string)
+	for _, e := range container.Config.Env {
+		keyvalue := strings.SplitN(e, "=", 2)
+		if len(keyvalue) == 2 {
+			env[keyvalue[0]] = keyvalue[1]
+		}
+	}
+	for _, allowed := range s.Env {
+		name, field := dockerFieldName(allowed)
+		if value, ok := env[name]; ok {
+			fields[field] = value
+		}
+	}
+
+	return fields
+}
+
+// dockerFieldName parses "name" or "name=field". The default field name is
+// the name prefixed with "_" as done by the GELF log driver.
+func dockerFieldName(spec string) (string, string) {
+	keyvalue := strings.SplitN(spec, "=", 2)
+	if len(keyvalue) == 2 {
+		return keyvalue[0], keyvalue[1]
+	}
+	return spec, "_" + spec
+}
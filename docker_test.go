@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDockerContainer = `{
+	"Id": "de57c44274f63c39455041c9515c0e12b856bef6533f8e4f8b3489852a0d7208",
+	"Name": "/k8s_ads-auction-comet-source-adapter_ads-auction-835331642-rzzgr_default_99baeb50-3bc3-11e7-a061-0a50dcb4a89e_1",
+	"Config": {
+		"Image": "registry2.applifier.info:5005/comet-source-adapter:f205ed11f1a2",
+		"Labels": {
+			"io.kubernetes.container.name": "ads-auction-comet-source-adapter",
+			"io.kubernetes.pod.name": "ads-auction-835331642-rzzgr",
+			"io.kubernetes.pod.namespace": "default",
+			"app": "ads-auction"
+		},
+		"Env": ["PATH=/usr/bin", "ENVIRONMENT=staging", "SECRET=foo"]
+	}
+}`
+
+// startFakeDocker serves the container inspect API on a unix socket and
+// counts the requests. If block isn't nil, the responses wait for it.
+func startFakeDocker(t *testing.T, block chan bool) (string, *int, func()) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	socket := dir + "/docker.sock"
+
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if block != nil {
+			<-block
+		}
+		if r.URL.Path == "/containers/de57c44274f6/json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(testDockerContainer))
+			return
+		}
+		http.Error(w, `{"message":"No such container"}`, http.StatusNotFound)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	return socket, &requests, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDockerEnricher(t *testing.T) {
+	socket, requests, stop := startFakeDocker(t, nil)
+	defer stop()
+
+	s := NewDockerEnricher(socket)
+	s.Labels = append(s.Labels, "app=app_name")
+	s.Env = []string{"ENVIRONMENT"}
+
+	// The first message is forwarded while the container is looked up
+	m := JSONToMessage(`{"msg":"hello","container_id":"de57c44274f6","container_name":"ads-auction-comet-source-adapter"}`)
+	m.ParseJSON()
+	s.Enrich(&m)
+	assert.Equal(t, false, m.HasField("_io.kubernetes.pod.name"))
+	s.lookups.Wait()
+
+	m = JSONToMessage(`{"msg":"hello","container_id":"de57c44274f6","container_name":"ads-auction-comet-source-adapter"}`)
+	m.ParseJSON()
+	s.Enrich(&m)
+
+	value, _ := m.FieldString("_io.kubernetes.pod.namespace")
+	assert.Equal(t, "default", value)
+	value, _ = m.FieldString("_io.kubernetes.pod.name")
+	assert.Equal(t, "ads-auction-835331642-rzzgr", value)
+	value, _ = m.FieldString("_io.kubernetes.container.name")
+	assert.Equal(t, "ads-auction-comet-source-adapter", value)
+	value, _ = m.FieldString("app_name")
+	assert.Equal(t, "ads-auction", value)
+	value, _ = m.FieldString("_ENVIRONMENT")
+	assert.Equal(t, "staging", value)
+	value, _ = m.FieldString("docker_image")
+	assert.Equal(t, "registry2.applifier.info:5005/comet-source-adapter:f205ed11f1a2", value)
+
+	// Existing fields are kept and env variables which aren't allowed are not copied
+	value, _ = m.FieldString("container_name")
+	assert.Equal(t, "ads-auction-comet-source-adapter", value)
+	_, ok := m.FieldString("_SECRET")
+	assert.Equal(t, false, ok)
+
+	m = JSONToMessage(`{"msg":"again","container_id":"de57c44274f6"}`)
+	m.ParseJSON()
+	s.Enrich(&m)
+	value, _ = m.FieldString("_io.kubernetes.pod.name")
+	assert.Equal(t, "ads-auction-835331642-rzzgr", value)
+	assert.Equal(t, 1, *requests)
+}
+
+func TestDockerEnricherUnknownContainer(t *testing.T) {
+	socket, requests, stop := startFakeDocker(t, nil)
+	defer stop()
+
+	s := NewDockerEnricher(socket)
+	s.CacheTTL = 50 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		m := JSONToMessage(`{"msg":"hello","container_id":"0123456789ab"}`)
+		m.ParseJSON()
+		s.Enrich(&m)
+		assert.Equal(t, `{"container_id":"0123456789ab","msg":"hello"}`, m.Container.String())
+		s.lookups.Wait()
+	}
+	assert.Equal(t, 1, *requests)
+
+	time.Sleep(60 * time.Millisecond)
+	m := JSONToMessage(`{"msg":"hello","container_id":"0123456789ab"}`)
+	m.ParseJSON()
+	s.Enrich(&m)
+	s.lookups.Wait()
+	assert.Equal(t, 2, *requests)
+
+	// Messages without a container are passed as is
+	m = JSONToMessage(`{"msg":"hello"}`)
+	m.ParseJSON()
+	s.Enrich(&m)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestDockerEnricherSlowLookup(t *testing.T) {
+	block := make(chan bool)
+	socket, requests, stop := startFakeDocker(t, block)
+	defer stop()
+
+	s := NewDockerEnricher(socket)
+
+	// Messages are not held up while docker is slow to answer
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		m := JSONToMessage(`{"msg":"hello","container_id":"de57c44274f6"}`)
+		m.ParseJSON()
+		s.Enrich(&m)
+		assert.Equal(t, false, m.HasField("_io.kubernetes.pod.name"))
+	}
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	close(block)
+	s.lookups.Wait()
+	assert.Equal(t, 1, *requests)
+
+	m := JSONToMessage(`{"msg":"hello","container_id":"de57c44274f6"}`)
+	m.ParseJSON()
+	s.Enrich(&m)
+	value, _ := m.FieldString("_io.kubernetes.pod.name")
+	assert.Equal(t, "ads-auction-835331642-rzzgr", value)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValueEncoder serializes a message into the value of a Kafka record.
+type ValueEncoder interface {
+	Encode(m *Message) ([]byte, error)
+}
+
+// JSONEncoder sends the message as a JSON document. This is the default.
+type JSONEncoder struct{}
+
+func (e JSONEncoder) Encode(m *Message) ([]byte, error) {
+	if err := m.ParseFields(); err != nil {
+		return nil, err
+	}
+	return m.Bytes(), nil
+}
+
+// NewValueEncoder creates an encoder by its name: "json", "avro", "protobuf"
+// or "msgpack". Avro requires the URL of a schema registry.
+func NewValueEncoder(name string, schemaRegistryURL string) (ValueEncoder, error) {
+	switch name {
+	case "", "json":
+		return JSONEncoder{}, nil
+	case "avro":
+		if schemaRegistryURL == "" {
+			return nil, fmt.Errorf("Avro encoding requires a schema registry url")
+		}
+		return NewAvroEncoder(NewSchemaRegistry(schemaRegistryURL)), nil
+	case "protobuf":
+		return ProtobufEncoder{}, nil
+	case "msgpack":
+		return MsgpackEncoder{}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown encoding %s", name)
+}
+
+// ParseTopicEncoders parses a comma delimited list of topic=encoding pairs,
+// eg. "service.foo=avro,service.bar=msgpack"
+func ParseTopicEncoders(str string, schemaRegistryURL string) (map[string]ValueEncoder, error) {
+	encoders := make(map[string]ValueEncoder)
+
+	if str == "" {
+		return encoders, nil
+	}
+
+	for _, part := range strings.Split(str, ",") {
+		keyvalue := strings.SplitN(part, "=", 2)
+		if len(keyvalue) != 2 || keyvalue[0] == "" {
+			return nil, fmt.Errorf("Invalid topic encoding '%s', expected topic=encoding", part)
+		}
+
+		encoder, err := NewValueEncoder(keyvalue[1], schemaRegistryURL)
+		if err != nil {
+			return nil, err
+		}
+		encoders[keyvalue[0]] = encoder
+	}
+
+	return encoders, nil
+}
+
+// logEnvelope is the generic representation of a log message used by the
+// schema based encodings (Avro and Protobuf). The well known fields have
+// their own slots and everything else goes into Fields, where non-string
+// values are stored as JSON.
+type logEnvelope struct {
+	Timestamp string
+	Service   string
+	Level     string
+	Host      string
+	Msg       string
+
+	Fields map[string]string
+
+	// Keys of Fields in sorted order so that the encoding is deterministic
+	Keys []string
+}
+
+func newLogEnvelope(m *Message) logEnvelope {
+	e := logEnvelope{Fields: make(map[string]string)}
+
+	m.ParseJSON()
+	children, _ := m.Container.ChildrenMap()
+	for key, child := range children {
+		value, isString := child.Data().(string)
+
+		if isString {
+			switch key {
+			case "ts":
+				e.Timestamp = value
+				continue
+			case "service":
+				e.Service = value
+				continue
+			case "level":
+				e.Level = value
+				continue
+			case "host":
+				e.Host = value
+				continue
+			case "msg":
+				e.Msg = value
+				continue
+			}
+		} else {
+			bytes, err := json.Marshal(child.Data())
+			if err != nil {
+				continue
+			}
+			value = string(bytes)
+		}
+
+		e.Fields[key] = value
+		e.Keys = append(e.Keys, key)
+	}
+
+	sort.Strings(e.Keys)
+
+	return e
+}
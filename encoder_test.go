@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONEncoder(t *testing.T) {
+	m := JSONToMessage(`{"service":"foo","msg":"hello"}`)
+	m.ParseJSON()
+
+	value, err := JSONEncoder{}.Encode(&m)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"msg":"hello","service":"foo"}`, string(value))
+}
+
+func TestNewValueEncoder(t *testing.T) {
+	e, err := NewValueEncoder("msgpack", "")
+	assert.Nil(t, err)
+	assert.IsType(t, MsgpackEncoder{}, e)
+
+	_, err = NewValueEncoder("avro", "")
+	assert.NotNil(t, err)
+
+	_, err = NewValueEncoder("xml", "")
+	assert.NotNil(t, err)
+}
+
+func TestParseTopicEncoders(t *testing.T) {
+	encoders, err := ParseTopicEncoders("service.foo=protobuf,service.bar=msgpack", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(encoders))
+	assert.IsType(t, ProtobufEncoder{}, encoders["service.foo"])
+	assert.IsType(t, MsgpackEncoder{}, encoders["service.bar"])
+
+	_, err = ParseTopicEncoders("service.foo", "")
+	assert.NotNil(t, err)
+}
+
+func TestLogEnvelope(t *testing.T) {
+	m := JSONToMessage(`{"ts":"2017-05-19T06:05:22Z","service":"foo","level":"INFO","msg":"hello","status":200,"tags":["a"],"pod_name":"foo-1"}`)
+	m.ParseJSON()
+
+	e := newLogEnvelope(&m)
+	assert.Equal(t, "2017-05-19T06:05:22Z", e.Timestamp)
+	assert.Equal(t, "foo", e.Service)
+	assert.Equal(t, "INFO", e.Level)
+	assert.Equal(t, "", e.Host)
+	assert.Equal(t, "hello", e.Msg)
+	assert.Equal(t, []string{"pod_name", "status", "tags"}, e.Keys)
+	assert.Equal(t, "foo-1", e.Fields["pod_name"])
+	assert.Equal(t, "200", e.Fields["status"])
+	assert.Equal(t, `["a"]`, e.Fields["tags"])
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+)
+
+// FileInput tails container log files written by the Docker json-file log
+// driver or by CRI runtimes (eg. /var/log/containers/*.log in Kubernetes).
+//
+// Read offsets are persisted into StateFile so that restarts neither lose
+// nor duplicate lines. Files are identified by their inode, so a file which
+// has been rotated and replaced by a new one is read from the beginning.
+type FileInput struct {
+	// Glob patterns of the files to tail
+	Patterns []string
+
+	// File where the read offsets are stored
+	StateFile string
+
+	// StartAtEnd skips the existing content of files found on the first
+	// scan which don't have a saved offset. Files which appear later are
+	// always read from the beginning.
+	StartAtEnd bool
+
+	// How often to look for new files and save the offsets
+	ScanInterval time.Duration
+
+	Messages chan Message
+
+	// Stats counts the lines read, can be nil
+	Stats *Stats
+
+	mutex   sync.Mutex
+	state   map[string]*fileInputState
+	tailers map[string]*fileTailer
+	close   chan bool
+	closed  sync.WaitGroup
+	readers sync.WaitGroup
+}
+
+type fileInputState struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type fileTailer struct {
+	tail  *tail.Tail
+	inode uint64
+
+	// Offset after the last line which has been fully processed
+	offset int64
+}
+
+// Lines longer than this are split by the runtimes into partial lines,
+// which are buffered until the full line has been received. This caps the
+// size of the buffer.
+const maxPartialLineBytes = 1024 * 1024
+
+// Start tails the files and sends their lines into messages.
+func (s *FileInput) Start(messages chan Message) error {
+	s.Messages = messages
+	return s.Init()
+}
+
+func (s *FileInput) Init() error {
+	s.state = make(map[string]*fileInputState)
+	s.tailers = make(map[string]*fileTailer)
+	s.close = make(chan bool)
+
+	if s.ScanInterval == 0 {
+		s.ScanInterval = 5 * time.Second
+	}
+
+	if s.StateFile != "" {
+		data, err := ioutil.ReadFile(s.StateFile)
+		if err == nil {
+			err = json.Unmarshal(data, &s.state)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading file input state from %s, starting over: %s\n", s.StateFile, err)
+				s.state = make(map[string]*fileInputState)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, pattern := range s.Patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid file input pattern %s: %s", pattern, err)
+		}
+	}
+
+	s.scan(s.StartAtEnd)
+
+	s.closed.Add(1)
+	go func() {
+		defer s.closed.Done()
+		ticker := time.NewTicker(s.ScanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.close:
+				return
+			case <-ticker.C:
+				s.scan(false)
+				err := s.SaveState()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error saving file input state: %s\n", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// scan starts tailing files which match the patterns and aren't tailed yet
+func (s *FileInput) scan(skipExisting bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seen := make(map[string]bool)
+
+	for _, pattern := range s.Patterns {
+		files, _ := filepath.Glob(pattern)
+		for _, filename := range files {
+			seen[filename] = true
+			if _, ok := s.tailers[filename]; ok {
+				continue
+			}
+
+			fi, err := os.Stat(filename)
+			if err != nil || fi.IsDir() {
+				continue
+			}
+			inode := fileInode(fi)
+
+			var offset int64 = 0
+			if state, ok := s.state[filename]; ok {
+				if state.Inode == inode && state.Offset <= fi.Size() {
+					offset = state.Offset
+				}
+			} else if skipExisting {
+				offset = fi.Size()
+			}
+
+			err = s.startTailer(filename, inode, offset)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error tailing %s: %s\n", filename, err)
+			}
+		}
+	}
+
+	// Forget files which don't exist anymore
+	for filename := range s.state {
+		if !seen[filename] {
+			delete(s.state, filename)
+		}
+	}
+}
+
+func (s *FileInput) startTailer(filename string, inode uint64, offset int64) error {
+	t, err := tail.TailFile(filename, tail.Config{
+		Location:  &tail.SeekInfo{Offset: offset, Whence: os.SEEK_SET},
+		Follow:    true,
+		ReOpen:    false, // rotated files are picked up by scan with a new inode
+		MustExist: true,
+		Poll:      true, // follows symlinks such as /var/log/containers/*.log when they are pointed to a new file
+		Logger:    tail.DiscardingLogger,
+	})
+	if err != nil {
+		return err
+	}
+
+	tailer := &fileTailer{tail: t, inode: inode, offset: offset}
+	s.tailers[filename] = tailer
+	s.state[filename] = &fileInputState{Inode: inode, Offset: offset}
+
+	s.readers.Add(1)
+	go s.readLines(filename, tailer)
+
+	return nil
+}
+
+func (s *FileInput) readLines(filename string, tailer *fileTailer) {
+	defer s.readers.Done()
+
+	parser := NewContainerLogParser(filename)
+	pending := tailer.offset
+
+	for line := range tailer.tail.Lines {
+		if line.Err != nil {
+			continue
+		}
+
+		pending += int64(len(line.Text)) + 1
+		s.Stats.Add("logs2kafka.input.packets,input=file", 1)
+		s.Stats.Add("logs2kafka.input.bytes,input=file", int64(len(line.Text))+1)
+
+		m, ok := parser.Parse(line.Text)
+		if !ok {
+			continue
+		}
+
+		m.Source = "file"
+		m.ReceivedAt = time.Now()
+		s.Stats.Add("logs2kafka.input.messages,input=file", 1)
+		if s.Messages != nil {
+			select {
+			case s.Messages <- m:
+			case <-s.close:
+				// Nobody reads the messages anymore. The offset isn't
+				// advanced, so the line is read again after a restart.
+				// The tail is drained until Close has killed it.
+				for range tailer.tail.Lines {
+				}
+				return
+			}
+		}
+
+		s.mutex.Lock()
+		tailer.offset = pending
+		if state, ok := s.state[filename]; ok && state.Inode == tailer.inode {
+			state.Offset = pending
+		}
+		s.mutex.Unlock()
+	}
+
+	// The tail ends when the file has been removed or rotated. The next
+	// scan will start a new tailer if a new file appears with the same name.
+	s.mutex.Lock()
+	if s.tailers[filename] == tailer {
+		delete(s.tailers, filename)
+	}
+	s.mutex.Unlock()
+}
+
+// SaveState writes the read offsets into the state file.
+func (s *FileInput) SaveState() error {
+	if s.StateFile == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	data, err := json.Marshal(s.state)
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.StateFile)
+}
+
+// Close stops tailing and saves the offsets of the lines processed so far.
+// A line which is being sent into Messages is given up if it isn't received.
+func (s *FileInput) Close() {
+	close(s.close)
+	s.closed.Wait()
+
+	// Kill instead of Stop, which would wait for the pending line to be
+	// delivered into Messages.
+	s.mutex.Lock()
+	for _, tailer := range s.tailers {
+		tailer.tail.Kill(nil)
+	}
+	s.mutex.Unlock()
+	s.readers.Wait()
+
+	err := s.SaveState()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving file input state: %s\n", err)
+	}
+}
+
+// Kubernetes names the container log files as
+// <pod name>_<namespace>_<container name>-<container id>.log
+var kubernetesLogFileName = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-([0-9a-f]{64})\.log$`)
+
+// Docker stores the json-file logs as <container id>/<container id>-json.log
+var dockerLogFileName = regexp.MustCompile(`^([0-9a-f]{64})-json\.log$`)
+
+// ContainerLogParser parses the lines of one container log file, joining
+// partial lines, and adds the container metadata found in the file name.
+type ContainerLogParser struct {
+	fields  map[string]string
+	partial []byte
+}
+
+func NewContainerLogParser(filename string) *ContainerLogParser {
+	p := &ContainerLogParser{fields: make(map[string]string)}
+
+	base := filepath.Base(filename)
+	if match := kubernetesLogFileName.FindStringSubmatch(base); match != nil {
+		p.fields["pod_name"] = match[1]
+		p.fields["namespace"] = match[2]
+		p.fields["container_name"] = match[3]
+		p.fields["container_id"] = match[4]
+	} else if match := dockerLogFileName.FindStringSubmatch(base); match != nil {
+		p.fields["container_id"] = match[1]
+	}
+
+	return p
+}
+
+// Parse parses a line in either the Docker json-file format
+//
+//   {"log":"message\n","stream":"stdout","time":"2017-05-19T06:05:22.037120689Z"}
+//
+// or the CRI format
+//
+//   2017-05-19T06:05:22.037120689Z stdout F message
+//
+// Returns false if the line was a partial line and the message isn't
+// complete yet, or if the line couldn't be parsed.
+func (p *ContainerLogParser) Parse(line string) (Message, bool) {
+	var ts, stream, text string
+	var partial bool
+
+	if strings.HasPrefix(line, "{") {
+		entry := struct {
+			Log    string `json:"log"`
+			Stream string `json:"stream"`
+			Time   string `json:"time"`
+		}{}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			return Message{}, false
+		}
+		ts, stream = entry.Time, entry.Stream
+		// Docker splits long lines and leaves out the newline from all but the last part
+		partial = !strings.HasSuffix(entry.Log, "\n")
+		text = strings.TrimSuffix(entry.Log, "\n")
+	} else {
+		parts := strings.SplitN(line, " ", 4)
+		if len(parts) < 3 {
+			return Message{}, false
+		}
+		ts, stream = parts[0], parts[1]
+		partial = parts[2] == "P"
+		if len(parts) == 4 {
+			text = parts[3]
+		}
+	}
+
+	if partial {
+		if len(p.partial)+len(text) <= maxPartialLineBytes {
+			p.partial = append(p.partial, text...)
+		}
+		return Message{}, false
+	}
+
+	if len(p.partial) > 0 {
+		text = string(append(p.partial, text...))
+		p.partial = p.partial[:0]
+	}
+
+	m := PayloadToMessage(text)
+
+	if _, err := m.GetString("ts"); err != nil {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			m.SetField("ts", t.UTC().Format(time.RFC3339Nano))
+		}
+	}
+
+	if stream != "" {
+		m.SetField("stream", stream)
+	}
+
+	for key, value := range p.fields {
+		if _, err := m.GetString(key); err != nil {
+			m.SetField(key, value)
+		}
+	}
+
+	return m, true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainerId = "e02acf37f963ec2d46ede21766070559aa4a79c1afc8582e27d580ef2326800e"
+
+func TestContainerLogParserDockerJSON(t *testing.T) {
+	p := NewContainerLogParser("/var/lib/docker/containers/" + testContainerId + "/" + testContainerId + "-json.log")
+
+	m, ok := p.Parse(`{"log":"Hello, World!\n","stream":"stderr","time":"2017-05-19T06:05:22.037120689Z"}`)
+	assert.Equal(t, true, ok)
+
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "Hello, World!", value)
+	value, _ = m.FieldString("stream")
+	assert.Equal(t, "stderr", value)
+	value, _ = m.FieldString("ts")
+	assert.Equal(t, "2017-05-19T06:05:22.037120689Z", value)
+	value, _ = m.FieldString("container_id")
+	assert.Equal(t, testContainerId, value)
+}
+
+func TestContainerLogParserDockerJSONPartial(t *testing.T) {
+	p := NewContainerLogParser("/tmp/foo.log")
+
+	_, ok := p.Parse(`{"log":"{\"msg\":\"Hello, ","stream":"stdout","time":"2017-05-19T06:05:22.037120689Z"}`)
+	assert.Equal(t, false, ok)
+
+	m, ok := p.Parse(`{"log":"World!\",\"level\":\"INFO\"}\n","stream":"stdout","time":"2017-05-19T06:05:22.037120689Z"}`)
+	assert.Equal(t, true, ok)
+
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "Hello, World!", value)
+	value, _ = m.FieldString("level")
+	assert.Equal(t, "INFO", value)
+}
+
+func TestContainerLogParserCRI(t *testing.T) {
+	p := NewContainerLogParser("/var/log/containers/ads-auction-835331642-rzzgr_default_comet-source-adapter-" + testContainerId + ".log")
+
+	_, ok := p.Parse("2017-05-19T06:05:22.037120689Z stdout P {\"msg\":\"Hello, ")
+	assert.Equal(t, false, ok)
+
+	m, ok := p.Parse("2017-05-19T06:05:22.037120689Z stdout F World!\",\"ts\":\"2017-05-19T06:05:21Z\"}")
+	assert.Equal(t, true, ok)
+
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "Hello, World!", value)
+	value, _ = m.FieldString("ts")
+	assert.Equal(t, "2017-05-19T06:05:21Z", value)
+	value, _ = m.FieldString("pod_name")
+	assert.Equal(t, "ads-auction-835331642-rzzgr", value)
+	value, _ = m.FieldString("namespace")
+	assert.Equal(t, "default", value)
+	value, _ = m.FieldString("container_name")
+	assert.Equal(t, "comet-source-adapter", value)
+	value, _ = m.FieldString("container_id")
+	assert.Equal(t, testContainerId, value)
+
+	m, ok = p.Parse("2017-05-19T06:05:22.037120689Z stderr F plain text")
+	assert.Equal(t, true, ok)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "plain text", value)
+
+	_, ok = p.Parse("garbage")
+	assert.Equal(t, false, ok)
+}
+
+func readTestMessage(t *testing.T, messages chan Message) string {
+	select {
+	case m := <-messages:
+		value, _ := m.FieldString("msg")
+		return value
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a message")
+	}
+	return ""
+}
+
+func TestFileInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := dir + "/foo.log"
+	err = ioutil.WriteFile(filename, []byte("2017-05-19T06:05:22Z stdout F existing\n"), 0644)
+	assert.Nil(t, err)
+
+	messages := make(chan Message, 10)
+	s := FileInput{
+		Patterns:     []string{dir + "/*.log"},
+		StateFile:    dir + "/state",
+		StartAtEnd:   true,
+		ScanInterval: 100 * time.Millisecond,
+		Messages:     messages,
+	}
+	err = s.Init()
+	assert.Nil(t, err)
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	file.WriteString("2017-05-19T06:05:23Z stdout F first\n")
+	file.Close()
+
+	assert.Equal(t, "first", readTestMessage(t, messages))
+
+	// A file which appears later is read from the beginning
+	err = ioutil.WriteFile(dir+"/bar.log", []byte("2017-05-19T06:05:22Z stdout F bar\n"), 0644)
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", readTestMessage(t, messages))
+
+	s.Close()
+
+	data, err := ioutil.ReadFile(dir + "/state")
+	assert.Nil(t, err)
+	state := make(map[string]*fileInputState)
+	err = json.Unmarshal(data, &state)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(75), state[filename].Offset)
+
+	// Lines written while stopped are read after restart, nothing is read twice
+	file, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	file.WriteString("2017-05-19T06:05:24Z stdout F second\n")
+	file.Close()
+
+	restarted := FileInput{
+		Patterns:     []string{filename},
+		StateFile:    dir + "/state",
+		StartAtEnd:   true,
+		ScanInterval: 100 * time.Millisecond,
+		Messages:     messages,
+	}
+	err = restarted.Init()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "second", readTestMessage(t, messages))
+	restarted.Close()
+	assert.Equal(t, 0, len(messages))
+}
+
+func TestFileInputCloseUnread(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := dir + "/foo.log"
+	err = ioutil.WriteFile(filename, []byte("2017-05-19T06:05:22Z stdout F first\n2017-05-19T06:05:23Z stdout F second\n"), 0644)
+	assert.Nil(t, err)
+
+	messages := make(chan Message)
+	s := FileInput{
+		Patterns:     []string{filename},
+		StateFile:    dir + "/state",
+		ScanInterval: 100 * time.Millisecond,
+		Messages:     messages,
+		Stats:        NewStats(),
+	}
+	err = s.Init()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "first", readTestMessage(t, messages))
+	for i := 0; i < 500 && s.Stats.Counter("logs2kafka.input.messages,input=file") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The second line is never received, Close must not wait for it
+	closed := make(chan bool)
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Close")
+	}
+
+	// Nothing is sent after Close
+	select {
+	case <-messages:
+		t.Fatal("Message sent after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	data, err := ioutil.ReadFile(dir + "/state")
+	assert.Nil(t, err)
+	state := make(map[string]*fileInputState)
+	err = json.Unmarshal(data, &state)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(36), state[filename].Offset)
+}
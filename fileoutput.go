@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileOutput writes local copies of the messages into one rotated log file
+// per topic, which can then be viewed with the tail command.
+type FileOutput struct {
+	Path string
+
+	// Maximum size of a log file in megabytes before it gets rotated
+	MaxSize int
+
+	// Maximum number of rotated files to keep
+	MaxBackups int
+
+	Debug bool
+
+	// Stats counts the written messages, can be nil
+	Stats *Stats
+
+	loggers map[string]*lumberjack.Logger
+}
+
+func NewFileOutput(path string) *FileOutput {
+	return &FileOutput{
+		Path:       path,
+		MaxSize:    100,
+		MaxBackups: 3,
+		loggers:    make(map[string]*lumberjack.Logger),
+	}
+}
+
+func (o *FileOutput) Write(m *Message) error {
+	logger, ok := o.loggers[m.Topic]
+	if !ok {
+		filename := o.Path + "/" + m.Topic + ".log"
+		if o.Debug {
+			fmt.Printf("Creating new logger for topic %s into file %s\n", m.Topic, filename)
+		}
+
+		logger = &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    o.MaxSize,
+			MaxBackups: o.MaxBackups,
+		}
+
+		o.loggers[m.Topic] = logger
+	}
+
+	n, err := logger.Write(m.Line())
+	if err != nil {
+		o.Stats.Add("logs2kafka.file.write_errors", 1)
+		return err
+	}
+	o.Stats.Add("logs2kafka.file.written", 1)
+	o.Stats.Add("logs2kafka.file.written_bytes", int64(n))
+	return nil
+}
+
+func (o *FileOutput) Close() {
+	for _, logger := range o.loggers {
+		logger.Close()
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	o := NewFileOutput(dir)
+
+	m := JSONToMessage(`{"msg":"hello"}`)
+	m.ParseJSON()
+	m.Topic = "service.foo"
+
+	err = o.Write(&m)
+	assert.Nil(t, err)
+	err = o.Write(&m)
+	assert.Nil(t, err)
+	o.Close()
+
+	data, err := ioutil.ReadFile(dir + "/service.foo.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"msg\":\"hello\"}\n{\"msg\":\"hello\"}\n", string(data))
+}
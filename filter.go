@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Filter selects messages by field values. A filter is a comma delimited
+// list of conditions which all must match:
+//
+//   level==ERROR,service!=logs2kafka
+//
+// "field==value" matches when the field has the given value and
+// "field!=value" matches when it doesn't (including when the field is
+// missing). An empty filter matches every message.
+type Filter struct {
+	conditions []filterCondition
+}
+
+type filterCondition struct {
+	field  string
+	value  string
+	negate bool
+}
+
+func ParseFilter(str string) (*Filter, error) {
+	f := &Filter{}
+
+	if strings.TrimSpace(str) == "" {
+		return f, nil
+	}
+
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+
+		var c filterCondition
+		if i := strings.Index(part, "!="); i != -1 {
+			c = filterCondition{field: part[0:i], value: part[i+2:], negate: true}
+		} else if i := strings.Index(part, "=="); i != -1 {
+			c = filterCondition{field: part[0:i], value: part[i+2:]}
+		} else {
+			return nil, fmt.Errorf("Invalid filter condition '%s', expected field==value or field!=value", part)
+		}
+
+		if c.field == "" {
+			return nil, fmt.Errorf("Invalid filter condition '%s', field name is missing", part)
+		}
+
+		f.conditions = append(f.conditions, c)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) Match(m *Message) bool {
+	for _, c := range f.conditions {
+		value, ok := m.FieldString(c.field)
+		equal := ok && value == c.value
+		if equal == c.negate {
+			return false
+		}
+	}
+	return true
+}
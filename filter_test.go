@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := ParseFilter("level==ERROR,service!=logs2kafka")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"level":"ERROR","service":"foo"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, f.Match(&m))
+
+	m = JSONToMessage(`{"level":"INFO","service":"foo"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, f.Match(&m))
+
+	m = JSONToMessage(`{"level":"ERROR","service":"logs2kafka"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, f.Match(&m))
+
+	m = JSONToMessage(`{"level":"ERROR"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, f.Match(&m))
+}
+
+func TestFilterNumbers(t *testing.T) {
+	f, err := ParseFilter("status==500")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"status":500}`)
+	m.ParseJSON()
+	assert.Equal(t, true, f.Match(&m))
+}
+
+func TestEmptyFilterMatchesEverything(t *testing.T) {
+	f, err := ParseFilter("")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"level":"ERROR"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, f.Match(&m))
+}
+
+func TestInvalidFilter(t *testing.T) {
+	_, err := ParseFilter("level")
+	assert.NotNil(t, err)
+
+	_, err = ParseFilter("==ERROR")
+	assert.NotNil(t, err)
+}
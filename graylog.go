@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"github.com/Jeffail/gabs"
 )
 
 type Chunk struct {
@@ -19,109 +23,306 @@ type Chunk struct {
 
 	Expiration int64
 
+	// Sender of the first chunk
+	Addr *net.UDPAddr
 }
 
+// The GELF specification allows at most 128 chunks per message.
+const MaxGraylogChunks = 128
+
+// Limits for the messages which haven't received all their chunks yet.
+// Incomplete messages expire after five seconds, these protect against
+// senders which start more messages than can be kept in memory.
+const (
+	DefaultMaxPendingChunkBytes    = 64 * 1024 * 1024
+	DefaultMaxPendingChunkMessages = 10000
+)
+
+// Compressed messages are decompressed up to this size. The GELF drivers
+// compress messages by default, and a small packet could otherwise
+// decompress into gigabytes.
+const MaxGraylogMessageSize = 8 * 1024 * 1024
+
+// The GELF input reads at most this many bytes of a packet
+const maxGraylogPacketSize = 9500
+
+// Chunk header: two magic bytes, 8 byte message id, sequence number and
+// sequence count
+const graylogChunkHeaderSize = 12
+
 type Graylog struct {
 	Port int
 
+	// Address to bind, eg. "127.0.0.1" or "::1". Empty binds all interfaces.
+	BindAddress string
+
 	Messages chan Message
 
-	close chan bool
+	// Number of goroutines reading the port, each with its own
+	// SO_REUSEPORT socket if there are more than one
+	Readers int
+
+	listener *UDPListener
 
 	Statsd StatisticsSender
 
+	// Stats counts the received packets, parse failures and chunks, can be nil
+	Stats *Stats
+
 	ReceivedChunks map[string]*Chunk
 
 	LastCleanup int64
+
+	// Limits for the incomplete chunked messages, the defaults are used if 0
+	MaxPendingBytes    int
+	MaxPendingMessages int
+
+	// Total size of the chunks in ReceivedChunks
+	pendingBytes int
+
+	// chunksMutex protects ReceivedChunks, LastCleanup and pendingBytes
+	// from the concurrent readers
+	chunksMutex sync.Mutex
+
+	// ACL limits the senders which are accepted, nil accepts all
+	ACL *ACL
+
+	// Fields where the sender address is stored
+	SourceFields SourceFields
 }
 
 func (s *Graylog) RunCleanup() error {
+	s.chunksMutex.Lock()
+	defer s.chunksMutex.Unlock()
+	return s.runCleanup()
+}
+
+func (s *Graylog) runCleanup() error {
 	now := time.Now().UnixNano()
 	for k, v := range s.ReceivedChunks {
 		if now > v.Expiration {
-			delete(s.ReceivedChunks, k)
+			s.dropChunks(k)
+			s.Stats.Add("logs2kafka.gelf.chunks_expired", 1)
 		}
 	}
 
 	return nil
 }
 
+// dropChunks removes an incomplete message.
+func (s *Graylog) dropChunks(message_id string) {
+	c, found := s.ReceivedChunks[message_id]
+	if !found {
+		return
+	}
+	delete(s.ReceivedChunks, message_id)
+	s.pendingBytes -= c.ReceivedBytes
+	s.Stats.AddGauge("logs2kafka.gelf.chunks_pending", -1)
+	s.Stats.AddGauge("logs2kafka.gelf.chunks_pending_bytes", -int64(c.ReceivedBytes))
+}
+
 func (s *Graylog) HandleChunkedPacket(buffer []byte) error {
+	return s.HandleChunkedPacketFrom(buffer, nil)
+}
 
-	message_id := string(buffer[2:10])
+// HandleChunkedPacketFrom handles a chunk received from addr. Chunks are
+// only joined with other chunks from the same sender.
+//
+// Chunks with an invalid sequence number or count are rejected and
+// duplicate chunks are ignored. If a new chunk would go over the limits of
+// pending messages, the message it belongs to is dropped.
+func (s *Graylog) HandleChunkedPacketFrom(buffer []byte, addr *net.UDPAddr) error {
+	c, err := s.addChunk(buffer, addr)
+	if err != nil || c == nil {
+		return err
+	}
 
-	c, found := s.ReceivedChunks[message_id]
-	if !found {
-		c = &Chunk{}
-		// buffer[11] is Sequence count - 1 byte: Total number of chunks this message has.
-		c.TotalCount = int(buffer[11])
-		c.Parts = make([][]byte, c.TotalCount)
+	buf := make([]byte, 0, c.ReceivedBytes)
+	for _, sub := range c.Parts {
+		buf = append(buf, sub...)
+	}
 
-		// Mark expiration 5 seconds into the future
-		c.Expiration = time.Now().UnixNano() + 5e9
+	buf, err = s.decompress(buf)
+	if err != nil {
+		return err
+	}
+
+	m := Message{}
+	m.Data = buf
+	err = m.ParseFields()
+	if err != nil {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=json", 1)
+		return err
+	}
+
+	ConvertGraylogFields(&m)
+	m.Source = "gelf"
+	m.ReceivedAt = time.Now()
+	s.SourceFields.Set(&m, c.Addr)
+	s.Stats.Add("logs2kafka.input.messages,input=gelf", 1)
+	s.Messages <- m
+
+	return nil
+}
+
+// addChunk stores a chunk and returns the message once all of its chunks
+// have been received.
+func (s *Graylog) addChunk(buffer []byte, addr *net.UDPAddr) (*Chunk, error) {
+	if len(buffer) < graylogChunkHeaderSize {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=chunk", 1)
+		return nil, fmt.Errorf("GELF chunk is too short: %d bytes", len(buffer))
+	}
+
+	s.chunksMutex.Lock()
+	defer s.chunksMutex.Unlock()
+
+	if s.ReceivedChunks == nil {
+		s.ReceivedChunks = make(map[string]*Chunk)
+	}
+
+	maxBytes := s.MaxPendingBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxPendingChunkBytes
+	}
+	maxMessages := s.MaxPendingMessages
+	if maxMessages <= 0 {
+		maxMessages = DefaultMaxPendingChunkMessages
+	}
+
+	if s.LastCleanup == 0 || time.Now().UnixNano() > s.LastCleanup + 5e9 {
+		s.LastCleanup = time.Now().UnixNano()
+		s.runCleanup()
+	}
+
+	message_id := string(buffer[2:10])
+	if addr != nil {
+		message_id = addr.IP.String() + "/" + message_id
 	}
 
 	// buffer[10] is Sequence number - 1 byte:
 	// The sequence number of this chunk. Starting at 0 and always less than the sequence count.
-	c.Parts[int(buffer[10])] = buffer[12:]
+	// buffer[11] is Sequence count - 1 byte: Total number of chunks this message has.
+	sequence := int(buffer[10])
+	count := int(buffer[11])
 
-	c.ReceivedBytes += len(c.Parts[c.ReceivedCount])
-	c.ReceivedCount += 1
-	
-	s.ReceivedChunks[message_id] = c
+	if count == 0 || count > MaxGraylogChunks || sequence >= count {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=chunk", 1)
+		return nil, fmt.Errorf("Invalid GELF chunk %d of %d", sequence, count)
+	}
 
-	if c.ReceivedCount == c.TotalCount {
+	c, found := s.ReceivedChunks[message_id]
+	if found && c.TotalCount != count {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=chunk", 1)
+		return nil, fmt.Errorf("GELF chunk count %d doesn't match the earlier chunks of the message (%d)", count, c.TotalCount)
+	}
 
-		buf := make([]byte, c.ReceivedBytes)
-		cursor := 0
-		for _, sub := range c.Parts {
-			l := len(sub)
-			copy(buf[cursor:cursor+l], sub)
-			cursor += l
-		}
+	if found && c.Parts[sequence] != nil {
+		s.Stats.Add("logs2kafka.gelf.chunks_duplicate", 1)
+		return nil, nil
+	}
 
-		m := Message{}
-		m.Data = buf
-		err := m.ParseJSON()
-		if err != nil {
-			return err
+	payload := buffer[graylogChunkHeaderSize:]
+
+	if !found && len(s.ReceivedChunks) >= maxMessages {
+		s.Stats.Add("logs2kafka.gelf.chunks_dropped,reason=pending_messages", 1)
+		return nil, fmt.Errorf("Over %d incomplete GELF messages, dropping chunk", maxMessages)
+	}
+
+	if s.pendingBytes + len(payload) > maxBytes {
+		if found {
+			s.dropChunks(message_id)
 		}
+		s.Stats.Add("logs2kafka.gelf.chunks_dropped,reason=pending_bytes", 1)
+		return nil, fmt.Errorf("GELF chunks use over %d bytes, dropping message", maxBytes)
+	}
 
-		ConvertGraylogFields(&m)
-		delete(s.ReceivedChunks, message_id)
-		s.Messages <- m
+	if !found {
+		c = &Chunk{}
+		c.TotalCount = count
+		c.Parts = make([][]byte, c.TotalCount)
+
+		// Mark expiration 5 seconds into the future
+		c.Expiration = time.Now().UnixNano() + 5e9
+		c.Addr = addr
+		s.ReceivedChunks[message_id] = c
+		s.Stats.AddGauge("logs2kafka.gelf.chunks_pending", 1)
 	}
+	s.Stats.Add("logs2kafka.gelf.chunks", 1)
 
-	if s.LastCleanup == 0 || time.Now().UnixNano() > s.LastCleanup + 5e9 {
-		s.LastCleanup = time.Now().UnixNano()
-		s.RunCleanup()
+	// The buffer is reused for the next packet, so the payload is copied
+	part := make([]byte, len(payload))
+	copy(part, payload)
+	c.Parts[sequence] = part
+
+	c.ReceivedBytes += len(part)
+	c.ReceivedCount += 1
+	s.pendingBytes += len(part)
+	s.Stats.AddGauge("logs2kafka.gelf.chunks_pending_bytes", int64(len(part)))
+
+	if c.ReceivedCount < c.TotalCount {
+		return nil, nil
 	}
 
-	return nil
+	s.dropChunks(message_id)
+	return c, nil
 }
 
 
 func (s *Graylog) ParseGraylogMessage(buffer []byte) (error) {
+	return s.ParseGraylogMessageFrom(buffer, nil)
+}
+
+// ParseGraylogMessageFrom handles a packet received from addr, unless the
+// ACL rejects the sender.
+func (s *Graylog) ParseGraylogMessageFrom(buffer []byte, addr *net.UDPAddr) (error) {
 	m := Message{}
 
-	if buffer[0] == '{' {
-		// Non-chunked delivery
-		m.Data = buffer
+	s.Stats.Add("logs2kafka.input.packets,input=gelf", 1)
+	s.Stats.Add("logs2kafka.input.bytes,input=gelf", int64(len(buffer)))
+
+	if addr != nil && !s.ACL.Allowed(addr.IP) {
+		if s.Statsd != nil {
+			s.Statsd.Inc("logs2kafka.rejected_packets,input=gelf", 1, 1)
+		}
+		return nil
+	}
+
+	if isCompressedGELF(buffer) {
+		// The buffer is reused for the next packet, but decompressing
+		// makes a copy
+		decompressed, err := s.decompress(buffer)
+		if err != nil {
+			return err
+		}
+		buffer = decompressed
+	}
+
+	if len(buffer) > 0 && buffer[0] == '{' {
+		// Non-chunked delivery. The buffer is reused for the next packet,
+		// so the message gets a copy.
+		m.Data = append([]byte(nil), buffer...)
 
-		err := m.ParseJSON()
+		err := m.ParseFields()
 		if err != nil {
+			s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=json", 1)
 			return err
 		}
 
 		ConvertGraylogFields(&m)
 
+		m.Source = "gelf"
+		m.ReceivedAt = time.Now()
+		s.SourceFields.Set(&m, addr)
+		s.Stats.Add("logs2kafka.input.messages,input=gelf", 1)
 		s.Messages <- m
-	} else if buffer[0] == 0x1E && buffer[1] == 0x0F {
+	} else if len(buffer) > 1 && buffer[0] == 0x1E && buffer[1] == 0x0F {
 		// Chunked delivery
-		err := s.HandleChunkedPacket(buffer)
+		err := s.HandleChunkedPacketFrom(buffer, addr)
 		if err != nil {
 			return err
 		}
+	} else {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=format", 1)
 	}
 
 	return nil
@@ -129,55 +330,91 @@ func (s *Graylog) ParseGraylogMessage(buffer []byte) (error) {
 
 
 
-func (s *Graylog) Init(port int) error {
-	s.Port = port
-	s.close = make(chan bool)
+// isCompressedGELF checks for the gzip magic bytes or a zlib header.
+func isCompressedGELF(buffer []byte) bool {
+	if len(buffer) < 2 {
+		return false
+	}
+	if buffer[0] == 0x1f && buffer[1] == 0x8b {
+		return true
+	}
+	// zlib: deflate with a window of at most 32KB and a check sum in the
+	// first two bytes
+	return buffer[0]&0x0f == 8 && buffer[0]>>4 <= 7 && (uint16(buffer[0])<<8|uint16(buffer[1]))%31 == 0
+}
+
+// decompress returns gzip and zlib compressed messages decompressed and
+// other messages as they are.
+func (s *Graylog) decompress(buffer []byte) ([]byte, error) {
+	if !isCompressedGELF(buffer) {
+		return buffer, nil
+	}
 
-	ServerAddr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(port))
+	var reader io.ReadCloser
+	var err error
+	if buffer[0] == 0x1f {
+		reader, err = gzip.NewReader(bytes.NewReader(buffer))
+	} else {
+		reader, err = zlib.NewReader(bytes.NewReader(buffer))
+	}
 	if err != nil {
-		return err
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=compression", 1)
+		return nil, err
 	}
+	defer reader.Close()
 
-	ServerConn, err := net.ListenUDP("udp", ServerAddr)
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, MaxGraylogMessageSize+1))
 	if err != nil {
-		return err
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=compression", 1)
+		return nil, err
+	}
+	if len(decompressed) > MaxGraylogMessageSize {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=gelf,reason=compression", 1)
+		return nil, fmt.Errorf("Decompressed GELF message is over %d bytes", MaxGraylogMessageSize)
 	}
 
-	buf := make([]byte, 9500)
+	return decompressed, nil
+}
 
-	go func() {
-		for {
-			select {
-			case val, ok := <-s.close:
-				if val == true || ok == false {
-					return
-				}
-				break
-			default:
+// Start listens to Port and sends the messages into messages.
+func (s *Graylog) Start(messages chan Message) error {
+	s.Messages = messages
+	return s.Init(s.Port)
+}
+
+func (s *Graylog) Init(port int) error {
+	s.Port = port
+	s.ReceivedChunks = make(map[string]*Chunk)
 
-				ServerConn.SetDeadline(time.Now().Add(time.Millisecond * 100))
-				n, _, err := ServerConn.ReadFromUDP(buf)
+	ServerAddr, err := ResolveListenAddr(s.BindAddress, port)
+	if err != nil {
+		return err
+	}
 
-				if s.Messages != nil && err == nil {
+	s.listener = &UDPListener{
+		Addr:       ServerAddr,
+		Readers:    s.Readers,
+		BufferSize: maxGraylogPacketSize,
+		Handle: func(buffer []byte, addr *net.UDPAddr) {
+			if s.Messages == nil {
+				return
+			}
 
-					err := s.ParseGraylogMessage(buf[0:n])
-					if err != nil {
-						if s.Statsd != nil {
-							s.Statsd.Inc("logs2kafka.invalid_graylog_messages", 1, 0.1)
-						}
-						fmt.Fprintf(os.Stderr, "Error parsing json message: %s\n", err)
-					}
+			err := s.ParseGraylogMessageFrom(buffer, addr)
+			if err != nil {
+				if s.Statsd != nil {
+					s.Statsd.Inc("logs2kafka.invalid_graylog_messages", 1, 0.1)
 				}
+				fmt.Fprintf(os.Stderr, "Error parsing json message: %s\n", err)
 			}
-		}
-	}()
-
-	return nil
+		},
+	}
 
+	return s.listener.Start()
 }
 
 func (s *Graylog) Close() {
-	s.close <- true
+	s.listener.Close()
 }
 
 
@@ -210,88 +447,80 @@ io.kubernetes.container.name (use this as the topic name)
 
 func ConvertGraylogFields(m *Message) error {
 
-	container_name, ok := m.Container.Path("_container_name").Data().(string)
+	container_name, err := m.GetString("_container_name")
 
-	if ok {
-		m.Container.Set(container_name, "container_name")
-		m.Container.Delete("_container_name")
+	if err == nil {
+		m.SetField("container_name", container_name)
+		m.DeleteField("_container_name")
 	}
 
-	level_number, ok := m.Container.Path("level").Data().(float64)
+	level_number, ok := m.Float("level")
 	if ok {
-		m.Container.Delete("level")
 		switch level_number {
 			case 3:
-				m.Container.Set("ERROR", "level")
+				m.SetField("level", "ERROR")
 			case 4:
-				m.Container.Set("WARN", "level")
+				m.SetField("level", "WARN")
 			case 6:
-				m.Container.Set("INFO", "level")
+				m.SetField("level", "INFO")
 			case 7:
-				m.Container.Set("DEBUG", "level")
+				m.SetField("level", "DEBUG")
 			default:
-				m.Container.Set("UNKNOWN", "level")
+				m.SetField("level", "UNKNOWN")
 		}
 	}
 
 	// We just drop the float timestamp and generate our own ts field later
-	m.Container.Delete("timestamp")
+	m.DeleteField("timestamp")
 
-	short_message, ok := m.Container.Path("short_message").Data().(string)
-	if ok {
+	short_message, err := m.GetString("short_message")
+	if err == nil {
 
 		// Check if the short_message is in fact a JSON document and handle that
 		if len(short_message) > 1 && short_message[0] == '{' {
-			short_message_data := m.Container.Path("short_message").Data().(string)
-			parsed_json_message, err := gabs.ParseJSON([]byte(short_message_data))
+			err = m.MergeJSON([]byte(short_message))
 
 			if err != nil {
 				// Error in JSON parse, just pass the data through as-is
-				m.Container.Set(short_message, "msg")
-			} else {
-
-				children, _ := parsed_json_message.ChildrenMap()
-				for key, value := range children {
-					_, err = m.Container.Set(value.Data(), key)
-				}
+				m.SetField("msg", short_message)
 			}
 		} else {
-			m.Container.Set(short_message, "msg")
+			m.SetField("msg", short_message)
 		}
 
-		m.Container.Delete("short_message")
+		m.DeleteField("short_message")
 	}
 
 	// Process tag. We can extract json properties out with the "key1=value1,key2=value2" notation
-	tag, ok := m.Container.Path("_tag").Data().(string)
-	if ok {
+	tag, err := m.GetString("_tag")
+	if err == nil {
 		parts := strings.Split(tag, ",")
 		replaced := false
 		for _, part := range parts {
 			keyvalue := strings.Split(part, "=")
 			if len(keyvalue) == 2 {
 				fmt.Printf("Found key %s to value %s\n", keyvalue[0], keyvalue[1])
-				m.Container.Set(keyvalue[1], keyvalue[0])
+				m.SetField(keyvalue[0], keyvalue[1])
 				replaced = true
 			}
 		}
 
 		// Delete the _tag if we did parse things out from it
 		if replaced {
-			m.Container.Delete("_tag")
+			m.DeleteField("_tag")
 		}
 	}
 
 	// Convert registry2.applifier.info:5005/comet-source-adapter@sha256:f205ed11f1a26bb8ceefc9389ebe6
 	// to registry2.applifier.info:5005/comet-source-adapter:f205ed11f1a26bb8ceefc9389ebe6
 	// But only if there is no docker_image already set as this could be passed from tag handling
-	_, ok = m.Container.Path("docker_image").Data().(string)
-	if !ok {
-		image_name, ok := m.Container.Path("_image_name").Data().(string)
-		if ok {
-			m.Container.Set(image_name, "docker_image")
+	_, err = m.GetString("docker_image")
+	if err != nil {
+		image_name, err := m.GetString("_image_name")
+		if err == nil {
+			m.SetField("docker_image", image_name)
 		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
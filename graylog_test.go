@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -29,11 +33,11 @@ func TestGraylogMessageConversion(t *testing.T) {
 
 	ConvertGraylogFields(&m)
 
-	value, ok := m.Container.Path("msg").Data().(string)
+	value, ok := m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "moi\r")
 
-	value, ok = m.Container.Path("level").Data().(string)
+	value, ok = m.FieldString("level")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "ERROR")
 
@@ -48,7 +52,7 @@ func TestGraylogEmptyMessage(t *testing.T) {
 
 	ConvertGraylogFields(&m)
 
-	value, ok := m.Container.Path("msg").Data().(string)
+	value, ok := m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "")
 }
@@ -64,11 +68,11 @@ func TestGraylogCorruptedMessage(t *testing.T) {
 	assert.Equal(t, err, nil)
 	
 
-	value, ok := m.Container.Path("foo").Data().(string)
+	value, ok := m.FieldString("foo")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "bar")
 
-	value, ok = m.Container.Path("msg").Data().(string)
+	value, ok = m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "{\"")
 
@@ -98,15 +102,15 @@ func TestGraylogMessageConversionForPodMessage(t *testing.T) {
 
 	ConvertGraylogFields(&m)
 
-	value, ok := m.Container.Path("container_name").Data().(string)
+	value, ok := m.FieldString("container_name")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "k8s_ads-auction-comet-source-adapter_ads-auction-835331642-rzzgr_default_99baeb50-3bc3-11e7-a061-0a50dcb4a89e_1")
 
-	value, ok = m.Container.Path("level").Data().(string)
+	value, ok = m.FieldString("level")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "DEBUG")
 
-	value, ok = m.Container.Path("docker_image").Data().(string)
+	value, ok = m.FieldString("docker_image")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "registry2.applifier.info:5005/comet-source-adapter@sha256:f205ed11f1a26bbfe3dd127adcf155949b9fb205b19821c8b78ceefc9389ebe6")
 
@@ -132,18 +136,18 @@ func TestGraylogMessageJSONin_short_message_field(t *testing.T) {
 
 	ConvertGraylogFields(&m)
 
-	value, ok := m.Container.Path("msg").Data().(string)
+	value, ok := m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "hei")
 
-	value, ok = m.Container.Path("short_message").Data().(string)
+	value, ok = m.FieldString("short_message")
 	assert.Equal(t, ok, false)
 
-	value, ok = m.Container.Path("foo").Data().(string)
+	value, ok = m.FieldString("foo")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "bar")
 
-	value, ok = m.Container.Path("obj.hello").Data().(string)
+	value, ok = m.FieldString("obj.hello")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "world")
 
@@ -175,15 +179,15 @@ func TestGraylogMessageTagFieldExtraction(t *testing.T) {
 
 	ConvertGraylogFields(&m)
 
-	value, ok := m.Container.Path("docker_image").Data().(string)
+	value, ok := m.FieldString("docker_image")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "registry.applifier.info:5000/kafka:0.8.2.1")
 
-	value, ok = m.Container.Path("_image_name").Data().(string)
+	value, ok = m.FieldString("_image_name")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "quay.io/coreos/hyperkube@sha256:77b81b118e6e231d284e6ae0ec50d898dadd88af469df33d5cf3f3a2d0d44473")
 
-	value, ok = m.Container.Path("foo").Data().(string)
+	value, ok = m.FieldString("foo")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "bar")
 
@@ -213,7 +217,7 @@ func TestGraylogReceive(t *testing.T) {
 	Conn.Close()
 
 	msg := <-s.Messages
-	value, ok := msg.Container.Path("msg").Data().(string)
+	value, ok := msg.FieldString("msg")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "main.main()", value)
 
@@ -267,16 +271,16 @@ func TestGraylogChunkProcessComplete(t *testing.T) {
 	s.HandleChunkedPacket([]byte("\x1e\x0f\x00\x00\x00\x00\xDE\xAD\xBE\xEF\x01\x02,\"test2\":\"hello\"}"))
 
 	msg := <-s.Messages
-	value, ok := msg.Container.Path("test").Data().(string)
+	value, ok := msg.FieldString("test")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "foobar", value)
 
-	value, ok = msg.Container.Path("test2").Data().(string)
+	value, ok = msg.FieldString("test2")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "hello", value)
 
 	// Ensure that ConvertGraylogFields has been called
-	value, ok = msg.Container.Path("level").Data().(string)
+	value, ok = msg.FieldString("level")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "DEBUG", value)
 
@@ -294,7 +298,7 @@ func TestGraylogSingleFullChunkProcessing(t *testing.T) {
 	s.HandleChunkedPacket([]byte("\x1e\x0f\x00\x00\x00\x00\xDE\xAD\xBE\xEF\x00\x01{\"version\":\"1.1\",\"host\":\"delivery-staging-us-east-1b-asg-general\",\"test\":\"foobar\",\"level\":7}"))
 
 	msg := <-s.Messages
-	value, ok := msg.Container.Path("test").Data().(string)
+	value, ok := msg.FieldString("test")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "foobar", value)
 
@@ -354,6 +358,88 @@ func TestGraylogRunCleanupEvery5Seconds(t *testing.T) {
 
 }
 
+func graylogChunk(id byte, sequence byte, count byte, payload string) []byte {
+	return append([]byte{0x1e, 0x0f, 0, 0, 0, 0, 0, 0, 0, id, sequence, count}, payload...)
+}
+
+func TestGraylogChunkValidation(t *testing.T) {
+
+	s := Graylog{Stats: NewStats()}
+	s.Messages = make(chan Message, 10)
+
+	assert.NotNil(t, s.HandleChunkedPacket([]byte("\x1e\x0f\x00")))
+	assert.NotNil(t, s.HandleChunkedPacket(graylogChunk(1, 2, 2, "{}")))
+	assert.NotNil(t, s.HandleChunkedPacket(graylogChunk(1, 0, 0, "{}")))
+	assert.NotNil(t, s.HandleChunkedPacket(graylogChunk(1, 0, 129, "{}")))
+	assert.Nil(t, s.HandleChunkedPacket(graylogChunk(1, 127, 128, "{}")))
+	assert.Equal(t, 1, len(s.ReceivedChunks))
+
+	// The count must match the earlier chunks
+	assert.NotNil(t, s.HandleChunkedPacket(graylogChunk(1, 0, 3, "{}")))
+	assert.Equal(t, int64(5), s.Stats.Counter("logs2kafka.input.parse_errors,input=gelf,reason=chunk"))
+
+	// ParseGraylogMessage must not panic on short packets either
+	assert.NotNil(t, s.ParseGraylogMessage([]byte("\x1e\x0f")))
+}
+
+func TestGraylogChunkDuplicates(t *testing.T) {
+
+	s := Graylog{Stats: NewStats()}
+	s.Messages = make(chan Message, 10)
+
+	assert.Nil(t, s.HandleChunkedPacket(graylogChunk(1, 0, 2, `{"short_message":`)))
+	assert.Nil(t, s.HandleChunkedPacket(graylogChunk(1, 0, 2, `{"short_message":`)))
+
+	chunk := s.ReceivedChunks["\x00\x00\x00\x00\x00\x00\x00\x01"]
+	assert.Equal(t, 1, chunk.ReceivedCount)
+	assert.Equal(t, 17, chunk.ReceivedBytes)
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.gelf.chunks_duplicate"))
+
+	assert.Nil(t, s.HandleChunkedPacket(graylogChunk(1, 1, 2, `"hello"}`)))
+	msg := <-s.Messages
+	value, _ := msg.FieldString("msg")
+	assert.Equal(t, "hello", value)
+	assert.Equal(t, 0, len(s.ReceivedChunks))
+	assert.Equal(t, 0, s.pendingBytes)
+}
+
+func TestGraylogChunkBufferReuse(t *testing.T) {
+
+	s := Graylog{}
+	s.Messages = make(chan Message, 10)
+
+	buffer := graylogChunk(1, 0, 2, `{"short_message":`)
+	s.HandleChunkedPacket(buffer)
+	copy(buffer[12:], "xxxxxxxxxxxxxxxxx")
+	s.HandleChunkedPacket(graylogChunk(1, 1, 2, `"hello"}`))
+
+	msg := <-s.Messages
+	value, _ := msg.FieldString("msg")
+	assert.Equal(t, "hello", value)
+}
+
+func TestGraylogChunkLimits(t *testing.T) {
+
+	s := Graylog{Stats: NewStats(), MaxPendingBytes: 20, MaxPendingMessages: 2}
+	s.Messages = make(chan Message, 10)
+
+	assert.Nil(t, s.HandleChunkedPacket(graylogChunk(1, 0, 3, "0123456789")))
+	assert.Nil(t, s.HandleChunkedPacket(graylogChunk(2, 0, 3, "0123456789")))
+
+	// Over the number of pending messages
+	assert.NotNil(t, s.HandleChunkedPacket(graylogChunk(3, 0, 3, "0")))
+	assert.Equal(t, 2, len(s.ReceivedChunks))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.gelf.chunks_dropped,reason=pending_messages"))
+
+	// Over the pending bytes, the message can't be completed and is dropped
+	assert.NotNil(t, s.HandleChunkedPacket(graylogChunk(1, 1, 3, "0123456789")))
+	assert.Equal(t, 1, len(s.ReceivedChunks))
+	assert.Equal(t, 10, s.pendingBytes)
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.gelf.chunks_dropped,reason=pending_bytes"))
+	assert.Equal(t, int64(1), s.Stats.Gauge("logs2kafka.gelf.chunks_pending"))
+	assert.Equal(t, int64(10), s.Stats.Gauge("logs2kafka.gelf.chunks_pending_bytes"))
+}
+
 /*
 func TestGraylogFullChunkReceive(t *testing.T) {
 
@@ -381,15 +467,15 @@ func TestGraylogFullChunkReceive(t *testing.T) {
 	Conn.Close()
 
 	msg := <-s.Messages
-	value, ok := msg.Container.Path("msg").Data().(string)
+	value, ok := msg.FieldString("msg")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "main.main()", value)
 
-	value, ok = msg.Container.Path("version").Data().(string)
+	value, ok = msg.FieldString("version")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "1.1", value)
 
-	value, ok = msg.Container.Path("_command").Data().(string)
+	value, ok = msg.FieldString("_command")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "/comet-source-adapter", value)
 
@@ -397,4 +483,70 @@ func TestGraylogFullChunkReceive(t *testing.T) {
 	s.Close()
 
 }
-*/
\ No newline at end of file
+*/
+func TestGraylogConcurrentChunks(t *testing.T) {
+
+	s := Graylog{}
+	s.Messages = make(chan Message, 100)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id byte) {
+			defer wg.Done()
+			s.HandleChunkedPacket(graylogChunk(id, 1, 2, `"hello"}`))
+			s.HandleChunkedPacket(graylogChunk(id, 0, 2, `{"short_message":`))
+		}(byte(i))
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, len(s.Messages))
+	assert.Equal(t, 0, len(s.ReceivedChunks))
+	assert.Equal(t, 0, s.pendingBytes)
+}
+
+func TestGraylogCompressedMessages(t *testing.T) {
+
+	s := Graylog{Stats: NewStats()}
+	s.Messages = make(chan Message, 10)
+
+	doc := []byte(`{"version":"1.1","host":"foo","short_message":"compressed","level":6}`)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(doc)
+	w.Close()
+
+	var zl bytes.Buffer
+	z := zlib.NewWriter(&zl)
+	z.Write(doc)
+	z.Close()
+
+	assert.Nil(t, s.ParseGraylogMessage(gz.Bytes()))
+	assert.Nil(t, s.ParseGraylogMessage(zl.Bytes()))
+
+	// Compressed messages can also be chunked
+	half := zl.Len() / 2
+	assert.Nil(t, s.HandleChunkedPacket(append([]byte{0x1e, 0x0f, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2}, zl.Bytes()[:half]...)))
+	assert.Nil(t, s.HandleChunkedPacket(append([]byte{0x1e, 0x0f, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2}, zl.Bytes()[half:]...)))
+
+	assert.Equal(t, 3, len(s.Messages))
+	for i := 0; i < 3; i++ {
+		m := <-s.Messages
+		value, _ := m.FieldString("msg")
+		assert.Equal(t, "compressed", value)
+	}
+
+	assert.NotNil(t, s.ParseGraylogMessage(gz.Bytes()[:10]))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.parse_errors,input=gelf,reason=compression"))
+
+	// A small packet which would decompress into too large a message
+	var bomb bytes.Buffer
+	w = gzip.NewWriter(&bomb)
+	w.Write(make([]byte, MaxGraylogMessageSize+1))
+	w.Close()
+
+	assert.NotNil(t, s.ParseGraylogMessage(bomb.Bytes()))
+	assert.Equal(t, 0, len(s.Messages))
+	assert.Equal(t, int64(2), s.Stats.Counter("logs2kafka.input.parse_errors,input=gelf,reason=compression"))
+}
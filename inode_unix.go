@@ -0,0 +1,17 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of a file, which is used to notice
+// when a log file has been replaced by a new one with the same name.
+func fileInode(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// Delivery metrics of the KafkaProducer. Each acknowledged message is
+// counted per topic together with its size and the latency from when the
+// relay received it. The number of messages in flight (sent to the
+// producer but not acknowledged or failed yet) and the metrics which sarama
+// collects into its go-metrics registry are published periodically.
+
+const DefaultKafkaMetricsInterval = 10 * time.Second
+
+func (s *KafkaProducer) handleSuccess(m *sarama.ProducerMessage) {
+	attempt, ok := m.Metadata.(*produceAttempt)
+	if !ok {
+		return
+	}
+	s.delivered(m.Topic)
+	s.Stats.Add("logs2kafka.produce,outcome=delivered", 1)
+
+	if s.Statsd == nil {
+		return
+	}
+
+	s.Statsd.Inc(fmt.Sprintf("logs2kafka.produced,topic=%s", m.Topic), 1, 0.1)
+
+	size := 0
+	if m.Key != nil {
+		size += m.Key.Length()
+	}
+	if m.Value != nil {
+		size += m.Value.Length()
+	}
+	s.Statsd.Inc(fmt.Sprintf("logs2kafka.produced_bytes,topic=%s", m.Topic), int64(size), 0.1)
+
+	if !attempt.message.ReceivedAt.IsZero() {
+		s.Statsd.TimingDuration(fmt.Sprintf("logs2kafka.produce_latency,topic=%s", m.Topic), time.Since(attempt.message.ReceivedAt), 0.1)
+	}
+}
+
+func (s *KafkaProducer) sending(topic string) {
+	s.metricsMutex.Lock()
+	s.inFlight[topic]++
+	s.metricsMutex.Unlock()
+}
+
+// delivered marks a message as acknowledged or permanently failed
+func (s *KafkaProducer) delivered(topic string) {
+	s.metricsMutex.Lock()
+	s.inFlight[topic]--
+	s.metricsMutex.Unlock()
+}
+
+// InFlight returns the number of messages of a topic which are waiting for
+// an acknowledgement.
+func (s *KafkaProducer) InFlight(topic string) int64 {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+	return s.inFlight[topic]
+}
+
+func (s *KafkaProducer) publishMetrics() {
+	if s.Statsd == nil {
+		return
+	}
+
+	// The counts are copied so that a slow statsd client doesn't hold up
+	// the producer, which takes the same lock for each message
+	s.metricsMutex.Lock()
+	inFlight := make(map[string]int64, len(s.inFlight))
+	for topic, count := range s.inFlight {
+		inFlight[topic] = count
+	}
+	s.metricsMutex.Unlock()
+
+	for topic, count := range inFlight {
+		s.Statsd.Gauge(fmt.Sprintf("logs2kafka.in_flight,topic=%s", topic), count, 1)
+	}
+
+	if s.metricRegistry != nil {
+		BridgeSaramaMetrics(s.metricRegistry, s.Statsd)
+	}
+}
+
+// BridgeSaramaMetrics sends the current values of sarama's metrics as
+// statsd gauges. The broker and topic specific metrics, such as
+// "request-latency-in-ms-for-broker-1", are tagged with broker=1 or
+// topic=<topic>. Meters are sent as their one minute rate and histograms
+// as their mean, 95th percentile and maximum, eg.
+//
+//   logs2kafka.sarama.request_latency_in_ms,broker=1,stat=p95
+func BridgeSaramaMetrics(registry metrics.Registry, statsd StatisticsSender) {
+	registry.Each(func(name string, metric interface{}) {
+		name = saramaMetricName(name)
+
+		switch m := metric.(type) {
+		case metrics.Meter:
+			statsd.Gauge(name, int64(m.Snapshot().Rate1()+0.5), 1)
+		case metrics.Histogram:
+			h := m.Snapshot()
+			if h.Count() == 0 {
+				return
+			}
+			statsd.Gauge(name+",stat=mean", int64(h.Mean()+0.5), 1)
+			statsd.Gauge(name+",stat=p95", int64(h.Percentile(0.95)+0.5), 1)
+			statsd.Gauge(name+",stat=max", h.Max(), 1)
+		case metrics.Counter:
+			statsd.Gauge(name, m.Count(), 1)
+		case metrics.Gauge:
+			statsd.Gauge(name, m.Value(), 1)
+		}
+	})
+}
+
+func saramaMetricName(name string) string {
+	tags := ""
+	for _, tag := range []string{"broker", "topic"} {
+		separator := "-for-" + tag + "-"
+		if i := strings.Index(name, separator); i >= 0 {
+			tags = "," + tag + "=" + name[i+len(separator):]
+			name = name[:i]
+			break
+		}
+	}
+
+	return "logs2kafka.sarama." + strings.Replace(name, "-", "_", -1) + tags
+}
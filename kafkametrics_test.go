@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaramaMetricName(t *testing.T) {
+	assert.Equal(t, "logs2kafka.sarama.request_latency_in_ms", saramaMetricName("request-latency-in-ms"))
+	assert.Equal(t, "logs2kafka.sarama.request_latency_in_ms,broker=1", saramaMetricName("request-latency-in-ms-for-broker-1"))
+	assert.Equal(t, "logs2kafka.sarama.batch_size,topic=service.foo-bar", saramaMetricName("batch-size-for-topic-service.foo-bar"))
+}
+
+func TestBridgeSaramaMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	histogram := metrics.GetOrRegisterHistogram("batch-size-for-topic-service.foo", registry, metrics.NewUniformSample(100))
+	for i := int64(1); i <= 100; i++ {
+		histogram.Update(i)
+	}
+	metrics.GetOrRegisterHistogram("compression-ratio", registry, metrics.NewUniformSample(100))
+	metrics.GetOrRegisterCounter("records-in-flight", registry).Inc(3)
+
+	statsd := newTestStatsd()
+	BridgeSaramaMetrics(registry, statsd)
+
+	value, _ := statsd.GaugeValue("logs2kafka.sarama.batch_size,topic=service.foo,stat=mean")
+	assert.Equal(t, int64(51), value)
+	value, _ = statsd.GaugeValue("logs2kafka.sarama.batch_size,topic=service.foo,stat=max")
+	assert.Equal(t, int64(100), value)
+	value, _ = statsd.GaugeValue("logs2kafka.sarama.records_in_flight")
+	assert.Equal(t, int64(3), value)
+
+	// Empty histograms are not sent
+	_, ok := statsd.GaugeValue("logs2kafka.sarama.compression_ratio,stat=mean")
+	assert.Equal(t, false, ok)
+}
+
+func TestKafkaProducerDeliveryMetrics(t *testing.T) {
+	statsd := newTestStatsd()
+	producer := newTestAsyncProducer()
+
+	s := KafkaProducer{Statsd: statsd, MetricsInterval: time.Millisecond}
+	s.metricRegistry = metrics.NewRegistry()
+	s.start(producer)
+
+	m := testProducerMessage()
+	m.ReceivedAt = time.Now()
+	s.Produce(m)
+
+	<-producer.produced
+	deadline := time.Now().Add(5 * time.Second)
+	for s.InFlight("service.foo") != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(0), s.InFlight("service.foo"))
+
+	s.Close()
+
+	assert.Equal(t, int64(1), statsd.Counter("logs2kafka.produced,topic=service.foo"))
+	assert.Equal(t, int64(len(`{"msg":"hello","service":"foo"}`)), statsd.Counter("logs2kafka.produced_bytes,topic=service.foo"))
+	assert.Equal(t, int64(1), statsd.Timings("logs2kafka.produce_latency,topic=service.foo"))
+	value, ok := statsd.GaugeValue("logs2kafka.in_flight,topic=service.foo")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, int64(0), value)
+}
+
+func TestKafkaProducerPublishMetricsDoesntBlockProduce(t *testing.T) {
+	statsd := &blockingStatsd{testStatsd: *newTestStatsd(), sending: make(chan bool, 1), release: make(chan bool)}
+	s := KafkaProducer{Statsd: statsd, inFlight: map[string]int64{"service.foo": 1}}
+
+	published := make(chan bool)
+	go func() {
+		s.publishMetrics()
+		close(published)
+	}()
+	<-statsd.sending
+
+	// Messages are counted while the in flight gauge is being sent
+	counted := make(chan bool)
+	go func() {
+		s.sending("service.foo")
+		close(counted)
+	}()
+	select {
+	case <-counted:
+	case <-time.After(time.Second):
+		t.Fatal("sending was blocked by publishMetrics")
+	}
+
+	close(statsd.release)
+	<-published
+	assert.Equal(t, int64(2), s.InFlight("service.foo"))
+	value, _ := statsd.GaugeValue("logs2kafka.in_flight,topic=service.foo")
+	assert.Equal(t, int64(1), value)
+}
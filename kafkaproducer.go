@@ -3,17 +3,74 @@ package main
 import "gopkg.in/Shopify/sarama.v1"
 import "time"
 import "fmt"
+import "os"
 import "hash"
 import "hash/fnv"
+import "sync"
+import "github.com/rcrowley/go-metrics"
 
 type KafkaProducer struct {
 	Brokers []string
 
 	CommonKey sarama.Encoder
 
+	// KeyTemplate overrides CommonKey with a key built from message fields
+	// when set.
+	KeyTemplate *KeyTemplate
+
+	// Version is the Kafka protocol version to use. Headers require at least 0.11.
+	Version sarama.KafkaVersion
+
+	// Headers enables routing metadata to be attached as record headers to each message.
+	Headers bool
+
+	// Hostname of the relay, sent in the "relay_host" header.
+	Hostname string
+
+	// Encoder serializes the message values. JSON is used if this is nil.
+	Encoder ValueEncoder
+
+	// TopicEncoders overrides Encoder for specific topics.
+	TopicEncoders map[string]ValueEncoder
+
+	// Number of times a message which failed with a retriable error is
+	// sent again, on top of the retries done by sarama itself.
+	MaxRetries int
+
+	// Delay before the first retry, doubled for each following retry.
+	RetryBackoff time.Duration
+
+	// DeadLetter stores the messages which failed permanently, nil to drop them.
+	DeadLetter *DeadLetterLog
+
 	producer sarama.AsyncProducer
 
+	// closed when the producer has shut down
+	done chan bool
+
+	// How often the in-flight counts and sarama's metrics are sent to statsd
+	MetricsInterval time.Duration
+
+	metricRegistry metrics.Registry
+	metricsMutex   sync.Mutex
+	inFlight       map[string]int64
+
+	// retries holds the retries which are waiting for their backoff
+	retries sync.WaitGroup
+	mutex   sync.Mutex
+	closing bool
+
 	Statsd StatisticsSender
+
+	// Stats counts the produce outcomes, can be nil
+	Stats *Stats
+}
+
+// produceAttempt is carried in the sarama.ProducerMessage metadata so that
+// failed messages can be retried and written to the dead-letter log.
+type produceAttempt struct {
+	message  Message
+	attempts int
 }
 
 type inconsistentHashPartitioner struct {
@@ -56,7 +113,7 @@ func (s *KafkaProducer) Init(brokers []string, partition_key string) error {
 	s.Brokers = brokers
 
 	conf := sarama.NewConfig()
-	conf.Producer.Return.Successes = false
+	conf.Producer.Return.Successes = true
 	conf.Producer.Return.Errors = true
 	conf.Producer.Partitioner = NewInconsistentHashPartitioner
 	conf.Producer.Flush.Messages = 1
@@ -64,7 +121,15 @@ func (s *KafkaProducer) Init(brokers []string, partition_key string) error {
 	//conf.Producer.RequiredAcks = -1
 	conf.Metadata.Retry.Max = 1
 
+	if s.Version != (sarama.KafkaVersion{}) {
+		conf.Version = s.Version
+	}
+	if s.Headers && !conf.Version.IsAtLeast(sarama.V0_11_0_0) {
+		conf.Version = sarama.V0_11_0_0
+	}
+
 	s.CommonKey = sarama.ByteEncoder(partition_key)
+	s.metricRegistry = conf.MetricRegistry
 
 	kp, err := sarama.NewAsyncProducer(brokers, conf)
 
@@ -72,33 +137,246 @@ func (s *KafkaProducer) Init(brokers []string, partition_key string) error {
 		return err
 	}
 
+	s.start(kp)
+	return nil
+
+}
+
+func (s *KafkaProducer) start(kp sarama.AsyncProducer) {
 	s.producer = kp
+	s.inFlight = make(map[string]int64)
+	if s.MetricsInterval == 0 {
+		s.MetricsInterval = DefaultKafkaMetricsInterval
+	}
 
+	s.done = make(chan bool)
+
+	var drained sync.WaitGroup
+	drained.Add(2)
 	go func() {
+		defer drained.Done()
 		for v := range kp.Errors() {
-			fmt.Printf("errors: %+v\n", v.Msg)
-			fmt.Printf("v: %+v\n", v)
-			if s.Statsd != nil {
-				s.Statsd.Inc("logs2kafka.produceErrors", 1, 1)
-			}
+			s.handleError(v)
 		}
 	}()
-	return nil
+	go func() {
+		defer drained.Done()
+		for m := range kp.Successes() {
+			s.handleSuccess(m)
+		}
+	}()
+	go func() {
+		drained.Wait()
+		close(s.done)
+	}()
 
+	go func() {
+		ticker := time.NewTicker(s.MetricsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.publishMetrics()
+			}
+		}
+	}()
 }
 
 func (s *KafkaProducer) Produce(m Message) {
 
+	key := s.CommonKey
+	if s.KeyTemplate != nil {
+		key = s.KeyTemplate.Key(&m)
+	}
+
+	encoder := s.Encoder
+	if e, ok := s.TopicEncoders[m.Topic]; ok {
+		encoder = e
+	}
+	if encoder == nil {
+		encoder = JSONEncoder{}
+	}
+
+	value, err := encoder.Encode(&m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding message for topic %s: %s\n", m.Topic, err)
+		if s.Statsd != nil {
+			s.Statsd.Inc("logs2kafka.encodeErrors", 1, 1)
+		}
+		s.deadLetter(&m, err, 0)
+		return
+	}
+
 	km := sarama.ProducerMessage{
-		Topic: m.Topic,
-		Key:   s.CommonKey,
-		Value: sarama.ByteEncoder(m.Container.Bytes()),
+		Topic:    m.Topic,
+		Key:      key,
+		Value:    sarama.ByteEncoder(value),
+		Metadata: &produceAttempt{message: m, attempts: 1},
+	}
+
+	if s.Headers {
+		km.Headers = s.RecordHeaders(&m)
 	}
 	//fmt.Printf("producer: %+v\n", s.producer)
+	s.sending(km.Topic)
 	s.producer.Input() <- &km
 }
 
+// RecordHeaders returns the routing metadata headers for a message so that
+// consumers can route and filter without parsing the message value.
+func (s *KafkaProducer) RecordHeaders(m *Message) []sarama.RecordHeader {
+	headers := make([]sarama.RecordHeader, 0, 6)
+
+	add := func(key string, value string) {
+		if value != "" {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+
+	add("source", m.Source)
+	add("relay_host", s.Hostname)
+
+	service, _ := m.FieldString("service")
+	add("service", service)
+
+	level, _ := m.FieldString("level")
+	add("level", level)
+
+	add("logs2kafka_build", builddate)
+
+	if !m.ReceivedAt.IsZero() {
+		add("received_ts", m.ReceivedAt.UTC().Format(time.RFC3339Nano))
+	}
+
+	return headers
+}
+
+// Write implements Output
+func (s *KafkaProducer) Write(m *Message) error {
+	s.Produce(*m)
+	return nil
+}
+
+// Close flushes the buffered messages and waits for the producer to shut
+// down. Messages which are waiting for a retry are sent before that, but if
+// they fail again they go to the dead-letter log.
 func (s *KafkaProducer) Close() {
-	//s.close <- true
+	s.mutex.Lock()
+	s.closing = true
+	s.mutex.Unlock()
+
+	s.retries.Wait()
 	s.producer.AsyncClose()
+	<-s.done
+	s.publishMetrics()
+
+	if s.DeadLetter != nil {
+		s.DeadLetter.Close()
+	}
+}
+
+// IsRetriableProduceError classifies produce errors. Errors caused by the
+// message itself or the configuration fail the same way when retried;
+// other errors such as leader elections and network problems are expected
+// to go away.
+func IsRetriableProduceError(err error) bool {
+	switch err {
+	case sarama.ErrInvalidMessage,
+		sarama.ErrInvalidMessageSize,
+		sarama.ErrMessageSizeTooLarge,
+		sarama.ErrMessageSetSizeTooLarge,
+		sarama.ErrInvalidTopic,
+		sarama.ErrInvalidRequiredAcks,
+		sarama.ErrInvalidTimestamp,
+		sarama.ErrUnsupportedVersion,
+		sarama.ErrUnsupportedForMessageFormat,
+		sarama.ErrPolicyViolation,
+		sarama.ErrTopicAuthorizationFailed,
+		sarama.ErrClusterAuthorizationFailed,
+		sarama.ErrShuttingDown,
+		sarama.ErrClosedClient:
+		return false
+	}
+
+	switch err.(type) {
+	case sarama.ConfigurationError, sarama.PacketEncodingError:
+		return false
+	}
+
+	return true
+}
+
+func (s *KafkaProducer) handleError(v *sarama.ProducerError) {
+	attempt, ok := v.Msg.Metadata.(*produceAttempt)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error producing message to topic %s: %s\n", v.Msg.Topic, v.Err)
+		return
+	}
+
+	service, _ := attempt.message.FieldString("service")
+	retriable := IsRetriableProduceError(v.Err)
+
+	if s.Statsd != nil {
+		s.Statsd.Inc("logs2kafka.produceErrors", 1, 1)
+		class := "fatal"
+		if retriable {
+			class = "retriable"
+		}
+		s.Statsd.Inc(fmt.Sprintf("logs2kafka.produce_errors,topic=%s,service=%s,error=%s", v.Msg.Topic, service, class), 1, 1)
+	}
+
+	if retriable && attempt.attempts <= s.MaxRetries {
+		s.mutex.Lock()
+		closing := s.closing
+		if !closing {
+			s.retries.Add(1)
+		}
+		s.mutex.Unlock()
+
+		if !closing {
+			backoff := s.RetryBackoff << uint(attempt.attempts-1)
+			attempt.attempts++
+			s.Stats.Add("logs2kafka.produce,outcome=retried", 1)
+			if s.Statsd != nil {
+				s.Statsd.Inc(fmt.Sprintf("logs2kafka.produce_retries,topic=%s", v.Msg.Topic), 1, 1)
+			}
+			// sarama keeps its own retry state in the message, so a fresh
+			// one is sent
+			retry := &sarama.ProducerMessage{
+				Topic:    v.Msg.Topic,
+				Key:      v.Msg.Key,
+				Value:    v.Msg.Value,
+				Headers:  v.Msg.Headers,
+				Metadata: attempt,
+			}
+			time.AfterFunc(backoff, func() {
+				defer s.retries.Done()
+				s.producer.Input() <- retry
+			})
+			return
+		}
+	}
+
+	s.delivered(v.Msg.Topic)
+	fmt.Fprintf(os.Stderr, "Error producing message of service %s to topic %s after %d attempts: %s\n", service, v.Msg.Topic, attempt.attempts, v.Err)
+	s.deadLetter(&attempt.message, v.Err, attempt.attempts)
+}
+
+func (s *KafkaProducer) deadLetter(m *Message, reason error, attempts int) {
+	service, _ := m.FieldString("service")
+	s.Stats.Add("logs2kafka.produce,outcome=failed", 1)
+	if s.Statsd != nil {
+		s.Statsd.Inc(fmt.Sprintf("logs2kafka.dead_letters,topic=%s,service=%s", m.Topic, service), 1, 1)
+	}
+
+	if s.DeadLetter == nil {
+		return
+	}
+
+	err := s.DeadLetter.Write(m, reason, attempts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing message to the dead-letter log of topic %s: %s\n", m.Topic, err)
+	}
 }
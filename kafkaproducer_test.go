@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/Shopify/sarama.v1"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestKafkaProducer(t *testing.T) {
@@ -34,3 +37,182 @@ func TestKafkaProducer(t *testing.T) {
 	k.Close()
 
 }
+
+func TestKafkaProducerRecordHeaders(t *testing.T) {
+
+	k := KafkaProducer{}
+	k.Hostname = "relay-1"
+
+	m := JSONToMessage("{\"level\":\"DEBUG\",\"service\":\"foo\",\"msg\":\"Hello, World!\"}")
+	err := m.ParseJSON()
+	assert.Nil(t, err)
+	m.Source = "gelf"
+	m.ReceivedAt = time.Date(2017, 5, 19, 6, 5, 22, 0, time.UTC)
+
+	headers := make(map[string]string)
+	for _, h := range k.RecordHeaders(&m) {
+		headers[string(h.Key)] = string(h.Value)
+	}
+
+	assert.Equal(t, "gelf", headers["source"])
+	assert.Equal(t, "relay-1", headers["relay_host"])
+	assert.Equal(t, "foo", headers["service"])
+	assert.Equal(t, "DEBUG", headers["level"])
+	assert.Equal(t, "2017-05-19T06:05:22Z", headers["received_ts"])
+}
+
+// testAsyncProducer fails the messages sent to it with the queued errors
+type testAsyncProducer struct {
+	input     chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	successes chan *sarama.ProducerMessage
+	failures  chan error
+	produced  chan *sarama.ProducerMessage
+}
+
+func newTestAsyncProducer(failures ...error) *testAsyncProducer {
+	p := &testAsyncProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError, 10),
+		successes: make(chan *sarama.ProducerMessage, 10),
+		failures:  make(chan error, len(failures)),
+		produced:  make(chan *sarama.ProducerMessage, 10),
+	}
+	for _, err := range failures {
+		p.failures <- err
+	}
+
+	go func() {
+		for m := range p.input {
+			select {
+			case err := <-p.failures:
+				p.errors <- &sarama.ProducerError{Msg: m, Err: err}
+			default:
+				p.produced <- m
+				p.successes <- m
+			}
+		}
+		close(p.errors)
+		close(p.successes)
+	}()
+
+	return p
+}
+
+func (p *testAsyncProducer) AsyncClose()                               { close(p.input) }
+func (p *testAsyncProducer) Close() error                              { p.AsyncClose(); return nil }
+func (p *testAsyncProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *testAsyncProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *testAsyncProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+func TestIsRetriableProduceError(t *testing.T) {
+	assert.Equal(t, true, IsRetriableProduceError(sarama.ErrLeaderNotAvailable))
+	assert.Equal(t, true, IsRetriableProduceError(sarama.ErrOutOfBrokers))
+	assert.Equal(t, true, IsRetriableProduceError(fmt.Errorf("connection reset")))
+	assert.Equal(t, false, IsRetriableProduceError(sarama.ErrMessageSizeTooLarge))
+	assert.Equal(t, false, IsRetriableProduceError(sarama.ErrTopicAuthorizationFailed))
+	assert.Equal(t, false, IsRetriableProduceError(sarama.ConfigurationError("bad")))
+}
+
+func testProducerMessage() Message {
+	m := JSONToMessage(`{"service":"foo","msg":"hello"}`)
+	m.ParseJSON()
+	m.Topic = "service.foo"
+	return m
+}
+
+func TestKafkaProducerRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	statsd := newTestStatsd()
+	producer := newTestAsyncProducer(sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition)
+
+	s := KafkaProducer{MaxRetries: 3, RetryBackoff: time.Millisecond, Statsd: statsd}
+	s.DeadLetter = NewDeadLetterLog(dir)
+	s.start(producer)
+
+	s.Produce(testProducerMessage())
+
+	select {
+	case m := <-producer.produced:
+		assert.Equal(t, "service.foo", m.Topic)
+		assert.Equal(t, 3, m.Metadata.(*produceAttempt).attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the retry")
+	}
+
+	s.Close()
+	assert.Equal(t, int64(2), statsd.Counter("logs2kafka.produce_retries,topic=service.foo"))
+	assert.Equal(t, int64(2), statsd.Counter("logs2kafka.produce_errors,topic=service.foo,service=foo,error=retriable"))
+
+	_, err = os.Stat(dir + "/service.foo.dead-letter.log")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKafkaProducerDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	statsd := newTestStatsd()
+	producer := newTestAsyncProducer(
+		sarama.ErrMessageSizeTooLarge,
+		sarama.ErrLeaderNotAvailable, sarama.ErrLeaderNotAvailable, sarama.ErrLeaderNotAvailable)
+
+	s := KafkaProducer{MaxRetries: 2, RetryBackoff: time.Millisecond, Statsd: statsd}
+	s.DeadLetter = NewDeadLetterLog(dir)
+	s.start(producer)
+
+	// Fatal errors are not retried
+	s.Produce(testProducerMessage())
+
+	// Retriable errors are retried MaxRetries times
+	s.Produce(testProducerMessage())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for statsd.Counter("logs2kafka.dead_letters,topic=service.foo,service=foo") < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+
+	assert.Equal(t, int64(1), statsd.Counter("logs2kafka.produce_errors,topic=service.foo,service=foo,error=fatal"))
+	assert.Equal(t, int64(3), statsd.Counter("logs2kafka.produce_errors,topic=service.foo,service=foo,error=retriable"))
+	assert.Equal(t, 0, len(producer.produced))
+
+	var lines []string
+	err = ReadLocalLogFile(dir+"/service.foo.dead-letter.log", func(line []byte) bool {
+		lines = append(lines, string(line))
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(lines))
+
+	m := JSONToMessage(lines[0])
+	m.ParseJSON()
+	value, _ := m.FieldString("dead_letter.reason")
+	assert.Equal(t, sarama.ErrMessageSizeTooLarge.Error(), value)
+	value, _ = m.FieldString("dead_letter.attempts")
+	assert.Equal(t, "1", value)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "hello", value)
+
+	m = JSONToMessage(lines[1])
+	m.ParseJSON()
+	value, _ = m.FieldString("dead_letter.attempts")
+	assert.Equal(t, "3", value)
+
+	// The dead-letter files are found and replayed into the original topic
+	files, err := LocalLogFiles(dir, "foo"+DeadLetterSuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dir + "/service.foo.dead-letter.log"}, files)
+
+	output := &testOutput{}
+	r := Replayer{Output: output}
+	err = r.Replay(files)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(output.messages))
+	assert.Equal(t, "service.foo", output.messages[0].Topic)
+	assert.Equal(t, `{"msg":"hello","service":"foo"}`, output.messages[0].Container.String())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// KeyTemplate builds the Kafka message key out of message fields.
+//
+// A template is either a plain field name ("container_id") or a string where
+// field names are written inside curly braces ("{service}-{pod_name}").
+// A template without any parts produces no key at all, in which case the
+// partitioner will pick a random partition for each message.
+type KeyTemplate struct {
+	parts []keyTemplatePart
+}
+
+type keyTemplatePart struct {
+	literal string
+	field   string
+}
+
+// ParseKeyTemplate parses the --kafka-key option. The special values "none"
+// and "" mean that messages are produced without a key.
+func ParseKeyTemplate(template string) (*KeyTemplate, error) {
+	t := &KeyTemplate{}
+
+	if template == "" || template == "none" {
+		return t, nil
+	}
+
+	if !strings.ContainsAny(template, "{}") {
+		t.parts = append(t.parts, keyTemplatePart{field: template})
+		return t, nil
+	}
+
+	rest := template
+	for len(rest) > 0 {
+		start := strings.IndexByte(rest, '{')
+		if start == -1 {
+			if strings.IndexByte(rest, '}') != -1 {
+				return nil, errors.New("Unexpected '}' in key template")
+			}
+			t.parts = append(t.parts, keyTemplatePart{literal: rest})
+			break
+		}
+
+		if strings.IndexByte(rest[0:start], '}') != -1 {
+			return nil, errors.New("Unexpected '}' in key template")
+		}
+
+		if start > 0 {
+			t.parts = append(t.parts, keyTemplatePart{literal: rest[0:start]})
+		}
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end == -1 {
+			return nil, errors.New("Missing '}' in key template")
+		}
+
+		field := rest[start+1 : start+end]
+		if field == "" {
+			return nil, errors.New("Empty field name in key template")
+		}
+		t.parts = append(t.parts, keyTemplatePart{field: field})
+
+		rest = rest[start+end+1:]
+	}
+
+	return t, nil
+}
+
+// Key returns the key for the message or nil if the template has no parts or
+// none of the referenced fields are present in the message.
+func (t *KeyTemplate) Key(m *Message) sarama.Encoder {
+	if len(t.parts) == 0 {
+		return nil
+	}
+
+	found := false
+	key := make([]byte, 0, 64)
+	for _, part := range t.parts {
+		if part.field == "" {
+			key = append(key, part.literal...)
+			continue
+		}
+
+		value, ok := m.FieldString(part.field)
+		if ok {
+			found = true
+			key = append(key, value...)
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	return sarama.ByteEncoder(key)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+func TestKeyTemplateSingleField(t *testing.T) {
+	k, err := ParseKeyTemplate("container_id")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"container_id":"e3088a0601ea","service":"foo"}`)
+	m.ParseJSON()
+
+	assert.Equal(t, sarama.ByteEncoder("e3088a0601ea"), k.Key(&m))
+}
+
+func TestKeyTemplateMultipleFields(t *testing.T) {
+	k, err := ParseKeyTemplate("{service}-{pod_name}")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"pod_name":"foo-1234","service":"foo"}`)
+	m.ParseJSON()
+
+	assert.Equal(t, sarama.ByteEncoder("foo-foo-1234"), k.Key(&m))
+}
+
+func TestKeyTemplateDockerLabelField(t *testing.T) {
+	k, err := ParseKeyTemplate("{_io.kubernetes.pod.name}")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"_io.kubernetes.pod.name":"foo-1234"}`)
+	m.ParseJSON()
+
+	assert.Equal(t, sarama.ByteEncoder("foo-1234"), k.Key(&m))
+}
+
+func TestKeyTemplateMissingFieldsGiveNoKey(t *testing.T) {
+	k, err := ParseKeyTemplate("{service}-{pod_name}")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"msg":"hello"}`)
+	m.ParseJSON()
+
+	assert.Nil(t, k.Key(&m))
+}
+
+func TestKeyTemplateNone(t *testing.T) {
+	k, err := ParseKeyTemplate("none")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"service":"foo"}`)
+	m.ParseJSON()
+
+	assert.Nil(t, k.Key(&m))
+}
+
+func TestKeyTemplateInvalid(t *testing.T) {
+	_, err := ParseKeyTemplate("{service")
+	assert.NotNil(t, err)
+
+	_, err = ParseKeyTemplate("service}")
+	assert.NotNil(t, err)
+
+	_, err = ParseKeyTemplate("{}")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalLogFiles returns the local log files of a service in chronological
+// order: first the rotated backups from oldest to newest and the live file
+// last. Both plain and gzip compressed backups are included.
+//
+// Same as with tail, the service can be given either as the full topic name
+// or without the "service." prefix.
+func LocalLogFiles(dir string, service string) ([]string, error) {
+	var files []string
+
+	for _, name := range []string{service, "service." + service} {
+		found, err := localLogFilesOf(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) > 0 {
+			files = found
+		}
+	}
+
+	return files, nil
+}
+
+func localLogFilesOf(dir string, name string) ([]string, error) {
+	// lumberjack names backups as <name>-<timestamp>.log where the
+	// timestamp sorts lexically in chronological order.
+	backups, err := filepath.Glob(filepath.Join(dir, globEscape(name)+"-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := filepath.Glob(filepath.Join(dir, globEscape(name)+"-*.log.gz"))
+	if err != nil {
+		return nil, err
+	}
+	backups = append(backups, compressed...)
+
+	prefix := filepath.Join(dir, name) + "-"
+	files := make([]string, 0, len(backups)+1)
+	for _, backup := range backups {
+		// Skip other services which share the prefix, eg. "foo-bar" when looking for "foo"
+		timestamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(backup, prefix), ".gz"), ".log")
+		if !isBackupTimestamp(timestamp) {
+			continue
+		}
+		files = append(files, backup)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return strings.TrimSuffix(files[i], ".gz") < strings.TrimSuffix(files[j], ".gz")
+	})
+
+	current := filepath.Join(dir, name+".log")
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, current)
+	}
+
+	return files, nil
+}
+
+// isBackupTimestamp checks that the string is in the lumberjack backup time
+// format "2006-01-02T15-04-05.000".
+func isBackupTimestamp(s string) bool {
+	if len(s) != len("2006-01-02T15-04-05.000") {
+		return false
+	}
+	for i, c := range []byte(s) {
+		switch i {
+		case 4, 7, 13, 16:
+			if c != '-' {
+				return false
+			}
+		case 10:
+			if c != 'T' {
+				return false
+			}
+		case 19:
+			if c != '.' {
+				return false
+			}
+		default:
+			if !IsDigit(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func globEscape(s string) string {
+	r := strings.NewReplacer("*", "\\*", "?", "\\?", "[", "\\[", "\\", "\\\\")
+	return r.Replace(s)
+}
+
+// TopicOfLocalLogFile returns the topic name of a local log file, eg.
+// "service.foo" for "/tmp/service.foo-2017-05-19T06-05-22.000.log.gz". The
+// dead-letter files of a topic map to the topic itself.
+func TopicOfLocalLogFile(filename string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(filename), ".gz"), ".log")
+
+	l := len("-2006-01-02T15-04-05.000")
+	if len(name) > l && name[len(name)-l] == '-' && isBackupTimestamp(name[len(name)-l+1:]) {
+		name = name[0 : len(name)-l]
+	}
+
+	return strings.TrimSuffix(name, DeadLetterSuffix)
+}
+
+// ReadLocalLogFile calls fn for each line in a local log file, decompressing
+// gzipped files. Reading stops if fn returns false. Lines appended to the
+// file while it's being read are not included, so that eg. replaying a
+// dead-letter file can't end up reading its own failures.
+func ReadLocalLogFile(filename string, fn func(line []byte) bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader = io.LimitReader(file, fi.Size())
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if !fn(scanner.Bytes()) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// FormatLocalLogLine formats a line from a local log file for the tail and
+// search commands: either as the raw JSON or as "<ts> <level> <msg>".
+func FormatLocalLogLine(line string, raw bool) string {
+	msg := JSONToMessage(line)
+
+	if raw {
+		return string(msg.Data)
+	}
+
+	ts, err1 := msg.GetString("ts")
+	level, err2 := msg.GetString("level")
+	if err2 != nil {
+		level = "UNKNOWN"
+	}
+	text, err3 := msg.GetString("msg")
+	text = strings.TrimRight(text, "\n")
+
+	if err1 != nil || err3 != nil {
+		return fmt.Sprintf("Raw message: %s", line)
+	}
+
+	return fmt.Sprintf("%s %s %s", ts, level, text)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestLogFile(t *testing.T, filename string, content string) {
+	if filepath.Ext(filename) == ".gz" {
+		file, err := os.Create(filename)
+		assert.Nil(t, err)
+		gz := gzip.NewWriter(file)
+		gz.Write([]byte(content))
+		gz.Close()
+		file.Close()
+		return
+	}
+
+	err := ioutil.WriteFile(filename, []byte(content), 0644)
+	assert.Nil(t, err)
+}
+
+func TestLocalLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestLogFile(t, dir+"/service.foo.log", "")
+	writeTestLogFile(t, dir+"/service.foo-2017-05-19T06-05-22.000.log", "")
+	writeTestLogFile(t, dir+"/service.foo-2017-05-18T06-05-22.000.log.gz", "")
+	writeTestLogFile(t, dir+"/service.foo-bar.log", "")
+	writeTestLogFile(t, dir+"/service.foo-bar-2017-05-18T06-05-22.000.log", "")
+
+	files, err := LocalLogFiles(dir, "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		dir + "/service.foo-2017-05-18T06-05-22.000.log.gz",
+		dir + "/service.foo-2017-05-19T06-05-22.000.log",
+		dir + "/service.foo.log",
+	}, files)
+
+	files, err = LocalLogFiles(dir, "service.foo-bar")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		dir + "/service.foo-bar-2017-05-18T06-05-22.000.log",
+		dir + "/service.foo-bar.log",
+	}, files)
+
+	files, err = LocalLogFiles(dir, "bar")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestTopicOfLocalLogFile(t *testing.T) {
+	assert.Equal(t, "service.foo", TopicOfLocalLogFile("/tmp/service.foo.log"))
+	assert.Equal(t, "service.foo", TopicOfLocalLogFile("/tmp/service.foo-2017-05-19T06-05-22.000.log"))
+	assert.Equal(t, "service.foo-bar", TopicOfLocalLogFile("/tmp/service.foo-bar-2017-05-19T06-05-22.000.log.gz"))
+}
+
+func TestReadLocalLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestLogFile(t, dir+"/service.foo-2017-05-18T06-05-22.000.log.gz", "first\nsecond\nthird\n")
+
+	lines := []string{}
+	err = ReadLocalLogFile(dir+"/service.foo-2017-05-18T06-05-22.000.log.gz", func(line []byte) bool {
+		lines = append(lines, string(line))
+		return len(lines) < 2
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second"}, lines)
+}
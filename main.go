@@ -3,12 +3,17 @@ package main
 import "fmt"
 import "os"
 import "strings"
+import "net"
+import "net/http"
+import "net/url"
 import "github.com/cactus/go-statsd-client/statsd"
-import "gopkg.in/natefinch/lumberjack.v2"
+import "os/signal"
+import "syscall"
 import "time"
 import "gopkg.in/urfave/cli.v1"
 import "github.com/op/go-logging"
 import "github.com/hpcloud/tail"
+import "gopkg.in/Shopify/sarama.v1"
 
 var builddate string
 
@@ -46,6 +51,24 @@ func main() {
 			Usage:  "The kafka topic will be '<topic-prefix>.<service name>'",
 			EnvVar: "TOPIC_PREFIX",
 		},
+		cli.StringFlag{
+			Name:   "topic-replacement",
+			Value:  "_",
+			Usage:  "Replaces the characters of service names which Kafka doesn't allow in topics (other than [a-zA-Z0-9._-]). Empty to remove them.",
+			EnvVar: "TOPIC_REPLACEMENT",
+		},
+		cli.StringFlag{
+			Name:   "topic-collisions",
+			Value:  TopicCollisionsKeep,
+			Usage:  "Topics which differ only by '.' and '_' collide in Kafka's metrics: keep, underscore (replace '.' with '_' in service names) or dot (replace '_' with '.')",
+			EnvVar: "TOPIC_COLLISIONS",
+		},
+		cli.IntFlag{
+			Name:   "topic-max-length",
+			Value:  DefaultMaxTopicLength,
+			Usage:  "Longer topic names are shortened and suffixed with a hash of the full name",
+			EnvVar: "TOPIC_MAX_LENGTH",
+		},
 		cli.StringFlag{
 			Name:   "server-ip",
 			Usage:  "The ip of this server, which will be placed into 'server_ip' attribute if present.",
@@ -57,6 +80,55 @@ func main() {
 			Value:  "localhost:9092",
 			EnvVar: "KAFKA_CONNECTION_STRING",
 		},
+		cli.StringFlag{
+			Name:   "kafka-key",
+			Usage:  "Key used for partitioning: 'hostname' (of this server), 'none' for random partitions, a field name (eg. 'container_id') or a template such as '{service}-{pod_name}'",
+			Value:  "hostname",
+			EnvVar: "KAFKA_KEY",
+		},
+		cli.StringFlag{
+			Name:   "kafka-version",
+			Usage:  "Kafka protocol version of the brokers, eg. '0.11.0.0'. Defaults to the oldest supported version or 0.11.0.0 when headers are enabled.",
+			EnvVar: "KAFKA_VERSION",
+		},
+		cli.BoolFlag{
+			Name:   "kafka-headers",
+			Usage:  "Attach source, relay_host, service, level, logs2kafka_build and received_ts record headers to each message. Requires Kafka 0.11 or newer.",
+			EnvVar: "KAFKA_HEADERS",
+		},
+		cli.StringFlag{
+			Name:   "kafka-encoding",
+			Usage:  "Encoding of the Kafka message values: json, avro, protobuf or msgpack",
+			Value:  "json",
+			EnvVar: "KAFKA_ENCODING",
+		},
+		cli.StringFlag{
+			Name:   "kafka-topic-encoding",
+			Usage:  "Comma delimited list of topic=encoding pairs which override kafka-encoding for specific topics, eg. 'service.foo=avro'",
+			EnvVar: "KAFKA_TOPIC_ENCODING",
+		},
+		cli.IntFlag{
+			Name:   "kafka-retries",
+			Usage:  "Number of times a message which failed with a retriable error (eg. leader election or network error) is produced again before it's written to the dead-letter log",
+			Value:  3,
+			EnvVar: "KAFKA_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "kafka-retry-backoff",
+			Usage:  "Delay before the first retry, doubled for each following retry",
+			Value:  time.Second,
+			EnvVar: "KAFKA_RETRY_BACKOFF",
+		},
+		cli.StringFlag{
+			Name:   "dead-letter-path",
+			Usage:  "Directory where the messages which couldn't be produced are written as <topic>.dead-letter.log. Defaults to the file-logs-path.",
+			EnvVar: "DEAD_LETTER_PATH",
+		},
+		cli.StringFlag{
+			Name:   "schema-registry-url",
+			Usage:  "Url of the schema registry, required by the avro encoding.",
+			EnvVar: "SCHEMA_REGISTRY_URL",
+		},
 		cli.IntFlag{
 			Name:   "syslog-port",
 			Usage:  "Port where to listen syslog messages in UDP",
@@ -68,7 +140,186 @@ func main() {
 			Usage:  "Port where to listen graylog messages in UDP",
 			Value:  5044,
 			EnvVar: "GRAYLOG_LISTEN_PORT",
+		},
+		cli.StringFlag{
+			Name:   "syslog-bind",
+			Usage:  "Address where to listen syslog messages, eg. '127.0.0.1' or '::1'. Defaults to all interfaces.",
+			EnvVar: "SYSLOG_BIND_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "graylog-bind",
+			Usage:  "Address where to listen graylog messages, eg. '127.0.0.1' or '::1'. Defaults to all interfaces.",
+			EnvVar: "GRAYLOG_BIND_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "syslog-socket",
+			Usage:  "Unix datagram socket where to listen syslog messages of local programs, eg. '/dev/log'",
+			EnvVar: "SYSLOG_SOCKET",
+		},
+		cli.IntFlag{
+			Name:   "syslog-tls-port",
+			Usage:  "Port where to listen syslog messages over TLS (RFC 5425, usually 6514). 0 to disable.",
+			EnvVar: "SYSLOG_TLS_PORT",
+		},
+		cli.StringFlag{
+			Name:   "syslog-tls-cert",
+			Usage:  "PEM certificate of the syslog TLS listener",
+			EnvVar: "SYSLOG_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "syslog-tls-key",
+			Usage:  "PEM private key of the syslog TLS listener",
+			EnvVar: "SYSLOG_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "syslog-tls-ca",
+			Usage:  "PEM bundle of the CAs which sign the client certificates",
+			EnvVar: "SYSLOG_TLS_CA",
+		},
+		cli.StringFlag{
+			Name:   "syslog-tls-client-auth",
+			Usage:  "Client certificates of the syslog TLS listener: 'none', 'optional' (verified if given) or 'required'",
+			Value:  ClientAuthNone,
+			EnvVar: "SYSLOG_TLS_CLIENT_AUTH",
+		},
+		cli.StringFlag{
+			Name:   "syslog-tls-identity-field",
+			Usage:  "Field where the common name (or the first subject alternative name) of a verified client certificate is stored. Empty to leave out.",
+			Value:  "tls_client",
+			EnvVar: "SYSLOG_TLS_IDENTITY_FIELD",
+		},
+		cli.DurationFlag{
+			Name:   "syslog-tls-idle-timeout",
+			Usage:  "Syslog TLS connections which don't send anything for this long are closed",
+			Value:  DefaultTLSIdleTimeout,
+			EnvVar: "SYSLOG_TLS_IDLE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "syslog-tls-max-connections",
+			Usage:  "Maximum number of open syslog TLS connections, further connections are closed right away",
+			Value:  DefaultMaxTLSConnections,
+			EnvVar: "SYSLOG_TLS_MAX_CONNECTIONS",
+		},
+		cli.IntFlag{
+			Name:   "syslog-readers",
+			Usage:  "Number of goroutines reading the syslog port. With more than one each reader has its own SO_REUSEPORT socket.",
+			Value:  1,
+			EnvVar: "SYSLOG_READERS",
+		},
+		cli.IntFlag{
+			Name:   "graylog-readers",
+			Usage:  "Number of goroutines reading the graylog port. With more than one each reader has its own SO_REUSEPORT socket.",
+			Value:  1,
+			EnvVar: "GRAYLOG_READERS",
+		},
+		cli.StringFlag{
+			Name:   "syslog-allow",
+			Usage:  "Comma delimited list of networks (eg. '10.0.0.0/8,127.0.0.1') which are allowed to send syslog messages. Defaults to all.",
+			EnvVar: "SYSLOG_ALLOW",
+		},
+		cli.StringFlag{
+			Name:   "syslog-deny",
+			Usage:  "Comma delimited list of networks which are not allowed to send syslog messages. Checked before syslog-allow.",
+			EnvVar: "SYSLOG_DENY",
+		},
+		cli.StringFlag{
+			Name:   "graylog-allow",
+			Usage:  "Comma delimited list of networks which are allowed to send graylog messages. Defaults to all.",
+			EnvVar: "GRAYLOG_ALLOW",
+		},
+		cli.StringFlag{
+			Name:   "graylog-deny",
+			Usage:  "Comma delimited list of networks which are not allowed to send graylog messages. Checked before graylog-allow.",
+			EnvVar: "GRAYLOG_DENY",
+		},
+		cli.IntFlag{
+			Name:   "graylog-max-pending-bytes",
+			Usage:  "Maximum total size of the chunks of incomplete chunked graylog messages. Messages which would go over the limit are dropped.",
+			Value:  DefaultMaxPendingChunkBytes,
+			EnvVar: "GRAYLOG_MAX_PENDING_BYTES",
+		},
+		cli.IntFlag{
+			Name:   "graylog-max-pending-messages",
+			Usage:  "Maximum number of incomplete chunked graylog messages. Chunks of new messages are dropped over the limit.",
+			Value:  DefaultMaxPendingChunkMessages,
+			EnvVar: "GRAYLOG_MAX_PENDING_MESSAGES",
+		},
+		cli.StringFlag{
+			Name:   "source-ip-field",
+			Usage:  "Field where to store the ip address of the sender, eg. source_ip. Replaces the field if the message has it. Empty to leave out.",
+			EnvVar: "SOURCE_IP_FIELD",
+		},
+		cli.StringFlag{
+			Name:   "source-port-field",
+			Usage:  "Field where to store the port of the sender, eg. source_port. Replaces the field if the message has it. Empty to leave out.",
+			EnvVar: "SOURCE_PORT_FIELD",
 		},		
+		cli.StringSliceFlag{
+			Name:  "output",
+			Usage: "Output where to send the messages, can be repeated. Format is type?option=value&option=value where type is kafka, file, stdout or http. Each output can have 'name', 'filter' (eg. 'level==ERROR,service!=foo') and 'queue' options. Kafka accepts 'brokers' and 'encoding', file accepts 'path' and http requires 'url'. Defaults to file and kafka.",
+			EnvVar: "LOGS2KAFKA_OUTPUTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "file-input",
+			Usage:  "Glob pattern of Docker json-file or CRI container log files to tail, eg. '/var/log/containers/*.log'. Can be repeated.",
+			EnvVar: "LOGS2KAFKA_FILE_INPUTS",
+		},
+		cli.StringFlag{
+			Name:   "file-input-state",
+			Usage:  "File where the read offsets of the file inputs are stored. Defaults to logs2kafka-file-input.state in the file-logs-path.",
+			EnvVar: "LOGS2KAFKA_FILE_INPUT_STATE",
+		},
+		cli.BoolFlag{
+			Name:   "file-input-from-beginning",
+			Usage:  "Read files which exist when logs2kafka is started for the first time from the beginning instead of only following new lines",
+			EnvVar: "LOGS2KAFKA_FILE_INPUT_FROM_BEGINNING",
+		},
+		cli.StringFlag{
+			Name:   "docker-socket",
+			Usage:  "Docker Engine API socket used to add container labels to messages which have a container_id, eg. /var/run/docker.sock. Disabled by default.",
+			EnvVar: "DOCKER_SOCKET",
+		},
+		cli.StringSliceFlag{
+			Name:   "docker-label",
+			Usage:  "Container label to add to the messages as '_<label>', or 'label=field' to use another field name. Can be repeated. Defaults to the Kubernetes namespace, pod name and container name labels.",
+			EnvVar: "DOCKER_LABELS",
+		},
+		cli.StringSliceFlag{
+			Name:   "docker-env",
+			Usage:  "Container environment variable to add to the messages as '_<name>', or 'name=field' to use another field name. Can be repeated.",
+			EnvVar: "DOCKER_ENV",
+		},
+		cli.DurationFlag{
+			Name:   "docker-cache-ttl",
+			Usage:  "How long the container lookups are cached",
+			Value:  5 * time.Minute,
+			EnvVar: "DOCKER_CACHE_TTL",
+		},
+		cli.StringFlag{
+			Name:   "sample-level-rates",
+			Usage:  "Comma delimited list of level=rate pairs, eg. 'DEBUG=0.1', to forward only a part of the messages of those levels",
+			EnvVar: "SAMPLE_LEVEL_RATES",
+		},
+		cli.StringFlag{
+			Name:   "sample-service-rates",
+			Usage:  "Comma delimited list of service=rate pairs to forward only a part of the messages of those services. Multiplied with the level rate.",
+			EnvVar: "SAMPLE_SERVICE_RATES",
+		},
+		cli.StringFlag{
+			Name:   "sample-key",
+			Usage:  "Field used for deterministic sampling, eg. 'request_id', so that all messages with the same value are kept or dropped together",
+			EnvVar: "SAMPLE_KEY",
+		},
+		cli.IntFlag{
+			Name:   "max-message-size",
+			Usage:  "Maximum size of a message as JSON in bytes, eg. the max.message.bytes of the brokers. Larger messages are truncated and marked with 'truncated' and 'original_size'. Disabled by default.",
+			EnvVar: "MAX_MESSAGE_SIZE",
+		},
+		cli.DurationFlag{
+			Name:   "dedup-window",
+			Usage:  "Collapse repeated messages with the same service, level and msg (ignoring numbers) within this window, eg. '10s'. The repeats are replaced by a summary message with a repeat_count. Disabled by default.",
+			EnvVar: "DEDUP_WINDOW",
+		},
 		cli.StringFlag{
 			Name:   "statsd-host",
 			Usage:  "Host where to send statsd metrics.",
@@ -81,6 +332,23 @@ func main() {
 			Value:  8125,
 			EnvVar: "STATSD_HOST",
 		},
+		cli.StringFlag{
+			Name:   "statsd-dialect",
+			Usage:  "How the metric tags are sent: 'influxdb' (name,tag=value), 'dogstatsd' (|#tag:value) or 'graphite' (name.tag.value)",
+			Value:  "influxdb",
+			EnvVar: "STATSD_DIALECT",
+		},
+		cli.DurationFlag{
+			Name:   "stats-interval",
+			Usage:  "How often the internal metrics of the relay (packets received, parse errors, queue depths, produce outcomes) are sent to statsd.",
+			Value:  DefaultStatsInterval,
+			EnvVar: "STATS_INTERVAL",
+		},
+		cli.StringSliceFlag{
+			Name:   "metric-rule",
+			Usage:  "Rule which turns matching messages into a statsd metric, can be repeated. Format is name=<metric>&type=counter|gauge|timing|histogram&field=<numeric field>&service=<service>&filter=<conditions>&tags=<fields>, eg. 'name=api.latency&type=timing&field=duration_ms&service=api&tags=status'. The environment variable is comma delimited, so the rules can't contain commas there.",
+			EnvVar: "METRIC_RULES",
+		},
 		cli.StringFlag{
 			Name:   "file-logs-path",
 			Usage:  "Directory where to store local copies of the log files.",
@@ -175,26 +443,291 @@ func main() {
 						continue
 					}
 
-					msg := JSONToMessage(line.Text)
+					fmt.Println(FormatLocalLogLine(line.Text, c.Bool("raw")))
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "search",
+			Usage:     "Search the local copies of a service's log files in the file-logs-path, including the rotated and gzipped files, and print the matching messages in chronological order.",
+			ArgsUsage: "service_name",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Show only messages which have 'ts' at or after this ISO8601 time, eg. 2017-05-19T06:00:00Z",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Show only messages which have 'ts' before this ISO8601 time",
+				},
+				cli.StringFlag{
+					Name:  "level",
+					Usage: "Comma delimited list of levels to show, eg. 'WARN,ERROR'",
+				},
+				cli.StringSliceFlag{
+					Name:  "field",
+					Usage: "Show only messages where field has the given value, eg. 'container_id=e3088a0601ea'. Can be repeated.",
+				},
+				cli.StringFlag{
+					Name:  "regexp",
+					Usage: "Show only messages where 'msg' matches the regular expression",
+				},
+				cli.BoolFlag{
+					Name:  "raw",
+					Usage: "Display raw JSON",
+				},
+				cli.BoolFlag{
+					Name:  "dead-letter",
+					Usage: "Search the dead-letter log of the service instead of the local copies",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) == 0 {
+					cli.ShowSubcommandHelp(c)
+					return cli.NewExitError("Please provide service name as first parameter", 1)
+				}
+
+				service := c.Args()[0]
 
-					if c.Bool("raw") {
-						fmt.Printf("%s\n", msg.Data)
-					} else {
-						ts, err1 := msg.GetString("ts")
-						level, err2 := msg.GetString("level")
-						if err2 != nil {
-							level = "UNKNOWN"
-						}
-						msg, err3 := msg.GetString("msg")
-						msg = strings.TrimRight(msg, "\n")
+				timeRange, err := ParseTimeRange(c.String("from"), c.String("to"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
 
-						if err1 != nil || err3 != nil {
-							fmt.Printf("Raw message: %s\n", line.Text)
-						} else {
-							fmt.Printf("%s %s %s\n", ts, level, msg)
-						}
+				query, err := NewSearchQuery(timeRange, c.String("level"), c.StringSlice("field"), c.String("regexp"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+
+				dir := c.GlobalString("file-logs-path")
+				var files []string
+				if c.Bool("dead-letter") {
+					dir, files, err = DeadLetterLogFiles(c.GlobalString("dead-letter-path"), dir, service)
+				} else {
+					files, err = LocalLogFiles(dir, service)
+				}
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Error finding log files: %+v", err), 1)
+				}
+				if len(files) == 0 {
+					return cli.NewExitError(fmt.Sprintf("Could not find any log files for service %s in %s", service, dir), 1)
+				}
+
+				if c.GlobalBool("debug") {
+					for _, f := range files {
+						fmt.Fprintf(cli.ErrWriter, "Searching %s\n", f)
 					}
 				}
+
+				raw := c.Bool("raw")
+				query.Search(files, func(line string) {
+					fmt.Println(FormatLocalLogLine(line, raw))
+				}, func(filename string, err error) {
+					fmt.Fprintf(cli.ErrWriter, "Error reading %s: %+v\n", filename, err)
+				})
+
+				return nil
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "Re-produce messages from the local copies of a service's log files (including rotated and gzipped files) in the file-logs-path into Kafka, eg. to backfill Kafka after an outage.",
+			ArgsUsage: "service_name",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Replay only messages which have 'ts' at or after this ISO8601 time, eg. 2017-05-19T06:00:00Z",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Replay only messages which have 'ts' before this ISO8601 time",
+				},
+				cli.IntFlag{
+					Name:  "rate",
+					Usage: "Maximum number of messages to produce per second, 0 for no limit",
+					Value: 1000,
+				},
+				cli.StringFlag{
+					Name:  "marker",
+					Usage: "Mark replayed messages with a field: 'field' sets field to true and 'field=value' to the value, eg. 'replayed=outage-2017-05-19'",
+				},
+				cli.BoolFlag{
+					Name:  "dead-letter",
+					Usage: "Replay the messages which couldn't be produced from the dead-letter log of the service instead of the local copies",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.Args()) == 0 {
+					cli.ShowSubcommandHelp(c)
+					return cli.NewExitError("Please provide service name as first parameter", 1)
+				}
+
+				service := c.Args()[0]
+
+				timeRange, err := ParseTimeRange(c.String("from"), c.String("to"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+
+				err = ValidateReplayRate(c.Int("rate"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+
+				dir := c.GlobalString("file-logs-path")
+				var files []string
+				if c.Bool("dead-letter") {
+					dir, files, err = DeadLetterLogFiles(c.GlobalString("dead-letter-path"), dir, service)
+				} else {
+					files, err = LocalLogFiles(dir, service)
+				}
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Error finding log files: %+v", err), 1)
+				}
+				if len(files) == 0 {
+					return cli.NewExitError(fmt.Sprintf("Could not find any log files for service %s in %s", service, dir), 1)
+				}
+
+				hostname, err := os.Hostname()
+				if err != nil {
+					panic(err)
+				}
+
+				brokers := strings.Split(c.GlobalString("kafka-connection-string"), ",")
+				kafka, err := NewKafkaProducerFromContext(c, brokers, hostname, url.Values{})
+				if err != nil {
+					return cli.NewExitError(err.Error(), 2)
+				}
+
+				replayer := Replayer{}
+				replayer.Output = kafka
+				replayer.Range = timeRange
+				replayer.Rate = c.Int("rate")
+				replayer.MarkerField, replayer.MarkerValue = ParseMarker(c.String("marker"))
+
+				for _, f := range files {
+					fmt.Fprintf(cli.ErrWriter, "Replaying %s\n", f)
+				}
+
+				err = replayer.Replay(files)
+				kafka.Close()
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Error replaying messages: %+v", err), 2)
+				}
+
+				fmt.Fprintf(cli.ErrWriter, "Replayed %d messages, skipped %d outside of the time range and %d invalid lines\n", replayer.Replayed, replayer.Skipped, replayer.Invalid)
+				return nil
+			},
+		},
+		{
+			Name:  "bench",
+			Usage: "Send generated syslog and GELF traffic to a running logs2kafka at a target rate and report the throughput, loss and latency of the forwarded messages. Run the daemon with --disable-kafka so that the messages are written to the local files, or with an http output to the --listen address of the bench.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "syslog-addr",
+					Usage: "Address of the syslog input",
+					Value: "127.0.0.1:8601",
+				},
+				cli.StringFlag{
+					Name:  "graylog-addr",
+					Usage: "Address of the graylog input",
+					Value: "127.0.0.1:5044",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Comma delimited list of formats which are sent in turns: " + strings.Join(BenchFormats, ", ") + " or all",
+					Value: "all",
+				},
+				cli.IntFlag{
+					Name:  "rate",
+					Usage: "Messages to send per second",
+					Value: 1000,
+				},
+				cli.DurationFlag{
+					Name:  "duration",
+					Usage: "How long to send messages",
+					Value: 10 * time.Second,
+				},
+				cli.IntFlag{
+					Name:  "size",
+					Usage: "Size of the msg field of each message in bytes",
+					Value: 200,
+				},
+				cli.IntFlag{
+					Name:  "services",
+					Usage: "Number of services (bench-0, bench-1, ...) the messages are spread over",
+					Value: 1,
+				},
+				cli.IntFlag{
+					Name:  "chunk-size",
+					Usage: "Maximum size of GELF chunks in bytes",
+					Value: DefaultBenchChunkSize,
+				},
+				cli.StringFlag{
+					Name:  "receive",
+					Usage: "How the forwarded messages are received: 'files' follows the local log files in the file-logs-path, 'http' listens for an http output and 'none' only sends",
+					Value: "files",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "Address where to receive the messages of an http output, eg. --output 'http?url=http://localhost:8090/'",
+					Value: ":8090",
+				},
+				cli.DurationFlag{
+					Name:  "wait",
+					Usage: "How long to wait for the last forwarded messages after sending",
+					Value: 5 * time.Second,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				formats, err := ParseBenchFormats(c.String("format"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+
+				bench := &Bench{
+					SyslogAddr:  c.String("syslog-addr"),
+					GraylogAddr: c.String("graylog-addr"),
+					Formats:     formats,
+					Rate:        c.Int("rate"),
+					Duration:    c.Duration("duration"),
+					Size:        c.Int("size"),
+					Services:    c.Int("services"),
+					ChunkSize:   c.Int("chunk-size"),
+				}
+
+				err = bench.Init()
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+
+				wait := c.Duration("wait")
+				switch c.String("receive") {
+				case "files":
+					receiver := &BenchFileReceiver{Dir: c.GlobalString("file-logs-path"), Prefix: c.GlobalString("topic-prefix"), Bench: bench}
+					receiver.Start(bench.Services)
+					defer receiver.Close()
+				case "http":
+					listener, err := net.Listen("tcp", c.String("listen"))
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Could not listen %s: %+v", c.String("listen"), err), 1)
+					}
+					defer listener.Close()
+					go http.Serve(listener, bench)
+				case "none":
+					wait = 0
+				default:
+					return cli.NewExitError("Unknown receive mode "+c.String("receive"), 1)
+				}
+
+				report, err := bench.Run(wait)
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+
+				fmt.Fprintf(cli.ErrWriter, "Run %s\n", bench.RunID)
+				report.Print(os.Stdout)
 				return nil
 			},
 		},
@@ -204,10 +737,6 @@ func main() {
 			Action: func(c *cli.Context) error {
 				fmt.Printf("Default action")
 
-				kafka := KafkaProducer{}
-
-				loggers := make(map[string]*lumberjack.Logger)
-
 				default_topic := c.GlobalString("default-topic")
 				topic_prefix := c.GlobalString("topic-prefix")
 				brokers := strings.Split(c.GlobalString("kafka-connection-string"), ",")
@@ -222,10 +751,24 @@ func main() {
 				fmt.Fprintf(os.Stderr, "default-topic: %s\n", default_topic)
 				fmt.Fprintf(os.Stderr, "topic_prefix: %s\n", topic_prefix)
 				fmt.Fprintf(os.Stderr, "brokers: %+v\n", brokers)
+				fmt.Fprintf(os.Stderr, "kafka key: %s\n", c.GlobalString("kafka-key"))
 				fmt.Fprintf(os.Stderr, "syslog listen port: %d\n", syslog_port)
 				fmt.Fprintf(os.Stderr, "graylog listen port: %d\n", graylog_port)
+				if c.GlobalString("syslog-bind") != "" {
+					fmt.Fprintf(os.Stderr, "syslog bind address: %s\n", c.GlobalString("syslog-bind"))
+				}
+				if c.GlobalString("graylog-bind") != "" {
+					fmt.Fprintf(os.Stderr, "graylog bind address: %s\n", c.GlobalString("graylog-bind"))
+				}
+				if c.GlobalInt("syslog-tls-port") != 0 {
+					fmt.Fprintf(os.Stderr, "syslog TLS port: %d (client certificates: %s)\n", c.GlobalInt("syslog-tls-port"), c.GlobalString("syslog-tls-client-auth"))
+				}
+				if c.GlobalString("syslog-socket") != "" {
+					fmt.Fprintf(os.Stderr, "syslog socket: %s\n", c.GlobalString("syslog-socket"))
+				}
 				fmt.Fprintf(os.Stderr, "statsd host: %s\n", statsd_host)
 				fmt.Fprintf(os.Stderr, "statsd port: %d\n", statsd_port)
+				fmt.Fprintf(os.Stderr, "statsd dialect: %s\n", c.GlobalString("statsd-dialect"))
 				fmt.Fprintf(os.Stderr, "server ip: %s\n", server_ip)
 				fmt.Fprintf(os.Stderr, "directory where to log local copies: %s\n", file_logs_path)
 
@@ -234,87 +777,241 @@ func main() {
 					panic(err)
 				}
 
-				if !c.GlobalBool("disable-kafka") {
-					err = kafka.Init(brokers, hostname)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "Error opening kafka connection: %+v\n", err)
-					}
-				}
-
-				statsd, err := statsd.NewClient(fmt.Sprintf("%s:%d", statsd_host, statsd_port), "")
+				client, err := statsd.NewClient(fmt.Sprintf("%s:%d", statsd_host, statsd_port), "")
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error opening statsd connection: %+v\n", err)
 				}
+				statsd, err := NewDialectStatsd(client, c.GlobalString("statsd-dialect"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
 				statsd.Inc("logs2kafka.app.started", 1, 1)
 
-				messages := make(chan Message)
+				stats := NewStats()
+				stats.Start(statsd, c.GlobalDuration("stats-interval"))
 
-				syslog := Syslog{}
-				syslog.Messages = messages
-				syslog.Init(int(syslog_port))
+				topics, err := NewTopicSanitiser(c.GlobalString("topic-replacement"), c.GlobalString("topic-collisions"), c.GlobalInt("topic-max-length"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				topics.Stats = stats
+				if err := ValidateTopic(topic_prefix + "." + default_topic); err != nil {
+					return cli.NewExitError(fmt.Sprintf("Invalid default-topic or topic-prefix: %+v", err), 1)
+				}
 
-				graylog := Graylog{}
-				graylog.Messages = messages
-				graylog.Init(int(graylog_port))
+				outputSpecs := c.GlobalStringSlice("output")
+				if len(outputSpecs) == 0 {
+					outputSpecs = []string{"file", "kafka"}
+				}
 
-				serverInfo := ServerInfo{}
-				serverInfo.ServerIP = server_ip
-				serverInfo.Hostname = hostname
+				outputDefaults := OutputDefaults{
+					FileLogsPath: file_logs_path,
+					Brokers:      brokers,
+					Debug:        c.GlobalBool("debug"),
+					Stats:        stats,
+					NewKafkaProducer: func(brokers []string, options url.Values) (*KafkaProducer, error) {
+						return NewKafkaProducerFromContext(c, brokers, hostname, options)
+					},
+				}
 
-				go func(c chan Message) {
-					m := JSONToMessage("{}")
-					m.ParseJSON()
-					m.Container.Set(fmt.Sprintf("logs2kafka starting at %s\n", time.Now().UTC().Format(time.RFC3339Nano)), "msg")
-					m.Container.Set("logs2kafka", "service")
-					m.Container.Set("INFO", "level")
-					c <- m
-				}(syslog.Messages)
-
-				for message := range syslog.Messages {
-					if c.GlobalBool("debug") {
-						fmt.Printf("Got message: %+v\n", message)
+				sinks := []*Sink{}
+				for _, outputSpec := range outputSpecs {
+					spec, err := ParseSinkSpec(outputSpec)
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Invalid output '%s': %+v", outputSpec, err), 1)
 					}
-					EnsureMessageFormat(serverInfo, &message)
-					SendStatsdMetricsFromMessage(statsd, &message)
 
-					if message.Topic == "" {
-						message.Topic = default_topic
+					if spec.Type == "kafka" && c.GlobalBool("disable-kafka") {
+						fmt.Fprintf(os.Stderr, "Kafka is disabled, skipping output %s\n", spec.Name)
+						continue
 					}
-					message.Topic = topic_prefix + "." + message.Topic
 
-					if loggers != nil {
+					output, err := NewOutput(spec, outputDefaults)
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Error creating output %s: %+v", spec.Name, err), 1)
+					}
+					if kafka, ok := output.(*KafkaProducer); ok {
+						kafka.Statsd = statsd
+						kafka.Stats = stats
+					}
 
-						filename := file_logs_path + "/" + message.Topic + ".log"
-						if c.GlobalBool("debug") {
-							fmt.Printf("Going to write message to file %s\n", filename)
-						}
+					sink := NewSink(spec.Name, output, spec.Filter, spec.QueueSize)
+					sink.Statsd = statsd
+					sinks = append(sinks, sink)
+					fmt.Fprintf(os.Stderr, "output: %s\n", outputSpec)
+				}
 
-						var logger *lumberjack.Logger = nil
+				syslogACL, err := ParseACL(c.GlobalString("syslog-allow"), c.GlobalString("syslog-deny"))
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Invalid syslog-allow or syslog-deny: %+v", err), 1)
+				}
+				graylogACL, err := ParseACL(c.GlobalString("graylog-allow"), c.GlobalString("graylog-deny"))
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Invalid graylog-allow or graylog-deny: %+v", err), 1)
+				}
+				sourceFields := SourceFields{
+					IP:   c.GlobalString("source-ip-field"),
+					Port: c.GlobalString("source-port-field"),
+				}
 
-						logger, ok := loggers[message.Topic]
-						if !ok {
-							if c.GlobalBool("debug") {
-								fmt.Printf("Creating new logger for topic %s\n", message.Topic)
-							}
+				inputs := []Input{}
+				identityField := ""
 
-							logger = &lumberjack.Logger{
-								Filename:   filename,
-								MaxSize:    100, // megabytes
-								MaxBackups: 3,
-							}
+				syslog := &Syslog{}
+				syslog.Port = syslog_port
+				syslog.Statsd = statsd
+				syslog.Stats = stats
+				syslog.ACL = syslogACL
+				syslog.SourceFields = sourceFields
+				syslog.Readers = c.GlobalInt("syslog-readers")
+				syslog.BindAddress = c.GlobalString("syslog-bind")
+				syslog.SocketPath = c.GlobalString("syslog-socket")
+				inputs = append(inputs, syslog)
+
+				if tlsPort := c.GlobalInt("syslog-tls-port"); tlsPort != 0 {
+					syslogTLS := &SyslogTLS{}
+					syslogTLS.Port = tlsPort
+					syslogTLS.BindAddress = c.GlobalString("syslog-bind")
+					syslogTLS.CertFile = c.GlobalString("syslog-tls-cert")
+					syslogTLS.KeyFile = c.GlobalString("syslog-tls-key")
+					syslogTLS.CAFile = c.GlobalString("syslog-tls-ca")
+					syslogTLS.ClientAuth = c.GlobalString("syslog-tls-client-auth")
+					syslogTLS.IdentityField = c.GlobalString("syslog-tls-identity-field")
+					identityField = syslogTLS.IdentityField
+					syslogTLS.IdleTimeout = c.GlobalDuration("syslog-tls-idle-timeout")
+					syslogTLS.MaxConnections = c.GlobalInt("syslog-tls-max-connections")
+					syslogTLS.Statsd = statsd
+					syslogTLS.Stats = stats
+					syslogTLS.ACL = syslogACL
+					syslogTLS.SourceFields = sourceFields
+					inputs = append(inputs, syslogTLS)
+				}
 
-							loggers[message.Topic] = logger
+				graylog := &Graylog{}
+				graylog.Port = graylog_port
+				graylog.Statsd = statsd
+				graylog.Stats = stats
+				graylog.MaxPendingBytes = c.GlobalInt("graylog-max-pending-bytes")
+				graylog.MaxPendingMessages = c.GlobalInt("graylog-max-pending-messages")
+				graylog.ACL = graylogACL
+				graylog.SourceFields = sourceFields
+				graylog.Readers = c.GlobalInt("graylog-readers")
+				graylog.BindAddress = c.GlobalString("graylog-bind")
+				inputs = append(inputs, graylog)
 
-						}
-						logger.Write([]byte(message.Container.String() + "\n"))
+				if patterns := c.GlobalStringSlice("file-input"); len(patterns) > 0 {
+					fileInput := &FileInput{}
+					fileInput.Patterns = patterns
+					fileInput.StateFile = c.GlobalString("file-input-state")
+					if fileInput.StateFile == "" {
+						fileInput.StateFile = file_logs_path + "/logs2kafka-file-input.state"
 					}
+					fileInput.StartAtEnd = !c.GlobalBool("file-input-from-beginning")
+					fileInput.Stats = stats
+					inputs = append(inputs, fileInput)
+					fmt.Fprintf(os.Stderr, "file inputs: %+v\n", patterns)
+				}
 
-					if !c.GlobalBool("disable-kafka") {
-						kafka.Produce(message)
+				var docker *DockerEnricher
+				if socket := c.GlobalString("docker-socket"); socket != "" {
+					docker = NewDockerEnricher(socket)
+					if labels := c.GlobalStringSlice("docker-label"); len(labels) > 0 {
+						docker.Labels = labels
 					}
+					docker.Env = c.GlobalStringSlice("docker-env")
+					docker.CacheTTL = c.GlobalDuration("docker-cache-ttl")
+					docker.Statsd = statsd
+					fmt.Fprintf(os.Stderr, "docker socket: %s\n", socket)
+				}
 
+				serverInfo := ServerInfo{}
+				serverInfo.ServerIP = server_ip
+				serverInfo.Hostname = hostname
+
+				metricRules := []*MetricRule{}
+				for _, spec := range c.GlobalStringSlice("metric-rule") {
+					rule, err := ParseMetricRule(spec)
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Invalid metric rule '%s': %+v", spec, err), 1)
+					}
+					metricRules = append(metricRules, rule)
+					fmt.Fprintf(os.Stderr, "metric rule: %s\n", spec)
+				}
+
+				var sampler *Sampler
+				if c.GlobalString("sample-level-rates") != "" || c.GlobalString("sample-service-rates") != "" {
+					levelRates, err := ParseSampleRates(c.GlobalString("sample-level-rates"))
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Invalid sample-level-rates: %+v", err), 1)
+					}
+					serviceRates, err := ParseSampleRates(c.GlobalString("sample-service-rates"))
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Invalid sample-service-rates: %+v", err), 1)
+					}
+					sampler = NewSampler(levelRates, serviceRates, c.GlobalString("sample-key"))
+					sampler.Statsd = statsd
+					fmt.Fprintf(os.Stderr, "sampling: levels %+v services %+v\n", levelRates, serviceRates)
+				}
+
+				var dedup *Deduplicator
+				if window := c.GlobalDuration("dedup-window"); window > 0 {
+					dedup = NewDeduplicator(window)
+					dedup.Statsd = statsd
+					fmt.Fprintf(os.Stderr, "dedup window: %s\n", window)
+				}
+
+				truncator := &Truncator{MaxSize: c.GlobalInt("max-message-size"), Statsd: statsd}
+
+				pipeline := &Pipeline{
+					Inputs:        inputs,
+					Docker:        docker,
+					ServerInfo:    serverInfo,
+					MetricRules:   metricRules,
+					DefaultTopic:  default_topic,
+					TopicPrefix:   topic_prefix,
+					Topics:        topics,
+					Sampler:       sampler,
+					Dedup:         dedup,
+					Truncator:     truncator,
+					Outputs:       sinks,
+					Statsd:        statsd,
+					Stats:         stats,
+					Debug:         c.GlobalBool("debug"),
+					IdentityField: identityField,
+				}
+				err = pipeline.Start()
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Error starting inputs: %+v", err), 1)
+				}
+
+				// Packets dropped by the kernel when the readers can't keep up
+				for input, port := range map[string]int{"syslog": syslog.listener.Port(), "gelf": graylog.listener.Port()} {
+					port := port
+					if _, err := UDPDrops(port); err != nil {
+						continue
+					}
+					stats.GaugeFunc("logs2kafka.udp.drops,input="+input, func() int64 {
+						drops, _ := UDPDrops(port)
+						return drops
+					})
 				}
 
+				go func() {
+					m := JSONToMessage("{}")
+					m.SetField("msg", fmt.Sprintf("logs2kafka starting at %s\n", time.Now().UTC().Format(time.RFC3339Nano)))
+					m.SetField("service", "logs2kafka")
+					m.SetField("level", "INFO")
+					m.Source = "internal"
+					m.ReceivedAt = time.Now()
+					pipeline.Send(m)
+				}()
+
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+				sig := <-signals
+				fmt.Fprintf(os.Stderr, "Got %s, stopping\n", sig)
+				pipeline.Stop()
+				stats.Stop()
 				return nil
 			},
 		},
@@ -322,3 +1019,58 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// NewKafkaProducerFromContext creates and connects a KafkaProducer configured
+// with the global kafka options. The options can override the encoding.
+func NewKafkaProducerFromContext(c *cli.Context, brokers []string, hostname string, options url.Values) (*KafkaProducer, error) {
+	var err error
+	kafka := &KafkaProducer{}
+
+	kafka_key := c.GlobalString("kafka-key")
+	if kafka_key != "hostname" {
+		kafka.KeyTemplate, err = ParseKeyTemplate(kafka_key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid kafka-key: %+v", err)
+		}
+	}
+
+	if c.GlobalString("kafka-version") != "" {
+		kafka.Version, err = sarama.ParseKafkaVersion(c.GlobalString("kafka-version"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid kafka-version: %+v", err)
+		}
+	}
+	kafka.Headers = c.GlobalBool("kafka-headers")
+
+	encoding := c.GlobalString("kafka-encoding")
+	if e := options.Get("encoding"); e != "" {
+		encoding = e
+	}
+	kafka.Encoder, err = NewValueEncoder(encoding, c.GlobalString("schema-registry-url"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid kafka-encoding: %+v", err)
+	}
+	kafka.TopicEncoders, err = ParseTopicEncoders(c.GlobalString("kafka-topic-encoding"), c.GlobalString("schema-registry-url"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid kafka-topic-encoding: %+v", err)
+	}
+	kafka.Hostname = hostname
+
+	kafka.MaxRetries = c.GlobalInt("kafka-retries")
+	kafka.RetryBackoff = c.GlobalDuration("kafka-retry-backoff")
+	deadLetterPath := c.GlobalString("dead-letter-path")
+	if p := options.Get("dead-letter-path"); p != "" {
+		deadLetterPath = p
+	}
+	if deadLetterPath == "" {
+		deadLetterPath = c.GlobalString("file-logs-path")
+	}
+	kafka.DeadLetter = NewDeadLetterLog(deadLetterPath)
+
+	err = kafka.Init(brokers, hostname)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening kafka connection: %+v", err)
+	}
+
+	return kafka, nil
+}
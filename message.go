@@ -1,13 +1,9 @@
 package main
 
 import "github.com/Jeffail/gabs"
-import "github.com/buger/jsonparser"
 
-//import "strconv"
 import "time"
 import "strings"
-import "fmt"
-import "bytes"
 
 type ServerInfo struct {
 	Hostname string
@@ -18,6 +14,22 @@ type Message struct {
 	Topic     string
 	Data      []byte
 	Container *gabs.Container
+
+	// Source is the protocol the message was received with, eg. "syslog" or "gelf"
+	Source string
+
+	// ReceivedAt is the time when the relay received the message
+	ReceivedAt time.Time
+
+	// Identity is the verified identity of the sender, eg. the name in the
+	// client certificate of a SyslogTLS connection. Empty if the input
+	// doesn't verify its senders.
+	Identity string
+
+	// Index of the top level fields of Data, see messagefields.go
+	fields   []messageField
+	indexed  bool
+	modified bool
 }
 
 var validLevels = [...]string{
@@ -104,44 +116,27 @@ func JSONToMessage(str string) Message {
 	return m
 }
 
+// ParseJSON decodes the whole message into Container. The edits done so
+// far are included.
 func (m *Message) ParseJSON() error {
 
 	if m.Container != nil {
 		return nil
 	}
 
-	parsedJson, err := gabs.ParseJSON(m.Data)
+	parsedJson, err := gabs.ParseJSON(m.Bytes())
 	if err != nil {
 		return err
 	}
 
 	m.Container = parsedJson
+	m.fields = nil
+	m.indexed = false
+	m.modified = false
 
 	return nil
 }
 
-func (m *Message) GetString(keys ...string) (string, error) {
-
-	v, t, _, e := jsonparser.Get(m.Data, keys...)
-
-	if e != nil {
-		return "", e
-	}
-
-	if t != jsonparser.String {
-		return "", fmt.Errorf("Value is not a number: %s", string(v))
-	}
-
-	// If no escapes return raw conten
-	if bytes.IndexByte(v, '\\') == -1 {
-		return string(v), nil
-	}
-
-	m.ParseJSON()
-	value, _ := m.Container.Path(strings.Join(keys, ".")).Data().(string)
-	return value, nil
-}
-
 func EnsureMessageFormat(i ServerInfo, m *Message) error {
 	err := EnsureMessageTimestamp(m)
 	if err != nil {
@@ -168,11 +163,11 @@ func EnsureMessageFormat(i ServerInfo, m *Message) error {
 
 func EnsureMessageTimestamp(m *Message) error {
 
-	_, ok := m.Container.Path("ts").Data().(string)
-	if !ok {
+	_, err := m.GetString("ts")
+	if err != nil {
 		ts := time.Now().UTC().Format(time.RFC3339Nano)
 
-		m.Container.Set(ts, "ts")
+		m.SetField("ts", ts)
 	}
 
 	return nil
@@ -188,21 +183,21 @@ func EnsureMessageTimestamp(m *Message) error {
 //   2) Set m.Topic to the service name
 func EnsureMessageService(m *Message) error {
 
-	service, ok := m.Container.Path("service").Data().(string)
+	service, err := m.GetString("service")
 
-	if ok {
+	if err == nil {
 		m.Topic = service
 		return nil
 	} 
 
-	kubernetes_container_name, ok := m.Container.Search("_io.kubernetes.container.name").Data().(string)
+	kubernetes_container_name, err := m.GetString("_io.kubernetes.container.name")
 
-	if ok {
-		m.Container.Set(kubernetes_container_name, "service")
+	if err == nil {
+		m.SetField("service", kubernetes_container_name)
 		m.Topic = kubernetes_container_name
 	} else {
-		container_name, ok := m.Container.Path("container_name").Data().(string)
-		if ok {
+		container_name, err := m.GetString("container_name")
+		if err == nil {
 
 			match := false
 			for _, prefix := range docker_left_names {
@@ -212,7 +207,7 @@ func EnsureMessageService(m *Message) error {
 				}
 			}
 			if !match {
-				m.Container.Set(container_name, "service")
+				m.SetField("service", container_name)
 				m.Topic = container_name
 			}
 		}
@@ -222,10 +217,10 @@ func EnsureMessageService(m *Message) error {
 
 func EnsureMessageLevel(m *Message) error {
 
-	value, ok := m.Container.Path("level").Data().(string)
-	if ok {
+	value, err := m.GetString("level")
+	if err == nil {
 		if upperCaseValue := strings.ToUpper(value); upperCaseValue != value {
-			m.Container.Set(upperCaseValue, "level")
+			m.SetField("level", upperCaseValue)
 			value = upperCaseValue
 		}
 
@@ -237,12 +232,12 @@ func EnsureMessageLevel(m *Message) error {
 		}
 
 		if value == "WARNING" {
-			m.Container.Set("WARN", "level")
+			m.SetField("level", "WARN")
 			found = true
 		}
 
 		if !found {
-			m.Container.Set("UNKNOWN", "level")
+			m.SetField("level", "UNKNOWN")
 		}
 	}
 	return nil
@@ -250,14 +245,14 @@ func EnsureMessageLevel(m *Message) error {
 
 func EnsureMessageServiceServerInfo(i ServerInfo, m *Message) error {
 	if i.Hostname != "" {
-		_, ok := m.Container.Path("host").Data().(string)
-		if !ok {
-			m.Container.Set(i.Hostname, "host")
+		_, err := m.GetString("host")
+		if err != nil {
+			m.SetField("host", i.Hostname)
 		}
 	}
 
 	if i.ServerIP != "" {
-		m.Container.Set(i.ServerIP, "server_ip")
+		m.SetField("server_ip", i.ServerIP)
 	}
 
 	return nil
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Jeffail/gabs"
+	"github.com/buger/jsonparser"
+)
+
+// Messages are kept as the JSON document they were received as. On the
+// first access the top level fields are indexed without decoding the
+// values: each field is a slice of Data. Reads decode only the value which
+// is asked for, edits (eg. adding "ts" and "service") replace or append
+// fields in the index and Bytes encodes the fields into one buffer. A
+// message which isn't modified is sent as the bytes it was received as.
+//
+// Container is the fully decoded gabs representation. ParseJSON creates it
+// for the code which walks the whole document, such as the Avro encoder and
+// the truncation. Once it exists it is the canonical form of the message
+// and the accessors below use it instead of the index.
+
+type messageField struct {
+	// key is the unescaped key
+	key []byte
+
+	// escape is set if the key has to be escaped when it's encoded
+	escape bool
+
+	// value is the raw JSON value
+	value []byte
+}
+
+var errNotObject = errors.New("Message is not a JSON object")
+
+// ParseFields checks that the message is a valid JSON object and indexes
+// its top level fields. Unlike ParseJSON it doesn't decode the values.
+func (m *Message) ParseFields() error {
+	if m.Container != nil {
+		return nil
+	}
+	return m.indexFields()
+}
+
+func (m *Message) indexFields() error {
+	if m.indexed {
+		return nil
+	}
+
+	if !json.Valid(m.Data) {
+		return fmt.Errorf("Invalid JSON document: %.64q", m.Data)
+	}
+
+	fields, err := scanObjectFields(m.Data, make([]messageField, 0, 16))
+	if err != nil {
+		return err
+	}
+
+	m.fields = fields
+	m.indexed = true
+	return nil
+}
+
+// scanObjectFields appends the top level fields of a valid JSON object.
+func scanObjectFields(data []byte, fields []messageField) ([]messageField, error) {
+	i := skipJSONSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil, errNotObject
+	}
+	i++
+
+	for {
+		i = skipJSONSpace(data, i)
+		if i >= len(data) {
+			return nil, errNotObject
+		}
+		if data[i] == '}' {
+			return fields, nil
+		}
+		if data[i] == ',' {
+			i = skipJSONSpace(data, i+1)
+		}
+
+		if i >= len(data) || data[i] != '"' {
+			return nil, errNotObject
+		}
+		start := i + 1
+		end, escaped := scanJSONString(data, start)
+		if end < 0 {
+			return nil, errNotObject
+		}
+
+		field := messageField{key: data[start:end]}
+		if escaped {
+			key, err := jsonparser.Unescape(field.key, nil)
+			if err != nil {
+				return nil, err
+			}
+			field.key = key
+			field.escape = true
+		}
+
+		i = skipJSONSpace(data, end+1)
+		if i >= len(data) || data[i] != ':' {
+			return nil, errNotObject
+		}
+		i = skipJSONSpace(data, i+1)
+
+		_, _, offset, err := jsonparser.Get(data[i:])
+		if err != nil {
+			return nil, err
+		}
+		field.value = data[i : i+offset]
+		fields = append(fields, field)
+		i += offset
+	}
+}
+
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// scanJSONString returns the index of the closing quote of a string which
+// starts at i, and whether the string has escapes.
+func scanJSONString(data []byte, i int) (int, bool) {
+	escaped := false
+	for ; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			escaped = true
+			i++
+		case '"':
+			return i, escaped
+		}
+	}
+	return -1, escaped
+}
+
+func (m *Message) fieldIndex(name string) int {
+	for i := range m.fields {
+		if string(m.fields[i].key) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// rawField returns the raw value of a top level field, or of a dotted path
+// if there is no field with the literal name. Strings are returned without
+// the quotes, as jsonparser does.
+func (m *Message) rawField(name string) ([]byte, jsonparser.ValueType) {
+	if m.indexFields() != nil {
+		return nil, jsonparser.NotExist
+	}
+
+	if i := m.fieldIndex(name); i >= 0 {
+		value, valueType, _, err := jsonparser.Get(m.fields[i].value)
+		if err != nil {
+			return nil, jsonparser.NotExist
+		}
+		return value, valueType
+	}
+
+	if strings.IndexByte(name, '.') < 0 {
+		return nil, jsonparser.NotExist
+	}
+
+	keys := strings.Split(name, ".")
+	i := m.fieldIndex(keys[0])
+	if i < 0 {
+		return nil, jsonparser.NotExist
+	}
+	value, valueType, _, err := jsonparser.Get(m.fields[i].value, keys[1:]...)
+	if err != nil {
+		return nil, jsonparser.NotExist
+	}
+	return value, valueType
+}
+
+// GetString returns a string field. The keys are literal object keys, eg.
+// GetString("_io.kubernetes.pod.name") or GetString("http", "method").
+func (m *Message) GetString(keys ...string) (string, error) {
+	if len(keys) == 0 {
+		return "", errors.New("No keys given")
+	}
+
+	if m.Container != nil {
+		value, ok := m.Container.Search(keys...).Data().(string)
+		if !ok {
+			return "", fmt.Errorf("Field %s is not a string", strings.Join(keys, "."))
+		}
+		return value, nil
+	}
+
+	if err := m.indexFields(); err != nil {
+		return "", err
+	}
+
+	i := m.fieldIndex(keys[0])
+	if i < 0 {
+		return "", jsonparser.KeyPathNotFoundError
+	}
+
+	v, t, _, err := jsonparser.Get(m.fields[i].value, keys[1:]...)
+	if err != nil {
+		return "", err
+	}
+	if t != jsonparser.String {
+		return "", fmt.Errorf("Value is not a string: %s", string(v))
+	}
+	return decodeJSONString(v)
+}
+
+// decodeJSONString decodes the contents of a string value. Strings without
+// escapes are converted as is.
+func decodeJSONString(v []byte) (string, error) {
+	if bytes.IndexByte(v, '\\') == -1 {
+		return string(v), nil
+	}
+	return jsonparser.ParseString(v)
+}
+
+// FieldString returns a field of a message as a string. The name is first
+// looked up as a literal key (so that docker label style keys such as
+// "_io.kubernetes.pod.name" work) and then as a dotted path. Numbers and
+// booleans are formatted, objects and arrays are not considered to be strings.
+func (m *Message) FieldString(name string) (string, bool) {
+	if m.Container != nil {
+		value := m.Container.Search(name).Data()
+		if value == nil {
+			value = m.Container.Path(name).Data()
+		}
+
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+
+		return "", false
+	}
+
+	value, valueType := m.rawField(name)
+	switch valueType {
+	case jsonparser.String:
+		s, err := decodeJSONString(value)
+		return s, err == nil
+	case jsonparser.Number:
+		f, err := jsonparser.ParseFloat(value)
+		if err != nil {
+			return "", false
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	case jsonparser.Boolean:
+		return string(value), true
+	}
+
+	return "", false
+}
+
+// Float returns a numeric top level field.
+func (m *Message) Float(name string) (float64, bool) {
+	if m.Container != nil {
+		value, ok := m.Container.Search(name).Data().(float64)
+		return value, ok
+	}
+
+	if m.indexFields() != nil {
+		return 0, false
+	}
+	i := m.fieldIndex(name)
+	if i < 0 {
+		return 0, false
+	}
+	value, err := jsonparser.ParseFloat(m.fields[i].value)
+	return value, err == nil
+}
+
+// HasField returns true if the message has a top level field with the name.
+func (m *Message) HasField(name string) bool {
+	if m.Container != nil {
+		return m.Container.Search(name).Data() != nil
+	}
+	return m.indexFields() == nil && m.fieldIndex(name) >= 0
+}
+
+// SetField sets a top level field. Strings, numbers and booleans are
+// encoded directly, other values with encoding/json.
+func (m *Message) SetField(name string, value interface{}) error {
+	if m.Container != nil {
+		_, err := m.Container.Set(value, name)
+		return err
+	}
+
+	var raw []byte
+	switch v := value.(type) {
+	case string:
+		raw = appendJSONString(make([]byte, 0, len(v)+2), v)
+	case float64:
+		raw = appendJSONFloat(nil, v)
+	case int:
+		raw = strconv.AppendInt(nil, int64(v), 10)
+	case bool:
+		raw = strconv.AppendBool(nil, v)
+	default:
+		var err error
+		raw, err = json.Marshal(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.setRaw(name, raw)
+}
+
+func (m *Message) setRaw(name string, raw []byte) error {
+	if err := m.indexFields(); err != nil {
+		return err
+	}
+
+	if i := m.fieldIndex(name); i >= 0 {
+		m.fields[i].value = raw
+	} else {
+		m.fields = append(m.fields, messageField{key: []byte(name), escape: needsJSONEscape(name), value: raw})
+	}
+	m.modified = true
+	return nil
+}
+
+// DeleteField removes a top level field.
+func (m *Message) DeleteField(name string) {
+	if m.Container != nil {
+		m.Container.Delete(name)
+		return
+	}
+
+	if m.indexFields() != nil {
+		return
+	}
+	if i := m.fieldIndex(name); i >= 0 {
+		m.fields = append(m.fields[:i], m.fields[i+1:]...)
+		m.modified = true
+	}
+}
+
+// MergeJSON sets the top level fields of a JSON object into the message.
+func (m *Message) MergeJSON(data []byte) error {
+	if m.Container != nil {
+		parsed, err := gabs.ParseJSON(data)
+		if err != nil {
+			return err
+		}
+		children, err := parsed.ChildrenMap()
+		if err != nil {
+			return err
+		}
+		for key, value := range children {
+			m.Container.Set(value.Data(), key)
+		}
+		return nil
+	}
+
+	other := Message{Data: data}
+	if err := other.indexFields(); err != nil {
+		return err
+	}
+	if err := m.indexFields(); err != nil {
+		return err
+	}
+
+	for _, field := range other.fields {
+		if i := m.fieldIndex(string(field.key)); i >= 0 {
+			m.fields[i].value = field.value
+		} else {
+			m.fields = append(m.fields, field)
+		}
+	}
+	m.modified = true
+	return nil
+}
+
+// Bytes returns the message as a JSON document.
+func (m *Message) Bytes() []byte {
+	if m.Container != nil {
+		return m.Container.Bytes()
+	}
+	if !m.modified {
+		return m.Data
+	}
+
+	size := 2
+	for _, field := range m.fields {
+		size += len(field.key) + len(field.value) + 4
+	}
+
+	buf := make([]byte, 0, size+16)
+	buf = append(buf, '{')
+	for i, field := range m.fields {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if field.escape {
+			buf = appendJSONString(buf, string(field.key))
+		} else {
+			buf = append(buf, '"')
+			buf = append(buf, field.key...)
+			buf = append(buf, '"')
+		}
+		buf = append(buf, ':')
+		buf = append(buf, field.value...)
+	}
+	buf = append(buf, '}')
+
+	// The fields still point to valid values, so the index is kept
+	m.Data = buf
+	m.modified = false
+	return buf
+}
+
+// Line returns the message as a JSON document followed by a newline, as
+// written into the log files. The buffer is not shared with the message.
+func (m *Message) Line() []byte {
+	b := m.Bytes()
+	line := make([]byte, len(b)+1)
+	copy(line, b)
+	line[len(b)] = '\n'
+	return line
+}
+
+// TextToMessage creates a message with the text in the "msg" field.
+func TextToMessage(text string) Message {
+	buf := make([]byte, 0, len(text)+10)
+	buf = append(buf, `{"msg":`...)
+	buf = appendJSONString(buf, text)
+	buf = append(buf, '}')
+	return Message{Data: buf}
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a quoted JSON string. Invalid UTF-8 is
+// replaced with U+FFFD as encoding/json does.
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+func needsJSONEscape(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == '"' || s[i] == '\\' || s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// appendJSONFloat formats a number like encoding/json does.
+func appendJSONFloat(dst []byte, f float64) []byte {
+	abs := f
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		return strconv.AppendFloat(dst, f, 'e', -1, 64)
+	}
+	return strconv.AppendFloat(dst, f, 'f', -1, 64)
+}
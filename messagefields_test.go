@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageFields(t *testing.T) {
+	m := JSONToMessage(`{"msg": "hello \"world\"", "n": 1.5e3, "ok": true, "nested": {"a": {"b": "c"}}, "_io.kubernetes.pod.name": "pod", "kéy": "v"}`)
+	assert.Nil(t, m.ParseFields())
+	assert.Nil(t, m.Container)
+
+	value, ok := m.FieldString("msg")
+	assert.True(t, ok)
+	assert.Equal(t, `hello "world"`, value)
+
+	value, ok = m.FieldString("n")
+	assert.True(t, ok)
+	assert.Equal(t, "1500", value)
+
+	value, ok = m.FieldString("ok")
+	assert.True(t, ok)
+	assert.Equal(t, "true", value)
+
+	value, ok = m.FieldString("nested.a.b")
+	assert.True(t, ok)
+	assert.Equal(t, "c", value)
+
+	_, ok = m.FieldString("nested")
+	assert.False(t, ok)
+
+	value, ok = m.FieldString("_io.kubernetes.pod.name")
+	assert.True(t, ok)
+	assert.Equal(t, "pod", value)
+
+	value, ok = m.FieldString("kéy")
+	assert.True(t, ok)
+	assert.Equal(t, "v", value)
+
+	_, err := m.GetString("n")
+	assert.NotNil(t, err)
+	value, err = m.GetString("nested", "a", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, "c", value)
+
+	f, ok := m.Float("n")
+	assert.True(t, ok)
+	assert.Equal(t, 1500.0, f)
+
+	assert.True(t, m.HasField("ok"))
+	assert.False(t, m.HasField("missing"))
+}
+
+func TestMessageFieldsUnmodified(t *testing.T) {
+	doc := `{"b": 1,  "a": "x"}`
+	m := JSONToMessage(doc)
+	m.FieldString("a")
+
+	// Unmodified messages are sent as they were received
+	assert.Equal(t, doc, string(m.Bytes()))
+}
+
+func TestMessageFieldsEdit(t *testing.T) {
+	m := JSONToMessage(`{"b": 1, "short_message": "x", "a": {"c": [1, 2]}}`)
+
+	m.SetField("b", "two")
+	m.SetField("new", "line\nbreak <tag> \x01")
+	m.SetField("rate", 0.25)
+	m.SetField("flag", false)
+	m.SetField("list", []string{"x", "y"})
+	m.SetField(`qu"ote`, 1.0)
+	m.DeleteField("short_message")
+	m.DeleteField("missing")
+
+	b := m.Bytes()
+	assert.True(t, json.Valid(b))
+	assert.Equal(t, `{"b":"two","a":{"c": [1, 2]},"new":"line\nbreak <tag> \u0001","rate":0.25,"flag":false,"list":["x","y"],"qu\"ote":1}`, string(b))
+
+	// The encoded document is reused and the fields stay valid
+	assert.Equal(t, string(b), string(m.Bytes()))
+	value, _ := m.FieldString("new")
+	assert.Equal(t, "line\nbreak <tag> \x01", value)
+
+	// ParseJSON includes the edits
+	assert.Nil(t, m.ParseJSON())
+	value, _ = m.Container.Path("b").Data().(string)
+	assert.Equal(t, "two", value)
+	assert.Nil(t, m.Container.Path("short_message").Data())
+
+	// After that the container is used
+	m.SetField("after", "yes")
+	value, _ = m.FieldString("after")
+	assert.Equal(t, "yes", value)
+	assert.Contains(t, string(m.Bytes()), `"after":"yes"`)
+}
+
+func TestMessageFieldsMergeJSON(t *testing.T) {
+	m := JSONToMessage(`{"a": 1, "b": 2}`)
+	assert.Nil(t, m.MergeJSON([]byte(`{"b": "x", "c": {"d": true}}`)))
+	assert.Equal(t, `{"a":1,"b":"x","c":{"d": true}}`, string(m.Bytes()))
+	assert.NotNil(t, m.MergeJSON([]byte(`{"b":`)))
+}
+
+func TestMessageFieldsInvalid(t *testing.T) {
+	for _, doc := range []string{``, `{`, `[1, 2]`, `"str"`, `{"a": 1} x`, `{"a": }`} {
+		m := JSONToMessage(doc)
+		assert.NotNil(t, m.ParseFields(), doc)
+		_, ok := m.FieldString("a")
+		assert.False(t, ok)
+		assert.NotNil(t, m.SetField("a", "b"))
+	}
+}
+
+func TestTextToMessage(t *testing.T) {
+	m := TextToMessage("quote \" backslash \\ tab \t invalid \xff ok ä")
+	assert.True(t, json.Valid(m.Bytes()))
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "quote \" backslash \\ tab \t invalid � ok ä", value)
+}
+
+// The benchmarks process a message like the relay does: parse, fill in the
+// standard fields, send the statsd metrics and encode.
+
+var benchmarkSyslogPacket = []byte(`<27>Aug  7 18:33:19 HOSTNAME docker/container-name/0123456789ab/registry:5000/foobar:12341234[9103]: {"level":"info","msg":"request handled","path":"/api/v1/things","status":200,"duration_ms":12.5,"request_id":"3f1e2d4c-5b6a-7988-a0b1-c2d3e4f5a6b7"}`)
+
+var benchmarkGraylogPacket = []byte(`{"version":"1.1","host":"node-1","short_message":"request handled in 12ms","timestamp":1.495174443806e+09,"level":6,"_command":"/app --port 8080","_container_id":"e02acf37f963ec2d46ede21766070559aa4a79c1afc8582e27d580ef2326800e","_container_name":"k8s_app_app-1234_default_b50f4a11_0","_created":"2017-05-19T06:14:02.196020749Z","_image_id":"sha256:91a48ff795cebb88646ec6cc4955bf7f500466feb44ec18b508f2ce94ed0d9b7","_image_name":"registry/app@sha256:77b81b118e6e231d","_io.kubernetes.container.name":"app","_io.kubernetes.pod.name":"app-1234","_tag":"test"}`)
+
+func benchmarkProcess(b *testing.B, m *Message, statsd StatisticsSender, addr *net.UDPAddr) {
+	SourceFields{IP: "source_ip", Port: "source_port"}.Set(m, addr)
+	EnsureMessageFormat(ServerInfo{Hostname: "relay", ServerIP: "10.0.0.1"}, m)
+	SendStatsdMetricsFromMessage(statsd, m)
+	if len(m.Bytes()) == 0 {
+		b.Fatal("Empty message")
+	}
+}
+
+func BenchmarkSyslogMessage(b *testing.B) {
+	statsd := newTestStatsd()
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 514}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkSyslogPacket)))
+	for i := 0; i < b.N; i++ {
+		m, err := ParseSyslogMessage(benchmarkSyslogPacket)
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkProcess(b, &m, statsd, addr)
+	}
+}
+
+func BenchmarkGraylogMessage(b *testing.B) {
+	statsd := newTestStatsd()
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 12201}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkGraylogPacket)))
+	for i := 0; i < b.N; i++ {
+		m := Message{Data: append([]byte(nil), benchmarkGraylogPacket...)}
+		if err := m.ParseFields(); err != nil {
+			b.Fatal(err)
+		}
+		ConvertGraylogFields(&m)
+		benchmarkProcess(b, &m, statsd, addr)
+	}
+}
+
+// BenchmarkGraylogMessageDecoded processes the message fully decoded, as
+// all messages were before the lazy representation.
+func BenchmarkGraylogMessageDecoded(b *testing.B) {
+	statsd := newTestStatsd()
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 12201}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkGraylogPacket)))
+	for i := 0; i < b.N; i++ {
+		m := Message{Data: append([]byte(nil), benchmarkGraylogPacket...)}
+		if err := m.ParseJSON(); err != nil {
+			b.Fatal(err)
+		}
+		ConvertGraylogFields(&m)
+		benchmarkProcess(b, &m, statsd, addr)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MetricRule turns matching log messages into a statsd metric, eg. the
+// latencies which a service only logs into a timing. Rules are given in
+// the same url query style as the outputs:
+//
+//   name=api.requests&service=api&tags=status,method
+//   name=api.latency&type=timing&field=duration_ms&filter=path!=/health&tags=path
+//
+// Options:
+//   name     metric name, required
+//   type     counter (default), gauge, timing or histogram
+//   field    numeric field which is the value of the metric. Required for
+//            all but counters, which are incremented by one if it's not set.
+//            Counter, gauge and timing values are rounded to integers.
+//   scale    multiplier for the field value, eg. 1000 for seconds to ms
+//   service  only messages of this service match
+//   filter   field conditions as with outputs, eg. "status!=200"
+//   tags     comma delimited fields which are added as tags
+//   rate     statsd sample rate, defaults to 1
+type MetricRule struct {
+	Name  string
+	Type  string
+	Field string
+	Scale float64
+	Tags  []string
+	Rate  float32
+
+	Filter *Filter
+}
+
+func ParseMetricRule(spec string) (*MetricRule, error) {
+	options, err := url.ParseQuery(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &MetricRule{
+		Name:  options.Get("name"),
+		Type:  options.Get("type"),
+		Field: options.Get("field"),
+		Scale: 1,
+		Rate:  1,
+	}
+
+	if r.Name == "" {
+		return nil, fmt.Errorf("Metric rule '%s' is missing the name", spec)
+	}
+
+	switch r.Type {
+	case "":
+		r.Type = "counter"
+	case "counter":
+	case "gauge", "timing", "histogram":
+		if r.Field == "" {
+			return nil, fmt.Errorf("Metric rule %s of type %s requires a field", r.Name, r.Type)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown type %s in metric rule %s, expected counter, gauge, timing or histogram", r.Type, r.Name)
+	}
+
+	if scale := options.Get("scale"); scale != "" {
+		r.Scale, err = strconv.ParseFloat(scale, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid scale '%s' in metric rule %s", scale, r.Name)
+		}
+	}
+
+	if rate := options.Get("rate"); rate != "" {
+		value, err := strconv.ParseFloat(rate, 32)
+		if err != nil || value <= 0 || value > 1 {
+			return nil, fmt.Errorf("Invalid rate '%s' in metric rule %s", rate, r.Name)
+		}
+		r.Rate = float32(value)
+	}
+
+	if tags := options.Get("tags"); tags != "" {
+		r.Tags = strings.Split(tags, ",")
+	}
+
+	conditions := options.Get("filter")
+	if service := options.Get("service"); service != "" {
+		if conditions != "" {
+			conditions += ","
+		}
+		conditions += "service==" + service
+	}
+	r.Filter, err = ParseFilter(conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Apply sends the metric if the message matches the rule. Messages which
+// don't have a numeric value in the field are skipped.
+func (r *MetricRule) Apply(statsd StatisticsSender, m *Message) error {
+	if m.ParseFields() != nil || !r.Filter.Match(m) {
+		return nil
+	}
+
+	value := 1.0
+	if r.Field != "" {
+		var ok bool
+		value, ok = numericField(m, r.Field)
+		if !ok {
+			return nil
+		}
+	}
+	value *= r.Scale
+
+	name := r.Name
+	for _, tag := range r.Tags {
+		if tagValue, ok := m.FieldString(tag); ok {
+			name += "," + tag + "=" + sanitiseTagValue(tagValue)
+		}
+	}
+
+	switch r.Type {
+	case "gauge":
+		return statsd.Gauge(name, roundMetricValue(value), r.Rate)
+	case "timing":
+		return statsd.Timing(name, roundMetricValue(value), r.Rate)
+	case "histogram":
+		return statsd.Raw(name, strconv.FormatFloat(value, 'f', -1, 64)+"|h", r.Rate)
+	}
+	return statsd.Inc(name, roundMetricValue(value), r.Rate)
+}
+
+// roundMetricValue rounds half away from zero, so that eg. a gauge of 2.6
+// isn't sent as 2.
+func roundMetricValue(value float64) int64 {
+	if value < 0 {
+		return int64(value - 0.5)
+	}
+	return int64(value + 0.5)
+}
+
+func numericField(m *Message, name string) (float64, bool) {
+	str, ok := m.FieldString(name)
+	if !ok {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// sanitiseTagValue replaces the characters which would break the tag
+// syntax of the metric names.
+func sanitiseTagValue(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return strings.NewReplacer(",", "_", "=", "_", " ", "_", ":", "_", "|", "_").Replace(value)
+}
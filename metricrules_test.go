@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricRule(t *testing.T) {
+	r, err := ParseMetricRule("name=api.latency&type=timing&field=duration&scale=1000&service=api&filter=path!=/health&tags=path,status&rate=0.5")
+	assert.Nil(t, err)
+	assert.Equal(t, "api.latency", r.Name)
+	assert.Equal(t, "timing", r.Type)
+	assert.Equal(t, "duration", r.Field)
+	assert.Equal(t, 1000.0, r.Scale)
+	assert.Equal(t, []string{"path", "status"}, r.Tags)
+	assert.Equal(t, float32(0.5), r.Rate)
+
+	r, err = ParseMetricRule("name=api.requests")
+	assert.Nil(t, err)
+	assert.Equal(t, "counter", r.Type)
+
+	_, err = ParseMetricRule("type=counter")
+	assert.NotNil(t, err)
+	_, err = ParseMetricRule("name=foo&type=timing")
+	assert.NotNil(t, err)
+	_, err = ParseMetricRule("name=foo&type=foo")
+	assert.NotNil(t, err)
+	_, err = ParseMetricRule("name=foo&rate=2")
+	assert.NotNil(t, err)
+	_, err = ParseMetricRule("name=foo&filter=foo")
+	assert.NotNil(t, err)
+}
+
+func TestMetricRuleApply(t *testing.T) {
+	raw := &rawStatsd{testStatsd: *newTestStatsd()}
+
+	counter, _ := ParseMetricRule("name=api.requests&service=api&tags=status,method")
+	timing, _ := ParseMetricRule("name=api.latency&type=timing&field=duration&scale=1000&service=api&filter=path!=/health")
+	histogram, _ := ParseMetricRule("name=api.size&type=histogram&field=size")
+
+	messages := []string{
+		`{"service":"api","status":200,"method":"GET","path":"/foo","duration":0.25,"size":"512"}`,
+		`{"service":"api","status":500,"method":"GET","path":"/health","duration":0.01}`,
+		`{"service":"api","status":200,"method":"GET","path":"/foo","duration":"not a number"}`,
+		`{"service":"other","status":200,"duration":1}`,
+	}
+	for _, json := range messages {
+		m := JSONToMessage(json)
+		m.ParseJSON()
+		for _, r := range []*MetricRule{counter, timing, histogram} {
+			r.Apply(raw, &m)
+		}
+	}
+
+	assert.Equal(t, int64(2), raw.Counter("api.requests,status=200,method=GET"))
+	assert.Equal(t, int64(1), raw.Counter("api.requests,status=500,method=GET"))
+	assert.Equal(t, int64(1), raw.Timings("api.latency"))
+	assert.Equal(t, []string{"api.size:512|h"}, raw.raw)
+}
+
+func TestMetricRuleApplyRounding(t *testing.T) {
+	statsd := newTestStatsd()
+
+	gauge, _ := ParseMetricRule("name=queue.length&type=gauge&field=length")
+	counter, _ := ParseMetricRule("name=queue.errors&field=errors")
+
+	m := JSONToMessage(`{"service":"api","length":2.6,"errors":-1.5}`)
+	m.ParseJSON()
+	gauge.Apply(statsd, &m)
+	counter.Apply(statsd, &m)
+
+	value, _ := statsd.GaugeValue("queue.length")
+	assert.Equal(t, int64(3), value)
+	assert.Equal(t, int64(-2), statsd.Counter("queue.errors"))
+
+	assert.Equal(t, int64(0), roundMetricValue(0.49))
+	assert.Equal(t, int64(1), roundMetricValue(0.5))
+}
+
+func TestMetricRuleApplyDogStatsDHistogram(t *testing.T) {
+	raw := &rawStatsd{testStatsd: *newTestStatsd()}
+	statsd := &DialectStatsd{Statsd: raw, Dialect: DialectDogStatsD}
+
+	// The sample rate must go before the tags
+	histogram, _ := ParseMetricRule("name=api.size&type=histogram&field=size&tags=method&rate=0.999999")
+
+	m := JSONToMessage(`{"service":"api","method":"GET","size":512}`)
+	m.ParseJSON()
+	for i := 0; i < 100 && len(raw.raw) == 0; i++ {
+		histogram.Apply(statsd, &m)
+	}
+
+	assert.Equal(t, []string{"api.size:512|h|@0.999999|#method:GET"}, raw.raw)
+	assert.Equal(t, []float32{1}, raw.rates)
+}
+
+func TestSanitiseTagValue(t *testing.T) {
+	assert.Equal(t, "a_b_c_d", sanitiseTagValue("a,b=c d"))
+	assert.Equal(t, "none", sanitiseTagValue(""))
+}
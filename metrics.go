@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metric names are written in the InfluxDB style, with the tags appended to
+// the name: "app.log.messages,service=foo,level=ERROR". DialectStatsd
+// rewrites the names for statsd servers which expect the tags in another
+// format:
+//
+//   influxdb   app.log.messages,service=foo,level=ERROR:1|c
+//   dogstatsd  app.log.messages:1|c|#service:foo,level:ERROR
+//   graphite   app.log.messages.service.foo.level.ERROR:1|c
+//
+// Graphite path components are sanitised so that eg. the dots in a topic
+// name don't create new levels.
+type DialectStatsd struct {
+	Statsd StatisticsSender
+
+	Dialect string
+}
+
+const (
+	DialectInfluxDB  = "influxdb"
+	DialectDogStatsD = "dogstatsd"
+	DialectGraphite  = "graphite"
+)
+
+// NewDialectStatsd wraps a statsd client. The InfluxDB dialect doesn't
+// need any rewriting, so the client is returned as is.
+func NewDialectStatsd(statsd StatisticsSender, dialect string) (StatisticsSender, error) {
+	switch dialect {
+	case "", DialectInfluxDB:
+		return statsd, nil
+	case DialectDogStatsD, DialectGraphite:
+		return &DialectStatsd{Statsd: statsd, Dialect: dialect}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown statsd dialect %s, expected influxdb, dogstatsd or graphite", dialect)
+}
+
+type metricTag struct {
+	key   string
+	value string
+}
+
+func parseMetricName(name string) (string, []metricTag) {
+	parts := strings.Split(name, ",")
+	tags := make([]metricTag, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		keyvalue := strings.SplitN(part, "=", 2)
+		if len(keyvalue) == 2 {
+			tags = append(tags, metricTag{key: keyvalue[0], value: keyvalue[1]})
+		}
+	}
+	return parts[0], tags
+}
+
+// GraphiteMetricName encodes the tags as path components.
+func GraphiteMetricName(name string) string {
+	base, tags := parseMetricName(name)
+	for _, tag := range tags {
+		base += "." + sanitiseGraphite(tag.key) + "." + sanitiseGraphite(tag.value)
+	}
+	return base
+}
+
+func sanitiseGraphite(s string) string {
+	if s == "" {
+		return "none"
+	}
+
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || IsDigit(c) || c == '-' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// DogStatsDTags returns the name without tags and the tags in the DogStatsD
+// "|#key:value,key:value" format, or an empty string if there are no tags.
+func DogStatsDTags(name string) (string, string) {
+	base, tags := parseMetricName(name)
+	if len(tags) == 0 {
+		return base, ""
+	}
+
+	formatted := make([]string, len(tags))
+	for i, tag := range tags {
+		formatted[i] = tag.key + ":" + tag.value
+	}
+	return base, "|#" + strings.Join(formatted, ",")
+}
+
+// send writes a metric with the type suffix, eg. "c" for counters.
+func (s *DialectStatsd) send(name string, value string, suffix string, rate float32) error {
+	return s.Raw(name, value+"|"+suffix, rate)
+}
+
+func (s *DialectStatsd) Inc(name string, value int64, rate float32) error {
+	return s.send(name, strconv.FormatInt(value, 10), "c", rate)
+}
+
+func (s *DialectStatsd) Dec(name string, value int64, rate float32) error {
+	return s.send(name, strconv.FormatInt(-value, 10), "c", rate)
+}
+
+func (s *DialectStatsd) Gauge(name string, value int64, rate float32) error {
+	return s.send(name, strconv.FormatInt(value, 10), "g", rate)
+}
+
+func (s *DialectStatsd) GaugeDelta(name string, value int64, rate float32) error {
+	// Deltas are told apart from gauge values by the sign
+	if value >= 0 {
+		return s.send(name, "+"+strconv.FormatInt(value, 10), "g", rate)
+	}
+	return s.send(name, strconv.FormatInt(value, 10), "g", rate)
+}
+
+func (s *DialectStatsd) Timing(name string, value int64, rate float32) error {
+	return s.send(name, strconv.FormatInt(value, 10), "ms", rate)
+}
+
+func (s *DialectStatsd) TimingDuration(name string, value time.Duration, rate float32) error {
+	ms := float64(value) / float64(time.Millisecond)
+	return s.send(name, strconv.FormatFloat(ms, 'f', -1, 64), "ms", rate)
+}
+
+func (s *DialectStatsd) Set(name string, value string, rate float32) error {
+	return s.send(name, value, "s", rate)
+}
+
+func (s *DialectStatsd) SetInt(name string, value int64, rate float32) error {
+	return s.send(name, strconv.FormatInt(value, 10), "s", rate)
+}
+
+// Raw sends the value as is, it must include the type suffix.
+func (s *DialectStatsd) Raw(name string, value string, rate float32) error {
+	if s.Dialect == DialectGraphite {
+		return s.Statsd.Raw(GraphiteMetricName(name), value, rate)
+	}
+
+	// DogStatsD tags go after the sample rate, so the sampling is done here
+	// instead of by the client
+	if rate < 1 && rand.Float32() >= rate {
+		return nil
+	}
+
+	base, tags := DogStatsDTags(name)
+	if rate < 1 {
+		value += "|@" + strconv.FormatFloat(float64(rate), 'f', -1, 32)
+	}
+	return s.Statsd.Raw(base, value+tags, 1)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rawStatsd records the raw metrics sent through it and their rates
+type rawStatsd struct {
+	testStatsd
+	raw   []string
+	rates []float32
+}
+
+func (s *rawStatsd) Raw(name string, value string, rate float32) error {
+	s.raw = append(s.raw, name+":"+value)
+	s.rates = append(s.rates, rate)
+	return nil
+}
+
+func TestNewDialectStatsd(t *testing.T) {
+	statsd := newTestStatsd()
+
+	s, err := NewDialectStatsd(statsd, "influxdb")
+	assert.Nil(t, err)
+	assert.Equal(t, statsd, s)
+
+	s, err = NewDialectStatsd(statsd, "dogstatsd")
+	assert.Nil(t, err)
+	assert.Equal(t, &DialectStatsd{Statsd: statsd, Dialect: "dogstatsd"}, s)
+
+	_, err = NewDialectStatsd(statsd, "foo")
+	assert.NotNil(t, err)
+}
+
+func TestGraphiteMetricName(t *testing.T) {
+	assert.Equal(t, "app.log.messages.service.foo.level.ERROR", GraphiteMetricName("app.log.messages,service=foo,level=ERROR"))
+	assert.Equal(t, "logs2kafka.produced.topic.service_foo", GraphiteMetricName("logs2kafka.produced,topic=service.foo"))
+	assert.Equal(t, "logs2kafka.unknown_service", GraphiteMetricName("logs2kafka.unknown_service"))
+	assert.Equal(t, "logs2kafka.sink.written.sink.none", GraphiteMetricName("logs2kafka.sink.written,sink="))
+}
+
+func TestDogStatsDTags(t *testing.T) {
+	name, tags := DogStatsDTags("app.log.messages,service=foo,level=ERROR")
+	assert.Equal(t, "app.log.messages", name)
+	assert.Equal(t, "|#service:foo,level:ERROR", tags)
+
+	name, tags = DogStatsDTags("logs2kafka.unknown_service")
+	assert.Equal(t, "logs2kafka.unknown_service", name)
+	assert.Equal(t, "", tags)
+}
+
+func TestDialectStatsd(t *testing.T) {
+	raw := &rawStatsd{}
+
+	s := &DialectStatsd{Statsd: raw, Dialect: DialectDogStatsD}
+	s.Inc("app.log.messages,service=foo,level=ERROR", 1, 1)
+	s.Gauge("logs2kafka.in_flight,topic=service.foo", 5, 1)
+	s.GaugeDelta("logs2kafka.queue", -2, 1)
+	s.TimingDuration("logs2kafka.produce_latency,topic=service.foo", 1500*time.Microsecond, 1)
+	// A rate of 0.5 is sent half of the time and the rate goes before the tags
+	for i := 0; i < 100; i++ {
+		s.Inc("app.log.messages,service=foo,level=DEBUG", 1, 0.5)
+	}
+
+	assert.Equal(t, "app.log.messages:1|c|#service:foo,level:ERROR", raw.raw[0])
+	assert.Equal(t, "logs2kafka.in_flight:5|g|#topic:service.foo", raw.raw[1])
+	assert.Equal(t, "logs2kafka.queue:-2|g", raw.raw[2])
+	assert.Equal(t, "logs2kafka.produce_latency:1.5|ms|#topic:service.foo", raw.raw[3])
+	assert.InDelta(t, 50, len(raw.raw)-4, 25)
+	assert.Equal(t, "app.log.messages:1|c|@0.5|#service:foo,level:DEBUG", raw.raw[4])
+	assert.Equal(t, float32(1), raw.rates[4])
+
+	// Raw values are sampled the same way
+	raw = &rawStatsd{}
+	s = &DialectStatsd{Statsd: raw, Dialect: DialectDogStatsD}
+	for i := 0; i < 100; i++ {
+		s.Raw("app.request_size,service=foo", "1.5|h", 0.5)
+	}
+	assert.InDelta(t, 50, len(raw.raw), 25)
+	assert.Equal(t, "app.request_size:1.5|h|@0.5|#service:foo", raw.raw[0])
+	assert.Equal(t, float32(1), raw.rates[0])
+
+	raw = &rawStatsd{}
+	s = &DialectStatsd{Statsd: raw, Dialect: DialectGraphite}
+	s.Inc("app.log.messages,service=foo,level=ERROR", 1, 1)
+	s.GaugeDelta("logs2kafka.queue", 2, 1)
+	assert.Equal(t, []string{"app.log.messages.service.foo.level.ERROR:1|c", "logs2kafka.queue:+2|g"}, raw.raw)
+}
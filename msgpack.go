@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MsgpackEncoder encodes the message document as MessagePack. The structure
+// is the same as with JSON, but integral numbers are sent as integers.
+type MsgpackEncoder struct{}
+
+func (e MsgpackEncoder) Encode(m *Message) ([]byte, error) {
+	if err := m.ParseJSON(); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(make([]byte, 0, 256), m.Container.Data())
+}
+
+func appendMsgpack(buf []byte, value interface{}) ([]byte, error) {
+	var err error
+
+	switch v := value.(type) {
+	case nil:
+		buf = append(buf, 0xc0)
+	case bool:
+		if v {
+			buf = append(buf, 0xc3)
+		} else {
+			buf = append(buf, 0xc2)
+		}
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			buf = appendMsgpackInt(buf, int64(v))
+		} else {
+			buf = append(buf, 0xcb)
+			buf = appendUint64(buf, math.Float64bits(v))
+		}
+	case string:
+		buf = appendMsgpackString(buf, v)
+	case []interface{}:
+		l := len(v)
+		switch {
+		case l < 16:
+			buf = append(buf, 0x90|byte(l))
+		case l <= math.MaxUint16:
+			buf = append(buf, 0xdc)
+			buf = appendUint16(buf, uint16(l))
+		default:
+			buf = append(buf, 0xdd)
+			buf = appendUint32(buf, uint32(l))
+		}
+		for _, item := range v {
+			buf, err = appendMsgpack(buf, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		l := len(v)
+		switch {
+		case l < 16:
+			buf = append(buf, 0x80|byte(l))
+		case l <= math.MaxUint16:
+			buf = append(buf, 0xde)
+			buf = appendUint16(buf, uint16(l))
+		default:
+			buf = append(buf, 0xdf)
+			buf = appendUint32(buf, uint32(l))
+		}
+
+		keys := make([]string, 0, l)
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			buf = appendMsgpackString(buf, key)
+			buf, err = appendMsgpack(buf, v[key])
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Can't encode value of type %T as MessagePack", value)
+	}
+
+	return buf, nil
+}
+
+func appendMsgpackInt(buf []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v < 128:
+		return append(buf, byte(v))
+	case v < 0 && v >= -32:
+		return append(buf, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return append(buf, 0xd0, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		buf = append(buf, 0xd1)
+		return appendUint16(buf, uint16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		buf = append(buf, 0xd2)
+		return appendUint32(buf, uint32(v))
+	}
+	buf = append(buf, 0xd3)
+	return appendUint64(buf, uint64(v))
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	l := len(s)
+	switch {
+	case l < 32:
+		buf = append(buf, 0xa0|byte(l))
+	case l <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(l))
+	case l <= math.MaxUint16:
+		buf = append(buf, 0xda)
+		buf = appendUint16(buf, uint16(l))
+	default:
+		buf = append(buf, 0xdb)
+		buf = appendUint32(buf, uint32(l))
+	}
+	return append(buf, s...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
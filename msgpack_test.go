@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgpackEncoder(t *testing.T) {
+	m := JSONToMessage(`{"b":true,"f":1.5,"i":-200,"n":null,"s":"hi","a":[1]}`)
+	m.ParseJSON()
+
+	value, err := MsgpackEncoder{}.Encode(&m)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0x86,
+		0xa1, 'a', 0x91, 0x01,
+		0xa1, 'b', 0xc3,
+		0xa1, 'f', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0xa1, 'i', 0xd1, 0xff, 0x38,
+		0xa1, 'n', 0xc0,
+		0xa1, 's', 0xa2, 'h', 'i',
+	}, value)
+}
+
+func TestAppendMsgpackString(t *testing.T) {
+	long := make([]byte, 40)
+	value := appendMsgpackString(nil, string(long))
+	assert.Equal(t, []byte{0xd9, 40}, value[0:2])
+	assert.Equal(t, 42, len(value))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output is a destination for processed messages, such as Kafka or the
+// local log files.
+type Output interface {
+	Write(m *Message) error
+	Close()
+}
+
+// Sink feeds messages which pass its filter to an Output. Each sink has its
+// own queue and goroutine so that a slow or failing output doesn't stall the
+// other sinks: if the queue is full, new messages are dropped.
+type Sink struct {
+	Name string
+
+	Output Output
+
+	Filter *Filter
+
+	Statsd StatisticsSender
+
+	queue chan Message
+
+	done sync.WaitGroup
+}
+
+const DefaultSinkQueueSize = 1000
+
+func NewSink(name string, output Output, filter *Filter, queueSize int) *Sink {
+	if queueSize <= 0 {
+		queueSize = DefaultSinkQueueSize
+	}
+
+	return &Sink{
+		Name:   name,
+		Output: output,
+		Filter: filter,
+		queue:  make(chan Message, queueSize),
+	}
+}
+
+func (s *Sink) Start() {
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		for m := range s.queue {
+			err := s.Output.Write(&m)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing message to sink %s: %s\n", s.Name, err)
+				if s.Statsd != nil {
+					s.Statsd.Inc(fmt.Sprintf("logs2kafka.sink.errors,sink=%s", s.Name), 1, 1)
+				}
+			} else if s.Statsd != nil {
+				s.Statsd.Inc(fmt.Sprintf("logs2kafka.sink.written,sink=%s", s.Name), 1, 0.1)
+			}
+		}
+	}()
+}
+
+// Send queues the message if it passes the filter. Returns false if the
+// message was dropped because the queue is full.
+func (s *Sink) Send(m Message) bool {
+	if s.Filter != nil && !s.Filter.Match(&m) {
+		return true
+	}
+
+	select {
+	case s.queue <- m:
+		return true
+	default:
+		if s.Statsd != nil {
+			s.Statsd.Inc(fmt.Sprintf("logs2kafka.sink.dropped,sink=%s", s.Name), 1, 1)
+		}
+		return false
+	}
+}
+
+// QueueDepth returns the number of messages waiting to be written.
+func (s *Sink) QueueDepth() int64 {
+	return int64(len(s.queue))
+}
+
+// Close waits for the queued messages to be written and closes the output.
+func (s *Sink) Close() {
+	close(s.queue)
+	s.done.Wait()
+	s.Output.Close()
+}
+
+// SinkSpec is a parsed --output option. The format is the output type
+// optionally followed by url query style options:
+//
+//   kafka
+//   stdout?filter=level==ERROR
+//   http?url=http://localhost:8080/logs&filter=service==foo&queue=100
+//   kafka?name=archive&brokers=archive1:9092,archive2:9092
+//
+// The common options are "name" (defaults to the type), "filter" and
+// "queue". Other options are specific to the output type.
+type SinkSpec struct {
+	Type      string
+	Name      string
+	Filter    *Filter
+	QueueSize int
+	Options   url.Values
+}
+
+func ParseSinkSpec(spec string) (SinkSpec, error) {
+	s := SinkSpec{}
+
+	parts := strings.SplitN(spec, "?", 2)
+	s.Type = parts[0]
+	if s.Type == "" {
+		return s, fmt.Errorf("Output type is missing from '%s'", spec)
+	}
+
+	s.Options = url.Values{}
+	if len(parts) == 2 {
+		options, err := url.ParseQuery(parts[1])
+		if err != nil {
+			return s, err
+		}
+		s.Options = options
+	}
+
+	s.Name = s.Options.Get("name")
+	if s.Name == "" {
+		s.Name = s.Type
+	}
+
+	var err error
+	s.Filter, err = ParseFilter(s.Options.Get("filter"))
+	if err != nil {
+		return s, err
+	}
+
+	if q := s.Options.Get("queue"); q != "" {
+		s.QueueSize, err = strconv.Atoi(q)
+		if err != nil {
+			return s, fmt.Errorf("Invalid queue size '%s' for output %s", q, s.Name)
+		}
+	}
+
+	return s, nil
+}
+
+// OutputDefaults carries the global settings used by outputs when the spec
+// doesn't override them.
+type OutputDefaults struct {
+	FileLogsPath string
+
+	Brokers []string
+
+	// NewKafkaProducer creates a producer configured with the global kafka
+	// options and the given brokers.
+	NewKafkaProducer func(brokers []string, options url.Values) (*KafkaProducer, error)
+
+	Debug bool
+
+	Stats *Stats
+}
+
+// NewOutput creates the output described by the spec. Known types are
+// "kafka", "file", "stdout" and "http".
+func NewOutput(spec SinkSpec, defaults OutputDefaults) (Output, error) {
+	switch spec.Type {
+	case "kafka":
+		brokers := defaults.Brokers
+		if b := spec.Options.Get("brokers"); b != "" {
+			brokers = strings.Split(b, ",")
+		}
+		if defaults.NewKafkaProducer == nil {
+			return nil, fmt.Errorf("Kafka output is not available")
+		}
+		kafka, err := defaults.NewKafkaProducer(brokers, spec.Options)
+		if err != nil {
+			return nil, err
+		}
+		return kafka, nil
+	case "file":
+		path := defaults.FileLogsPath
+		if p := spec.Options.Get("path"); p != "" {
+			path = p
+		}
+		o := NewFileOutput(path)
+		o.Debug = defaults.Debug
+		o.Stats = defaults.Stats
+		return o, nil
+	case "stdout":
+		return &WriterOutput{Writer: os.Stdout}, nil
+	case "http":
+		u := spec.Options.Get("url")
+		if u == "" {
+			return nil, fmt.Errorf("Http output %s requires the url option", spec.Name)
+		}
+		return NewHTTPOutput(u), nil
+	}
+
+	return nil, fmt.Errorf("Unknown output type %s", spec.Type)
+}
+
+// WriterOutput writes each message as a JSON line into a writer.
+type WriterOutput struct {
+	Writer io.Writer
+}
+
+func (o *WriterOutput) Write(m *Message) error {
+	_, err := o.Writer.Write(m.Line())
+	return err
+}
+
+func (o *WriterOutput) Close() {
+}
+
+// HTTPOutput posts each message as a JSON document into an url.
+type HTTPOutput struct {
+	URL string
+
+	Client *http.Client
+}
+
+func NewHTTPOutput(url string) *HTTPOutput {
+	return &HTTPOutput{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (o *HTTPOutput) Write(m *Message) error {
+	resp, err := o.Client.Post(o.URL, "application/json", bytes.NewReader(m.Bytes()))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Http output %s returned status %d", o.URL, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (o *HTTPOutput) Close() {
+}
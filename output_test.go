@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testOutput struct {
+	messages []Message
+	block    chan bool
+	fail     bool
+	closed   bool
+}
+
+func (o *testOutput) Write(m *Message) error {
+	if o.block != nil {
+		<-o.block
+	}
+	if o.fail {
+		return errors.New("failed")
+	}
+	o.messages = append(o.messages, *m)
+	return nil
+}
+
+func (o *testOutput) Close() {
+	o.closed = true
+}
+
+func TestParseSinkSpec(t *testing.T) {
+	spec, err := ParseSinkSpec("kafka")
+	assert.Nil(t, err)
+	assert.Equal(t, "kafka", spec.Type)
+	assert.Equal(t, "kafka", spec.Name)
+	assert.Equal(t, 0, spec.QueueSize)
+
+	spec, err = ParseSinkSpec("http?name=alerts&url=http://localhost:8080/logs&filter=level==ERROR&queue=10")
+	assert.Nil(t, err)
+	assert.Equal(t, "http", spec.Type)
+	assert.Equal(t, "alerts", spec.Name)
+	assert.Equal(t, "http://localhost:8080/logs", spec.Options.Get("url"))
+	assert.Equal(t, 10, spec.QueueSize)
+
+	m := JSONToMessage(`{"level":"ERROR"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, spec.Filter.Match(&m))
+
+	_, err = ParseSinkSpec("stdout?queue=foo")
+	assert.NotNil(t, err)
+
+	_, err = ParseSinkSpec("?queue=1")
+	assert.NotNil(t, err)
+}
+
+func TestNewOutput(t *testing.T) {
+	spec, _ := ParseSinkSpec("stdout")
+	output, err := NewOutput(spec, OutputDefaults{})
+	assert.Nil(t, err)
+	assert.IsType(t, &WriterOutput{}, output)
+
+	spec, _ = ParseSinkSpec("http")
+	_, err = NewOutput(spec, OutputDefaults{})
+	assert.NotNil(t, err)
+
+	spec, _ = ParseSinkSpec("kafka")
+	_, err = NewOutput(spec, OutputDefaults{})
+	assert.NotNil(t, err)
+
+	spec, _ = ParseSinkSpec("foo")
+	_, err = NewOutput(spec, OutputDefaults{})
+	assert.NotNil(t, err)
+}
+
+func TestSinkFilterAndClose(t *testing.T) {
+	output := &testOutput{}
+	filter, _ := ParseFilter("level==ERROR")
+	s := NewSink("test", output, filter, 10)
+	s.Start()
+
+	m := JSONToMessage(`{"level":"ERROR","msg":"first"}`)
+	m.ParseJSON()
+	s.Send(m)
+
+	m = JSONToMessage(`{"level":"INFO","msg":"second"}`)
+	m.ParseJSON()
+	s.Send(m)
+
+	s.Close()
+
+	assert.Equal(t, true, output.closed)
+	assert.Equal(t, 1, len(output.messages))
+	value, _ := output.messages[0].FieldString("msg")
+	assert.Equal(t, "first", value)
+}
+
+func TestSinkDropsWhenQueueIsFull(t *testing.T) {
+	output := &testOutput{block: make(chan bool)}
+	s := NewSink("test", output, nil, 1)
+	s.Start()
+
+	m := JSONToMessage(`{"msg":"hello"}`)
+	m.ParseJSON()
+
+	// First message is taken by the writer goroutine which then blocks,
+	// second one fills the queue.
+	assert.Equal(t, true, s.Send(m))
+	for len(s.queue) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, true, s.Send(m))
+	assert.Equal(t, false, s.Send(m))
+
+	close(output.block)
+	s.Close()
+	assert.Equal(t, 2, len(output.messages))
+}
+
+func TestWriterOutput(t *testing.T) {
+	buf := &bytes.Buffer{}
+	o := WriterOutput{Writer: buf}
+
+	m := JSONToMessage(`{"msg":"hello"}`)
+	m.ParseJSON()
+
+	err := o.Write(&m)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"msg\":\"hello\"}\n", buf.String())
+}
+
+func TestHTTPOutput(t *testing.T) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL)
+
+	m := JSONToMessage(`{"msg":"hello"}`)
+	m.ParseJSON()
+
+	err := o.Write(&m)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"msg":"hello"}`, string(received))
+}
+
+func TestHTTPOutputError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	o := NewHTTPOutput(server.URL)
+
+	m := JSONToMessage(`{"msg":"hello"}`)
+	m.ParseJSON()
+
+	err := o.Write(&m)
+	assert.NotNil(t, err)
+}
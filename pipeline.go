@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Input receives messages, eg. from a UDP port or log files, and sends them
+// into the channel given to Start until it's closed.
+type Input interface {
+	Start(messages chan Message) error
+	Close()
+}
+
+// Pipeline relays the messages of its inputs through the processors to the
+// outputs. The processors run in this order, each being skipped if it's not
+// configured: docker enrichment, message format and server info, statsd
+// metrics and metric rules, topic defaults and sanitisation, sampling,
+// deduplication and truncation. Each message which is not dropped is then
+// sent to every output.
+//
+// The logs2kafka daemon is a Pipeline configured from the command line
+// options, but a Pipeline can also be embedded in other programs.
+type Pipeline struct {
+	Inputs []Input
+
+	// Docker adds the container metadata, nil to skip
+	Docker *DockerEnricher
+
+	ServerInfo ServerInfo
+
+	MetricRules []*MetricRule
+
+	// Topic of the messages which don't have one
+	DefaultTopic string
+
+	// Prepended to the topics with a "." separator
+	TopicPrefix string
+
+	// Topics makes the topic names valid for Kafka, nil to use them as is
+	Topics *TopicSanitiser
+
+	// Sampler drops a fraction of the messages, nil to keep all
+	Sampler *Sampler
+
+	// Dedup collapses repeated messages, nil to keep all
+	Dedup *Deduplicator
+
+	// Truncator shortens long messages, nil to keep them as is
+	Truncator *Truncator
+
+	Outputs []*Sink
+
+	Statsd StatisticsSender
+
+	// Stats counts the messages of each stage, created by Start if nil
+	Stats *Stats
+
+	// IdentityField is removed from the messages without a verified
+	// Identity, so that a sender can't claim the identity of a TLS client
+	// by writing the field itself. Empty to keep the field.
+	IdentityField string
+
+	// Debug prints each received message
+	Debug bool
+
+	// Number of received messages waiting for the processors,
+	// DefaultPipelineQueueSize if 0
+	QueueSize int
+
+	messages chan Message
+	stop     chan bool
+	stopped  sync.Once
+	done     sync.WaitGroup
+	started  []Input
+}
+
+const DefaultPipelineQueueSize = 1000
+
+// PipelineCounts is the number of messages which passed each stage.
+type PipelineCounts struct {
+	Received     int64
+	SampledOut   int64
+	Deduplicated int64
+	Truncated    int64
+	Forwarded    int64
+}
+
+// Start starts the outputs and the inputs and begins relaying messages. If
+// an input fails to start, the started inputs and the outputs are closed.
+func (p *Pipeline) Start() error {
+	if p.Stats == nil {
+		p.Stats = NewStats()
+	}
+
+	if p.Topics != nil && p.Topics.Stats == nil {
+		p.Topics.Stats = p.Stats
+	}
+
+	queueSize := p.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultPipelineQueueSize
+	}
+	p.messages = make(chan Message, queueSize)
+	p.stop = make(chan bool)
+	p.Stats.GaugeFunc("logs2kafka.queue_depth,queue=input", func() int64 {
+		return int64(len(p.messages))
+	})
+
+	for _, sink := range p.Outputs {
+		if sink.Statsd == nil {
+			sink.Statsd = p.Statsd
+		}
+		sink.Start()
+		p.Stats.GaugeFunc("logs2kafka.queue_depth,queue="+sink.Name, sink.QueueDepth)
+	}
+
+	p.done.Add(1)
+	go p.run()
+
+	for _, input := range p.Inputs {
+		err := input.Start(p.messages)
+		if err != nil {
+			p.Stop()
+			return err
+		}
+		p.started = append(p.started, input)
+	}
+
+	return nil
+}
+
+// Send injects a message into the pipeline as if an input received it.
+func (p *Pipeline) Send(m Message) {
+	p.messages <- m
+}
+
+// Stop closes the inputs, flushes the deduplication summaries and closes
+// the outputs once they have written the queued messages. Only the first
+// call has an effect, so Stop can also be called after a failed Start.
+func (p *Pipeline) Stop() {
+	p.stopped.Do(func() {
+		for i := len(p.started) - 1; i >= 0; i-- {
+			p.started[i].Close()
+		}
+		p.started = nil
+
+		close(p.stop)
+		p.done.Wait()
+
+		if p.Docker != nil {
+			p.Docker.Close()
+		}
+
+		for _, sink := range p.Outputs {
+			sink.Close()
+		}
+	})
+}
+
+// Counts returns the number of messages which have passed each stage.
+func (p *Pipeline) Counts() PipelineCounts {
+	return PipelineCounts{
+		Received:     p.Stats.Counter("logs2kafka.pipeline,stage=received"),
+		SampledOut:   p.Stats.Counter("logs2kafka.pipeline,stage=sampled_out"),
+		Deduplicated: p.Stats.Counter("logs2kafka.pipeline,stage=deduplicated"),
+		Truncated:    p.Stats.Counter("logs2kafka.pipeline,stage=truncated"),
+		Forwarded:    p.Stats.Counter("logs2kafka.pipeline,stage=forwarded"),
+	}
+}
+
+// QueueDepth returns the number of messages waiting in the queue of each
+// output.
+func (p *Pipeline) QueueDepth() map[string]int64 {
+	depths := make(map[string]int64)
+	for _, sink := range p.Outputs {
+		depths[sink.Name] = sink.QueueDepth()
+	}
+	return depths
+}
+
+func (p *Pipeline) run() {
+	defer p.done.Done()
+
+	// Summaries of the repeated messages are emitted once a second
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case message := <-p.messages:
+			if p.Process(&message) {
+				p.forward(message)
+			}
+		case <-flush.C:
+			p.flush(false)
+		case <-p.stop:
+			p.drain()
+
+			// The windows which are still open are ended too, so that the
+			// repeats aren't lost
+			p.flush(true)
+			return
+		}
+	}
+}
+
+// drain processes the messages which the closed inputs left in the queue.
+func (p *Pipeline) drain() {
+	for {
+		select {
+		case message := <-p.messages:
+			if p.Process(&message) {
+				p.forward(message)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Process runs the processors on the message. Returns false if the message
+// was dropped.
+func (p *Pipeline) Process(message *Message) bool {
+	if p.Debug {
+		fmt.Printf("Got message: %+v\n", *message)
+	}
+	p.Stats.Add("logs2kafka.pipeline,stage=received", 1)
+	EnsureMessageFormat(p.ServerInfo, message)
+	if p.IdentityField != "" && message.Identity == "" {
+		message.DeleteField(p.IdentityField)
+	}
+
+	// The container metadata is added after the service has been decided,
+	// so that the messages of a container don't move to another topic once
+	// its lookup has finished
+	if p.Docker != nil {
+		p.Docker.Enrich(message)
+	}
+	SendStatsdMetricsFromMessage(p.Statsd, message)
+	for _, rule := range p.MetricRules {
+		rule.Apply(p.Statsd, message)
+	}
+
+	if message.Topic == "" {
+		message.Topic = p.DefaultTopic
+	}
+	if p.Topics != nil {
+		message.Topic = p.Topics.Topic(p.TopicPrefix, message.Topic, p.DefaultTopic)
+	} else {
+		message.Topic = p.TopicPrefix + "." + message.Topic
+	}
+
+	if p.Sampler != nil && !p.Sampler.Sample(message) {
+		p.Stats.Add("logs2kafka.pipeline,stage=sampled_out", 1)
+		return false
+	}
+
+	if p.Dedup != nil && !p.Dedup.Process(message) {
+		p.Stats.Add("logs2kafka.pipeline,stage=deduplicated", 1)
+		return false
+	}
+
+	if p.Truncator != nil && p.Truncator.Truncate(message) {
+		p.Stats.Add("logs2kafka.pipeline,stage=truncated", 1)
+	}
+
+	return true
+}
+
+func (p *Pipeline) forward(message Message) {
+	p.Stats.Add("logs2kafka.pipeline,stage=forwarded", 1)
+
+	// Encoded once here instead of in each output
+	message.Bytes()
+	for _, sink := range p.Outputs {
+		sink.Send(message)
+	}
+}
+
+func (p *Pipeline) flush(all bool) {
+	if p.Dedup == nil {
+		return
+	}
+	for _, summary := range p.Dedup.Flush(all) {
+		for _, sink := range p.Outputs {
+			sink.Send(summary)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPipeline relays real UDP syslog and GELF packets into a mock sarama
+// producer and local files
+type testPipeline struct {
+	*Pipeline
+	syslog   *Syslog
+	graylog  *Graylog
+	producer *testAsyncProducer
+	statsd   *testStatsd
+	dir      string
+}
+
+func newTestPipeline(t *testing.T) *testPipeline {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+
+	p := &testPipeline{
+		syslog:  &Syslog{BindAddress: "127.0.0.1"},
+		graylog: &Graylog{BindAddress: "127.0.0.1"},
+		statsd:  newTestStatsd(),
+		dir:     dir,
+	}
+
+	p.producer = newTestAsyncProducer()
+	kafka := &KafkaProducer{Statsd: p.statsd}
+	kafka.start(p.producer)
+
+	p.Pipeline = &Pipeline{
+		Inputs:       []Input{p.syslog, p.graylog},
+		ServerInfo:   ServerInfo{Hostname: "relay-1", ServerIP: "10.0.0.1"},
+		DefaultTopic: "default",
+		TopicPrefix:  "test",
+		Outputs: []*Sink{
+			NewSink("kafka", kafka, nil, 0),
+			NewSink("file", NewFileOutput(dir), nil, 0),
+		},
+		Statsd: p.statsd,
+	}
+	return p
+}
+
+// waitProduced returns the topic and value of the next message produced
+func (p *testPipeline) waitProduced(t *testing.T) (string, string) {
+	select {
+	case m := <-p.producer.produced:
+		value, err := m.Value.Encode()
+		assert.Nil(t, err)
+		return m.Topic, string(value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for a message to be produced")
+		return "", ""
+	}
+}
+
+func (p *testPipeline) send(t *testing.T, port int, payload string) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(payload))
+	assert.Nil(t, err)
+}
+
+func (p *testPipeline) readFile(t *testing.T, topic string) string {
+	data, err := ioutil.ReadFile(p.dir + "/" + topic + ".log")
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestPipeline(t *testing.T) {
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	assert.Nil(t, p.Start())
+
+	p.send(t, p.syslog.listener.Port(), `<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:1234[9103]: {"service":"foobar","level":"ERROR","msg":"Hello from syslog"}`)
+	syslogTopic, syslogValue := p.waitProduced(t)
+	p.send(t, p.graylog.listener.Port(), `{"version":"1.1","host":"web-1","short_message":"Hello from gelf","level":6}`)
+	gelfTopic, gelfValue := p.waitProduced(t)
+
+	p.Stop()
+
+	assert.Equal(t, "test.foobar", syslogTopic)
+	assert.Equal(t, "test.default", gelfTopic)
+
+	assert.Contains(t, syslogValue, `"msg":"Hello from syslog"`)
+	assert.Contains(t, syslogValue, `"host":"relay-1"`)
+	assert.Contains(t, gelfValue, `Hello from gelf`)
+
+	assert.Equal(t, int64(1), p.statsd.Counter("logs2kafka.produced,topic=test.foobar"))
+	assert.Equal(t, int64(1), p.statsd.Counter("logs2kafka.produced,topic=test.default"))
+	assert.Equal(t, int64(1), p.statsd.Counter("app.log.messages,service=foobar,level=ERROR"))
+
+	assert.Equal(t, syslogValue+"\n", p.readFile(t, "test.foobar"))
+	assert.Equal(t, gelfValue+"\n", p.readFile(t, "test.default"))
+
+	assert.Equal(t, PipelineCounts{Received: 2, Forwarded: 2}, p.Counts())
+	assert.Equal(t, map[string]int64{"kafka": 0, "file": 0}, p.QueueDepth())
+}
+
+func TestPipelineIdentityField(t *testing.T) {
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	p.IdentityField = "tls_client"
+	assert.Nil(t, p.Start())
+
+	// The inputs which don't verify their senders can't set the identity
+	p.send(t, p.syslog.listener.Port(), `<27>Aug  7 18:33:19 HOSTNAME docker/foobar/id/registry:5000/foobar:1234[9103]: {"service":"foobar","msg":"udp","tls_client":"spoofed"}`)
+	_, syslogValue := p.waitProduced(t)
+	p.send(t, p.graylog.listener.Port(), `{"version":"1.1","host":"web-1","short_message":"gelf","_service":"foobar","tls_client":"spoofed"}`)
+	_, gelfValue := p.waitProduced(t)
+
+	verified := JSONToMessage(`{"service":"foobar","msg":"tls","tls_client":"web-1.example.com"}`)
+	verified.Identity = "web-1.example.com"
+	p.Send(verified)
+	_, verifiedValue := p.waitProduced(t)
+
+	p.Stop()
+
+	assert.NotContains(t, syslogValue, "tls_client")
+	assert.NotContains(t, gelfValue, "tls_client")
+	assert.Contains(t, verifiedValue, `"tls_client":"web-1.example.com"`)
+}
+
+func TestPipelineProcessors(t *testing.T) {
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	p.Sampler = NewSampler(map[string]float64{"DEBUG": 0}, nil, "")
+	p.Dedup = NewDeduplicator(10 * time.Millisecond)
+	p.Truncator = &Truncator{MaxSize: 400}
+	assert.Nil(t, p.Start())
+
+	port := p.syslog.listener.Port()
+	p.send(t, port, `<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:1234[9103]: {"service":"foobar","level":"DEBUG","msg":"Sampled out"}`)
+	for i := 0; i < 3; i++ {
+		p.send(t, port, `<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:1234[9103]: {"service":"foobar","level":"INFO","msg":"Repeated"}`)
+		time.Sleep(time.Millisecond)
+	}
+	p.send(t, port, `<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:1234[9103]: {"service":"foobar","level":"INFO","msg":"`+strings.Repeat("long ", 200)+`"}`)
+
+	_, first := p.waitProduced(t)
+	_, long := p.waitProduced(t)
+
+	// The summary of the repeats is sent when the window has expired
+	_, summary := p.waitProduced(t)
+	p.Stop()
+
+	assert.Contains(t, first, `"msg":"Repeated"`)
+	assert.True(t, len(long) < 500, long)
+	assert.Contains(t, summary, `"repeat_count":2`)
+
+	assert.Equal(t, PipelineCounts{Received: 5, SampledOut: 1, Deduplicated: 2, Truncated: 1, Forwarded: 2}, p.Counts())
+	assert.Equal(t, 3, strings.Count(p.readFile(t, "test.foobar"), "\n"))
+}
+
+func TestPipelineDockerRouting(t *testing.T) {
+	block := make(chan bool)
+	socket, _, stop := startFakeDocker(t, block)
+	defer stop()
+
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	p.Docker = NewDockerEnricher(socket)
+	assert.Nil(t, p.Start())
+
+	// The labels of the container would route it by its kubernetes
+	// container name, but the topic must not change once they are known
+	send := func() (string, string) {
+		m := JSONToMessage(`{"msg":"hello","container_id":"de57c44274f6","container_name":"web"}`)
+		p.Send(m)
+		return p.waitProduced(t)
+	}
+	before, _ := send()
+	close(block)
+	p.Docker.lookups.Wait()
+	after, value := send()
+
+	p.Stop()
+
+	assert.Equal(t, "test.web", before)
+	assert.Equal(t, "test.web", after)
+	assert.Contains(t, value, `"_io.kubernetes.container.name":"ads-auction-comet-source-adapter"`)
+}
+
+func TestPipelineStopFlushesDedup(t *testing.T) {
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	p.Dedup = NewDeduplicator(time.Hour)
+	assert.Nil(t, p.Start())
+
+	for i := 0; i < 3; i++ {
+		m := JSONToMessage(`{"service":"foobar","level":"ERROR","msg":"Repeated"}`)
+		p.Send(m)
+	}
+	_, first := p.waitProduced(t)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Counts().Deduplicated < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The window is still open when the pipeline is stopped
+	p.Stop()
+	_, summary := p.waitProduced(t)
+
+	assert.Contains(t, first, `"msg":"Repeated"`)
+	assert.Contains(t, summary, `"repeat_count":2`)
+	assert.Contains(t, p.readFile(t, "test.foobar"), `"repeat_count":2`)
+}
+
+func TestPipelineStartError(t *testing.T) {
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	p.Inputs = append(p.Inputs, &Syslog{SocketPath: p.dir + "/missing/dev-log"})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(t, err)
+	p.syslog.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	assert.NotNil(t, p.Start())
+
+	// The inputs which were started have been closed
+	conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: p.syslog.Port})
+	assert.Nil(t, err)
+	conn.Close()
+
+	// Start has already stopped the pipeline
+	p.Stop()
+}
+
+// releasedStatsd blocks the counters until release is closed
+type releasedStatsd struct {
+	testStatsd
+	release chan bool
+}
+
+func (s *releasedStatsd) Inc(name string, value int64, rate float32) error {
+	<-s.release
+	return s.testStatsd.Inc(name, value, rate)
+}
+
+func TestPipelineInputQueue(t *testing.T) {
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	p.Inputs = nil
+	statsd := &releasedStatsd{testStatsd: *newTestStatsd(), release: make(chan bool)}
+	p.Statsd = statsd
+	assert.Nil(t, p.Start())
+
+	// The first message holds up the processing and the rest are queued
+	for i := 0; i < 4; i++ {
+		p.Send(JSONToMessage(`{"service":"foobar","level":"INFO","msg":"queued"}`))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats.Gauge("logs2kafka.queue_depth,queue=input") != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(3), p.Stats.Gauge("logs2kafka.queue_depth,queue=input"))
+
+	// The queued messages are processed before the pipeline stops
+	close(statsd.release)
+	p.Stop()
+	assert.Equal(t, int64(4), p.Counts().Forwarded)
+	assert.Equal(t, 4, strings.Count(p.readFile(t, "test.foobar"), "\n"))
+}
+
+func TestPipelineTopics(t *testing.T) {
+	p := newTestPipeline(t)
+	defer os.RemoveAll(p.dir)
+	p.Topics, _ = NewTopicSanitiser("_", TopicCollisionsKeep, 0)
+	assert.Nil(t, p.Start())
+
+	p.send(t, p.graylog.listener.Port(), `{"version":"1.1","host":"web-1","short_message":"Hello","service":"registry:5000/foo"}`)
+	topic, value := p.waitProduced(t)
+	p.Stop()
+
+	assert.Equal(t, "test.registry_5000_foo", topic)
+	assert.Equal(t, value+"\n", p.readFile(t, "test.registry_5000_foo"))
+	assert.Equal(t, int64(1), p.Stats.Counter("logs2kafka.topic,outcome=sanitised"))
+}
@@ -0,0 +1,62 @@
+package main
+
+// ProtobufEncoder encodes messages as the LogEnvelope message described in
+// logenvelope.proto. The encoding is written by hand as the envelope is
+// simple enough not to warrant generated code.
+type ProtobufEncoder struct{}
+
+const (
+	protobufFieldTimestamp = 1
+	protobufFieldService   = 2
+	protobufFieldLevel     = 3
+	protobufFieldHost      = 4
+	protobufFieldMsg       = 5
+	protobufFieldFields    = 6
+
+	protobufWireTypeBytes = 2
+)
+
+func (e ProtobufEncoder) Encode(m *Message) ([]byte, error) {
+	envelope := newLogEnvelope(m)
+
+	buf := make([]byte, 0, 256)
+	buf = appendProtobufString(buf, protobufFieldTimestamp, envelope.Timestamp)
+	buf = appendProtobufString(buf, protobufFieldService, envelope.Service)
+	buf = appendProtobufString(buf, protobufFieldLevel, envelope.Level)
+	buf = appendProtobufString(buf, protobufFieldHost, envelope.Host)
+	buf = appendProtobufString(buf, protobufFieldMsg, envelope.Msg)
+
+	// map<string, string> is encoded as repeated entry messages with the key
+	// as field 1 and the value as field 2.
+	entry := make([]byte, 0, 64)
+	for _, key := range envelope.Keys {
+		entry = entry[:0]
+		entry = appendProtobufString(entry, 1, key)
+		entry = appendProtobufString(entry, 2, envelope.Fields[key])
+
+		buf = appendProtobufVarint(buf, uint64(protobufFieldFields<<3|protobufWireTypeBytes))
+		buf = appendProtobufVarint(buf, uint64(len(entry)))
+		buf = append(buf, entry...)
+	}
+
+	return buf, nil
+}
+
+func appendProtobufVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// appendProtobufString appends a string field. Empty strings are the
+// default value in proto3 and are left out.
+func appendProtobufString(buf []byte, field int, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	buf = appendProtobufVarint(buf, uint64(field<<3|protobufWireTypeBytes))
+	buf = appendProtobufVarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
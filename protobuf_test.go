@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtobufEncoder(t *testing.T) {
+	m := JSONToMessage(`{"ts":"t","level":"INFO","n":1}`)
+	m.ParseJSON()
+
+	value, err := ProtobufEncoder{}.Encode(&m)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0x0a, 1, 't', // ts
+		0x1a, 4, 'I', 'N', 'F', 'O', // level
+		0x32, 6, 0x0a, 1, 'n', 0x12, 1, '1', // fields entry
+	}, value)
+}
+
+func TestAppendProtobufVarint(t *testing.T) {
+	assert.Equal(t, []byte{0x01}, appendProtobufVarint(nil, 1))
+	assert.Equal(t, []byte{0xac, 0x02}, appendProtobufVarint(nil, 300))
+}
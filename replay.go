@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// TimeRange selects messages by their "ts" field. Zero From or To leaves
+// that end of the range open.
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+func (r TimeRange) IsSet() bool {
+	return !r.From.IsZero() || !r.To.IsZero()
+}
+
+// Contains checks if the message ts is within the range. Messages without a
+// valid ts are only accepted when the range is open on both ends.
+func (r TimeRange) Contains(m *Message) bool {
+	if !r.IsSet() {
+		return true
+	}
+
+	str, ok := m.FieldString("ts")
+	if !ok {
+		return false
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return false
+	}
+
+	if !r.From.IsZero() && ts.Before(r.From) {
+		return false
+	}
+	if !r.To.IsZero() && !ts.Before(r.To) {
+		return false
+	}
+
+	return true
+}
+
+// ParseTimeRange parses the --from and --to options, which are ISO8601
+// timestamps. Both are optional.
+func ParseTimeRange(from string, to string) (TimeRange, error) {
+	r := TimeRange{}
+	var err error
+
+	if from != "" {
+		r.From, err = time.Parse(time.RFC3339Nano, from)
+		if err != nil {
+			return r, fmt.Errorf("Invalid from time: %s", err)
+		}
+	}
+
+	if to != "" {
+		r.To, err = time.Parse(time.RFC3339Nano, to)
+		if err != nil {
+			return r, fmt.Errorf("Invalid to time: %s", err)
+		}
+	}
+
+	return r, nil
+}
+
+// Replayer reads local log files and writes the messages into an output,
+// usually a KafkaProducer, so that Kafka can be backfilled after an outage.
+type Replayer struct {
+	Output Output
+
+	Range TimeRange
+
+	// Maximum number of messages per second, zero for no limit
+	Rate int
+
+	// MarkerField is added to each replayed message with MarkerValue
+	MarkerField string
+	MarkerValue interface{}
+
+	// Number of messages replayed and skipped by Replay
+	Replayed int
+	Skipped  int
+	Invalid  int
+}
+
+// ParseMarker parses the --marker option: "field" marks messages with
+// field=true and "field=value" with the given string value.
+func ParseMarker(str string) (string, interface{}) {
+	if str == "" {
+		return "", nil
+	}
+
+	keyvalue := strings.SplitN(str, "=", 2)
+	if len(keyvalue) == 2 {
+		return keyvalue[0], keyvalue[1]
+	}
+
+	return str, true
+}
+
+// The replay is paced by a ticker, which can't tick more often than this
+const MaxReplayRate = 1000000
+
+// ValidateReplayRate checks the --rate option.
+func ValidateReplayRate(rate int) error {
+	if rate < 0 || rate > MaxReplayRate {
+		return fmt.Errorf("Invalid rate %d, must be between 0 (no limit) and %d messages per second", rate, MaxReplayRate)
+	}
+	return nil
+}
+
+// Replay replays all the files in the given order. The topic of each
+// message is derived from the file name.
+func (r *Replayer) Replay(files []string) error {
+	var ticker *time.Ticker
+	if r.Rate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(r.Rate))
+		defer ticker.Stop()
+	}
+
+	for _, filename := range files {
+		topic := TopicOfLocalLogFile(filename)
+
+		var writeErr error
+		err := ReadLocalLogFile(filename, func(line []byte) bool {
+			m := Message{}
+			m.Data = append([]byte(nil), line...)
+			if m.ParseJSON() != nil {
+				r.Invalid++
+				return true
+			}
+
+			if !r.Range.Contains(&m) {
+				r.Skipped++
+				return true
+			}
+
+			// Messages from the dead-letter files are produced as they were
+			m.Container.Delete("dead_letter")
+
+			if r.MarkerField != "" {
+				m.Container.Set(r.MarkerValue, r.MarkerField)
+			}
+			m.Topic = topic
+			m.Source = "replay"
+			m.ReceivedAt = time.Now()
+
+			if ticker != nil {
+				<-ticker.C
+			}
+
+			writeErr = r.Output.Write(&m)
+			if writeErr != nil {
+				return false
+			}
+			r.Replayed++
+			return true
+		})
+
+		if writeErr != nil {
+			return writeErr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", filename, err)
+		}
+	}
+
+	return nil
+}
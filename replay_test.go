@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeRange(t *testing.T) {
+	r, err := ParseTimeRange("2017-05-19T06:00:00Z", "2017-05-19T07:00:00Z")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"ts":"2017-05-19T06:05:22.037120689Z"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, r.Contains(&m))
+
+	m = JSONToMessage(`{"ts":"2017-05-19T07:00:00Z"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, r.Contains(&m))
+
+	m = JSONToMessage(`{"ts":"2017-05-19T05:59:59Z"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, r.Contains(&m))
+
+	m = JSONToMessage(`{"msg":"no ts"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, r.Contains(&m))
+	assert.Equal(t, true, TimeRange{}.Contains(&m))
+
+	_, err = ParseTimeRange("yesterday", "")
+	assert.NotNil(t, err)
+}
+
+func TestParseMarker(t *testing.T) {
+	field, value := ParseMarker("replayed")
+	assert.Equal(t, "replayed", field)
+	assert.Equal(t, true, value)
+
+	field, value = ParseMarker("replay=outage")
+	assert.Equal(t, "replay", field)
+	assert.Equal(t, "outage", value)
+}
+
+func TestValidateReplayRate(t *testing.T) {
+	assert.Nil(t, ValidateReplayRate(0))
+	assert.Nil(t, ValidateReplayRate(1000))
+	assert.Nil(t, ValidateReplayRate(MaxReplayRate))
+	assert.NotNil(t, ValidateReplayRate(-1))
+	assert.NotNil(t, ValidateReplayRate(2000000000))
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestLogFile(t, dir+"/service.foo-2017-05-19T06-05-22.000.log.gz",
+		"{\"ts\":\"2017-05-19T05:00:00Z\",\"msg\":\"too early\"}\n{\"ts\":\"2017-05-19T06:01:00Z\",\"msg\":\"first\"}\n")
+	writeTestLogFile(t, dir+"/service.foo.log",
+		"{\"ts\":\"2017-05-19T06:10:00Z\",\"msg\":\"second\"}\nnot json\n{\"ts\":\"2017-05-19T08:00:00Z\",\"msg\":\"too late\"}\n")
+
+	files, err := LocalLogFiles(dir, "foo")
+	assert.Nil(t, err)
+
+	output := &testOutput{}
+	r := Replayer{Output: output, Rate: 1000}
+	r.Range, _ = ParseTimeRange("2017-05-19T06:00:00Z", "2017-05-19T07:00:00Z")
+	r.MarkerField, r.MarkerValue = ParseMarker("replayed")
+
+	start := time.Now()
+	err = r.Replay(files)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= time.Millisecond)
+
+	assert.Equal(t, 2, r.Replayed)
+	assert.Equal(t, 2, r.Skipped)
+	assert.Equal(t, 1, r.Invalid)
+
+	assert.Equal(t, 2, len(output.messages))
+	msg, _ := output.messages[0].FieldString("msg")
+	assert.Equal(t, "first", msg)
+	msg, _ = output.messages[1].FieldString("msg")
+	assert.Equal(t, "second", msg)
+
+	assert.Equal(t, "service.foo", output.messages[0].Topic)
+	replayed, _ := output.messages[0].FieldString("replayed")
+	assert.Equal(t, "true", replayed)
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	logs, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logs)
+	dead, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dead)
+
+	writeTestLogFile(t, logs+"/service.foo.log", "{\"msg\":\"local copy\"}\n")
+	writeTestLogFile(t, dead+"/service.foo.dead-letter-2017-05-19T06-05-22.000.log.gz",
+		"{\"msg\":\"first\",\"dead_letter\":{\"reason\":\"timeout\",\"attempts\":3}}\n")
+	writeTestLogFile(t, dead+"/service.foo.dead-letter.log",
+		"{\"msg\":\"second\",\"dead_letter\":{\"reason\":\"timeout\",\"attempts\":3}}\n")
+
+	dir, files, err := DeadLetterLogFiles(dead, logs, "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, dead, dir)
+	assert.Equal(t, []string{
+		dead + "/service.foo.dead-letter-2017-05-19T06-05-22.000.log.gz",
+		dead + "/service.foo.dead-letter.log",
+	}, files)
+
+	output := &testOutput{}
+	r := Replayer{Output: output}
+	assert.Nil(t, r.Replay(files))
+
+	assert.Equal(t, 2, len(output.messages))
+	msg, _ := output.messages[0].FieldString("msg")
+	assert.Equal(t, "first", msg)
+	msg, _ = output.messages[1].FieldString("msg")
+	assert.Equal(t, "second", msg)
+	assert.Equal(t, "service.foo", output.messages[1].Topic)
+	assert.False(t, output.messages[1].HasField("dead_letter"))
+
+	// Without a dead-letter path the files are next to the local copies
+	dir, files, err = DeadLetterLogFiles("", logs, "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, logs, dir)
+	assert.Equal(t, 0, len(files))
+}
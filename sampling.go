@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sampler forwards only a part of the messages. The rate of a message is
+// the rate of its level multiplied with the rate of its service, both
+// defaulting to 1.
+//
+// If KeyField is set, messages which have it are sampled by a hash of its
+// value instead of randomly, so that all lines of eg. one request_id are
+// either kept or dropped together.
+//
+// Forwarded messages get a "sample_rate" field so that downstream counts
+// can be scaled back.
+type Sampler struct {
+	LevelRates map[string]float64
+
+	ServiceRates map[string]float64
+
+	KeyField string
+
+	Statsd StatisticsSender
+
+	random *rand.Rand
+}
+
+func NewSampler(levelRates map[string]float64, serviceRates map[string]float64, keyField string) *Sampler {
+	return &Sampler{
+		LevelRates:   levelRates,
+		ServiceRates: serviceRates,
+		KeyField:     keyField,
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// ParseSampleRates parses a comma delimited list of name=rate pairs, eg.
+// "DEBUG=0.1,INFO=0.5". Rates must be between 0 and 1.
+func ParseSampleRates(str string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		keyvalue := strings.SplitN(part, "=", 2)
+		if len(keyvalue) != 2 || keyvalue[0] == "" {
+			return nil, fmt.Errorf("Invalid sample rate '%s', expected name=rate", part)
+		}
+
+		rate, err := strconv.ParseFloat(keyvalue[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("Invalid sample rate '%s', expected a number between 0 and 1", part)
+		}
+		rates[keyvalue[0]] = rate
+	}
+
+	return rates, nil
+}
+
+// Rate returns the sampling rate of a message.
+func (s *Sampler) Rate(m *Message) float64 {
+	rate := 1.0
+
+	if level, ok := m.FieldString("level"); ok {
+		if r, ok := s.LevelRates[level]; ok {
+			rate *= r
+		}
+	}
+
+	if service, ok := m.FieldString("service"); ok {
+		if r, ok := s.ServiceRates[service]; ok {
+			rate *= r
+		}
+	}
+
+	return rate
+}
+
+// Sample returns false if the message must be dropped. Kept messages are
+// marked with their sample rate.
+func (s *Sampler) Sample(m *Message) bool {
+	if m.ParseFields() != nil {
+		return true
+	}
+
+	rate := s.Rate(m)
+
+	var keep bool
+	if rate >= 1 {
+		keep = true
+	} else if rate <= 0 {
+		keep = false
+	} else if key, ok := m.FieldString(s.KeyField); s.KeyField != "" && ok {
+		keep = hashFraction(key) < rate
+	} else {
+		keep = s.random.Float64() < rate
+	}
+
+	if !keep {
+		if s.Statsd != nil {
+			service, _ := m.FieldString("service")
+			level, _ := m.FieldString("level")
+			s.Statsd.Inc(fmt.Sprintf("logs2kafka.sampled_out,service=%s,level=%s", service, level), 1, 0.1)
+		}
+		return false
+	}
+
+	m.SetField("sample_rate", rate)
+	return true
+}
+
+// hashFraction maps a string evenly into [0, 1)
+func hashFraction(key string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return float64(h.Sum32()) / (math.MaxUint32 + 1.0)
+}
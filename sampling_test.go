@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSampleRates(t *testing.T) {
+	rates, err := ParseSampleRates("DEBUG=0.1, INFO=1")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{"DEBUG": 0.1, "INFO": 1}, rates)
+
+	rates, err = ParseSampleRates("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rates))
+
+	_, err = ParseSampleRates("DEBUG=2")
+	assert.NotNil(t, err)
+	_, err = ParseSampleRates("DEBUG")
+	assert.NotNil(t, err)
+	_, err = ParseSampleRates("DEBUG=foo")
+	assert.NotNil(t, err)
+}
+
+func sampleTestMessage(json string) *Message {
+	m := JSONToMessage(json)
+	m.ParseJSON()
+	return &m
+}
+
+func TestSamplerRate(t *testing.T) {
+	s := NewSampler(map[string]float64{"DEBUG": 0.1}, map[string]float64{"foo": 0.5}, "")
+
+	assert.Equal(t, 0.1, s.Rate(sampleTestMessage(`{"service":"bar","level":"DEBUG"}`)))
+	assert.Equal(t, 0.05, s.Rate(sampleTestMessage(`{"service":"foo","level":"DEBUG"}`)))
+	assert.Equal(t, 0.5, s.Rate(sampleTestMessage(`{"service":"foo","level":"INFO"}`)))
+	assert.Equal(t, 1.0, s.Rate(sampleTestMessage(`{"service":"bar","level":"INFO"}`)))
+}
+
+func TestSamplerSample(t *testing.T) {
+	statsd := newTestStatsd()
+	s := NewSampler(map[string]float64{"DEBUG": 0.1, "TRACE": 0}, nil, "")
+	s.Statsd = statsd
+
+	m := sampleTestMessage(`{"service":"bar","level":"INFO"}`)
+	assert.Equal(t, true, s.Sample(m))
+	value, _ := m.FieldString("sample_rate")
+	assert.Equal(t, "1", value)
+
+	assert.Equal(t, false, s.Sample(sampleTestMessage(`{"service":"bar","level":"TRACE"}`)))
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		m := sampleTestMessage(`{"service":"bar","level":"DEBUG"}`)
+		if s.Sample(m) {
+			kept++
+			value, _ := m.FieldString("sample_rate")
+			assert.Equal(t, "0.1", value)
+		}
+	}
+	assert.InDelta(t, 1000, kept, 200)
+	assert.Equal(t, int64(10000-kept), statsd.Counter("logs2kafka.sampled_out,service=bar,level=DEBUG"))
+}
+
+func TestSamplerKeyField(t *testing.T) {
+	s := NewSampler(map[string]float64{"DEBUG": 0.5}, nil, "request_id")
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		json := fmt.Sprintf(`{"service":"bar","level":"DEBUG","request_id":"%d"}`, i)
+		first := s.Sample(sampleTestMessage(json))
+		// All lines of the same request are either kept or dropped
+		for j := 0; j < 5; j++ {
+			assert.Equal(t, first, s.Sample(sampleTestMessage(json)))
+		}
+		if first {
+			kept++
+		}
+	}
+	assert.InDelta(t, 500, kept, 100)
+}
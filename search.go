@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SearchQuery selects messages from the local log files for the search
+// command. Unset criteria match every message.
+type SearchQuery struct {
+	Range TimeRange
+
+	// Accepted levels, empty accepts all
+	Levels []string
+
+	// Field equality conditions
+	Filter *Filter
+
+	// Pattern is matched against the msg field
+	Pattern *regexp.Regexp
+}
+
+// NewSearchQuery builds a query from the search command options. Levels is
+// a comma delimited list and fields are "field=value" pairs.
+func NewSearchQuery(timeRange TimeRange, levels string, fields []string, pattern string) (*SearchQuery, error) {
+	q := &SearchQuery{Range: timeRange}
+
+	if levels != "" {
+		for _, level := range strings.Split(levels, ",") {
+			q.Levels = append(q.Levels, strings.ToUpper(strings.TrimSpace(level)))
+		}
+	}
+
+	// The values are used as is, so they can contain "," and "!=" which
+	// have a meaning in the filter syntax
+	q.Filter = &Filter{}
+	for _, field := range fields {
+		keyvalue := strings.SplitN(field, "=", 2)
+		if len(keyvalue) != 2 || keyvalue[0] == "" {
+			return nil, fmt.Errorf("Invalid field condition '%s', expected field=value", field)
+		}
+		q.Filter.conditions = append(q.Filter.conditions, filterCondition{field: keyvalue[0], value: keyvalue[1]})
+	}
+
+	var err error
+	if pattern != "" {
+		q.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression: %s", err)
+		}
+	}
+
+	return q, nil
+}
+
+func (q *SearchQuery) Match(m *Message) bool {
+	if !q.Range.Contains(m) {
+		return false
+	}
+
+	if len(q.Levels) > 0 {
+		level, _ := m.FieldString("level")
+		found := false
+		for _, l := range q.Levels {
+			if l == level {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.Filter != nil && !q.Filter.Match(m) {
+		return false
+	}
+
+	if q.Pattern != nil {
+		msg, _ := m.FieldString("msg")
+		if !q.Pattern.MatchString(msg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Search scans the files in order and calls fn with each matching line.
+// The files are expected to be in chronological order as returned by
+// LocalLogFiles. Errors reading individual files are passed to onError and
+// the search continues with the next file.
+func (q *SearchQuery) Search(files []string, fn func(line string), onError func(filename string, err error)) {
+	for _, filename := range files {
+		err := ReadLocalLogFile(filename, func(line []byte) bool {
+			m := Message{}
+			m.Data = line
+			if m.ParseJSON() != nil {
+				return true
+			}
+
+			if q.Match(&m) {
+				fn(string(line))
+			}
+			return true
+		})
+
+		if err != nil && onError != nil {
+			onError(filename, err)
+		}
+	}
+}
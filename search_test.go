@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchQuery(t *testing.T) {
+	q, err := NewSearchQuery(TimeRange{}, "warn,ERROR", []string{"container_id=abc"}, "^conn")
+	assert.Nil(t, err)
+
+	m := JSONToMessage(`{"level":"ERROR","container_id":"abc","msg":"connection refused"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, q.Match(&m))
+
+	m = JSONToMessage(`{"level":"INFO","container_id":"abc","msg":"connection refused"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, q.Match(&m))
+
+	m = JSONToMessage(`{"level":"WARN","container_id":"def","msg":"connection refused"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, q.Match(&m))
+
+	m = JSONToMessage(`{"level":"WARN","container_id":"abc","msg":"refused connection"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, q.Match(&m))
+
+	// Values can contain the separators of the filter syntax
+	q, err = NewSearchQuery(TimeRange{}, "", []string{"msg=a,b!=c", "service=foo"}, "")
+	assert.Nil(t, err)
+
+	m = JSONToMessage(`{"service":"foo","msg":"a,b!=c"}`)
+	m.ParseJSON()
+	assert.Equal(t, true, q.Match(&m))
+
+	m = JSONToMessage(`{"service":"foo","msg":"a"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, q.Match(&m))
+
+	_, err = NewSearchQuery(TimeRange{}, "", []string{"container_id"}, "")
+	assert.NotNil(t, err)
+
+	_, err = NewSearchQuery(TimeRange{}, "", nil, "(")
+	assert.NotNil(t, err)
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestLogFile(t, dir+"/service.foo-2017-05-18T06-05-22.000.log.gz",
+		"{\"ts\":\"2017-05-18T06:00:00Z\",\"level\":\"ERROR\",\"msg\":\"oldest\"}\n")
+	writeTestLogFile(t, dir+"/service.foo-2017-05-19T06-05-22.000.log",
+		"{\"ts\":\"2017-05-19T06:00:00Z\",\"level\":\"INFO\",\"msg\":\"info\"}\n{\"ts\":\"2017-05-19T06:01:00Z\",\"level\":\"ERROR\",\"msg\":\"older\"}\n")
+	writeTestLogFile(t, dir+"/service.foo.log",
+		"{\"ts\":\"2017-05-20T06:00:00Z\",\"level\":\"ERROR\",\"msg\":\"newest\"}\n")
+
+	files, err := LocalLogFiles(dir, "foo")
+	assert.Nil(t, err)
+
+	q, err := NewSearchQuery(TimeRange{}, "ERROR", nil, "")
+	assert.Nil(t, err)
+
+	lines := []string{}
+	q.Search(files, func(line string) {
+		lines = append(lines, FormatLocalLogLine(line, false))
+	}, nil)
+
+	assert.Equal(t, []string{
+		"2017-05-18T06:00:00Z ERROR oldest",
+		"2017-05-19T06:01:00Z ERROR older",
+		"2017-05-20T06:00:00Z ERROR newest",
+	}, lines)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats collects the internal metrics of the relay itself: packets and
+// bytes received per input, parse failures, GELF chunks, queue depths,
+// local file writes and produce outcomes. The hot paths only increment
+// atomic counters; Publish sends the counters as deltas since the previous
+// publish and the gauges as their current values.
+//
+// A nil *Stats ignores all updates, so the components don't need to check
+// whether the metrics are enabled.
+type Stats struct {
+	mutex     sync.RWMutex
+	counters  map[string]*int64
+	published map[string]int64
+	gauges    map[string]*int64
+	gaugeFns  map[string]func() int64
+
+	close chan bool
+	done  sync.WaitGroup
+}
+
+const DefaultStatsInterval = 10 * time.Second
+
+func NewStats() *Stats {
+	return &Stats{
+		counters:  make(map[string]*int64),
+		published: make(map[string]int64),
+		gauges:    make(map[string]*int64),
+		gaugeFns:  make(map[string]func() int64),
+	}
+}
+
+func (s *Stats) value(values map[string]*int64, name string) *int64 {
+	s.mutex.RLock()
+	v, ok := values[name]
+	s.mutex.RUnlock()
+	if ok {
+		return v
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok = values[name]
+	if !ok {
+		v = new(int64)
+		values[name] = v
+	}
+	return v
+}
+
+// Add increments a counter, eg. Add("logs2kafka.input.packets,input=gelf", 1)
+func (s *Stats) Add(name string, value int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(s.value(s.counters, name), value)
+}
+
+// SetGauge sets the current value of a gauge.
+func (s *Stats) SetGauge(name string, value int64) {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(s.value(s.gauges, name), value)
+}
+
+// AddGauge changes the current value of a gauge by delta.
+func (s *Stats) AddGauge(name string, delta int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(s.value(s.gauges, name), delta)
+}
+
+// GaugeFunc registers a gauge which is read when the metrics are
+// published, eg. the length of a queue.
+func (s *Stats) GaugeFunc(name string, f func() int64) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.gaugeFns[name] = f
+	s.mutex.Unlock()
+}
+
+// Counter returns the total value of a counter.
+func (s *Stats) Counter(name string) int64 {
+	if s == nil {
+		return 0
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if v, ok := s.counters[name]; ok {
+		return atomic.LoadInt64(v)
+	}
+	return 0
+}
+
+// Gauge returns the current value of a gauge.
+func (s *Stats) Gauge(name string) int64 {
+	if s == nil {
+		return 0
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if v, ok := s.gauges[name]; ok {
+		return atomic.LoadInt64(v)
+	}
+	if f, ok := s.gaugeFns[name]; ok {
+		return f()
+	}
+	return 0
+}
+
+// Publish sends the counters which have changed since the previous
+// publish and all gauges. The values are read under the lock and sent after
+// releasing it, so that a slow statsd client doesn't block the hot paths.
+func (s *Stats) Publish(statsd StatisticsSender) {
+	if s == nil || statsd == nil {
+		return
+	}
+
+	type gaugeFn struct {
+		name string
+		f    func() int64
+	}
+
+	s.mutex.Lock()
+	counters := make(map[string]int64)
+	for name, v := range s.counters {
+		total := atomic.LoadInt64(v)
+		if delta := total - s.published[name]; delta != 0 {
+			counters[name] = delta
+			s.published[name] = total
+		}
+	}
+
+	gauges := make(map[string]int64, len(s.gauges))
+	for name, v := range s.gauges {
+		gauges[name] = atomic.LoadInt64(v)
+	}
+
+	fns := make([]gaugeFn, 0, len(s.gaugeFns))
+	for name, f := range s.gaugeFns {
+		fns = append(fns, gaugeFn{name: name, f: f})
+	}
+	s.mutex.Unlock()
+
+	for _, name := range sortedNames(counters) {
+		statsd.Inc(name, counters[name], 1)
+	}
+
+	for _, name := range sortedNames(gauges) {
+		statsd.Gauge(name, gauges[name], 1)
+	}
+
+	sort.Slice(fns, func(i, j int) bool { return fns[i].name < fns[j].name })
+	for _, fn := range fns {
+		statsd.Gauge(fn.name, fn.f(), 1)
+	}
+}
+
+func sortedNames(values map[string]int64) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start publishes the metrics every interval until Stop is called.
+func (s *Stats) Start(statsd StatisticsSender, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultStatsInterval
+	}
+	s.close = make(chan bool)
+
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.close:
+				s.Publish(statsd)
+				return
+			case <-ticker.C:
+				s.Publish(statsd)
+			}
+		}
+	}()
+}
+
+// Stop publishes the final values and stops the publishing.
+func (s *Stats) Stop() {
+	close(s.close)
+	s.done.Wait()
+}
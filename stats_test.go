@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsPublish(t *testing.T) {
+	stats := NewStats()
+	statsd := newTestStatsd()
+
+	stats.Add("logs2kafka.input.packets,input=syslog", 2)
+	stats.Add("logs2kafka.input.packets,input=syslog", 1)
+	stats.SetGauge("logs2kafka.gelf.chunks_pending", 5)
+	stats.AddGauge("logs2kafka.gelf.chunks_pending", -2)
+	depth := int64(7)
+	stats.GaugeFunc("logs2kafka.queue_depth,queue=kafka", func() int64 { return depth })
+
+	assert.Equal(t, int64(3), stats.Counter("logs2kafka.input.packets,input=syslog"))
+	assert.Equal(t, int64(3), stats.Gauge("logs2kafka.gelf.chunks_pending"))
+	assert.Equal(t, int64(7), stats.Gauge("logs2kafka.queue_depth,queue=kafka"))
+
+	stats.Publish(statsd)
+	assert.Equal(t, int64(3), statsd.Counter("logs2kafka.input.packets,input=syslog"))
+	value, _ := statsd.GaugeValue("logs2kafka.gelf.chunks_pending")
+	assert.Equal(t, int64(3), value)
+	value, _ = statsd.GaugeValue("logs2kafka.queue_depth,queue=kafka")
+	assert.Equal(t, int64(7), value)
+
+	// Counters are sent as the delta since the previous publish
+	stats.Add("logs2kafka.input.packets,input=syslog", 4)
+	depth = 0
+	stats.Publish(statsd)
+	assert.Equal(t, int64(7), statsd.Counter("logs2kafka.input.packets,input=syslog"))
+	value, _ = statsd.GaugeValue("logs2kafka.queue_depth,queue=kafka")
+	assert.Equal(t, int64(0), value)
+}
+
+// blockingStatsd blocks the counters and gauges until release is closed
+type blockingStatsd struct {
+	testStatsd
+	sending chan bool
+	release chan bool
+}
+
+func (s *blockingStatsd) Inc(name string, value int64, rate float32) error {
+	s.sending <- true
+	<-s.release
+	return s.testStatsd.Inc(name, value, rate)
+}
+
+func (s *blockingStatsd) Gauge(name string, value int64, rate float32) error {
+	s.sending <- true
+	<-s.release
+	return s.testStatsd.Gauge(name, value, rate)
+}
+
+func TestStatsPublishDoesntBlockUpdates(t *testing.T) {
+	stats := NewStats()
+	statsd := &blockingStatsd{testStatsd: *newTestStatsd(), sending: make(chan bool, 1), release: make(chan bool)}
+
+	stats.Add("logs2kafka.input.packets,input=syslog", 1)
+	published := make(chan bool)
+	go func() {
+		stats.Publish(statsd)
+		close(published)
+	}()
+	<-statsd.sending
+
+	// A new counter takes the write lock while the publish is still sending
+	added := make(chan bool)
+	go func() {
+		stats.Add("logs2kafka.input.packets,input=gelf", 1)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add was blocked by Publish")
+	}
+
+	close(statsd.release)
+	<-published
+	assert.Equal(t, int64(1), statsd.Counter("logs2kafka.input.packets,input=syslog"))
+}
+
+func TestStatsNil(t *testing.T) {
+	var stats *Stats
+	stats.Add("foo", 1)
+	stats.SetGauge("bar", 1)
+	stats.Publish(newTestStatsd())
+	assert.Equal(t, int64(0), stats.Counter("foo"))
+}
+
+func TestSyslogStats(t *testing.T) {
+	s := Syslog{Messages: make(chan Message, 1), Stats: NewStats()}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 514}
+
+	packet := []byte("<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:12341234[9103]: Hello")
+	s.HandlePacket(packet, addr)
+	s.HandlePacket([]byte("foo bar"), addr)
+	s.HandlePacket([]byte("<30>foo"), addr)
+	s.HandlePacket([]byte{}, addr)
+
+	assert.Equal(t, int64(4), s.Stats.Counter("logs2kafka.input.packets,input=syslog"))
+	assert.Equal(t, int64(len(packet)+7+7), s.Stats.Counter("logs2kafka.input.bytes,input=syslog"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.messages,input=syslog"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.parse_errors,input=syslog,reason=priority"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.parse_errors,input=syslog,reason=header"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.parse_errors,input=syslog,reason=empty"))
+}
+
+func TestSyslogParseErrorReason(t *testing.T) {
+	reason := func(line string) string {
+		_, err := ParseGenericSyslogMessage([]byte(line))
+		return SyslogParseErrorReason(err)
+	}
+
+	assert.Equal(t, "priority", reason("foo bar"))
+	assert.Equal(t, "priority", reason("<1234567>foo"))
+	assert.Equal(t, "priority", reason("<>foo"))
+	assert.Equal(t, "priority", reason("<3x>foo"))
+	assert.Equal(t, "priority", reason("<34"))
+	assert.Equal(t, "header", reason("<34>1 2003-10-11T22:14:15.003Z host"))
+	assert.Equal(t, "header", reason("<34>1 2003-10-11T22:14:15.003Z host su - ID47 [broken"))
+
+	_, err := ParseSyslogMessage([]byte{})
+	assert.Equal(t, "empty", SyslogParseErrorReason(err))
+	_, err = ParseSyslogMessage([]byte("<30>foo"))
+	assert.Equal(t, "header", SyslogParseErrorReason(err))
+	assert.Equal(t, "other", SyslogParseErrorReason(errors.New("Priority")))
+}
+
+func TestGraylogStats(t *testing.T) {
+	s := Graylog{Messages: make(chan Message, 1), Stats: NewStats()}
+	s.ReceivedChunks = make(map[string]*Chunk)
+
+	s.ParseGraylogMessage([]byte("{\"short_message\":\"hello\"}"))
+	s.ParseGraylogMessage([]byte("{broken"))
+	s.ParseGraylogMessage([]byte("foo"))
+	s.ParseGraylogMessage([]byte("\x1e\x0f\x00\x00\x00\x00\xDE\xAD\xBE\xEF\x00\x02{\"test\":"))
+
+	assert.Equal(t, int64(4), s.Stats.Counter("logs2kafka.input.packets,input=gelf"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.messages,input=gelf"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.parse_errors,input=gelf,reason=json"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.parse_errors,input=gelf,reason=format"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.gelf.chunks"))
+	assert.Equal(t, int64(1), s.Stats.Gauge("logs2kafka.gelf.chunks_pending"))
+
+	for _, c := range s.ReceivedChunks {
+		c.Expiration = 0
+	}
+	s.RunCleanup()
+	assert.Equal(t, int64(0), s.Stats.Gauge("logs2kafka.gelf.chunks_pending"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.gelf.chunks_expired"))
+}
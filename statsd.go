@@ -18,14 +18,14 @@ type StatisticsSender interface {
 
 func SendStatsdMetricsFromMessage(statsd StatisticsSender, m *Message) error {
 
-	service, ok := m.Container.Path("service").Data().(string)
-	if !ok {
+	service, err := m.GetString("service")
+	if err != nil {
 		statsd.Inc("logs2kafka.unknown_service", 1, 1)
 		return nil
 	}
 
-	level, ok := m.Container.Path("level").Data().(string)
-	if ok {
+	level, err := m.GetString("level")
+	if err == nil {
 		if level == "DEBUG" {
 			statsd.Inc(fmt.Sprintf("app.log.messages,service=%s,level=DEBUG", service), 1, 0.1)
 		} else {
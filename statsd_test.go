@@ -2,7 +2,9 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestStatsd(t *testing.T) {
@@ -12,3 +14,79 @@ func TestStatsd(t *testing.T) {
 	assert.Nil(t, nil)
 
 }
+
+// testStatsd records the counters which are incremented, the last value of
+// each gauge and the number of timings
+type testStatsd struct {
+	mutex    sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+	timings  map[string]int64
+}
+
+func newTestStatsd() *testStatsd {
+	return &testStatsd{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+		timings:  make(map[string]int64),
+	}
+}
+
+func (s *testStatsd) GaugeValue(name string) (int64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.gauges[name]
+	return value, ok
+}
+
+func (s *testStatsd) Timings(name string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.timings[name]
+}
+
+func (s *testStatsd) Counter(name string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.counters[name]
+}
+
+func (s *testStatsd) Inc(name string, value int64, rate float32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counters[name] += value
+	return nil
+}
+
+func (s *testStatsd) Dec(name string, value int64, rate float32) error {
+	return s.Inc(name, -value, rate)
+}
+
+func (s *testStatsd) Gauge(name string, value int64, rate float32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gauges[name] = value
+	return nil
+}
+
+func (s *testStatsd) GaugeDelta(name string, value int64, rate float32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gauges[name] += value
+	return nil
+}
+
+func (s *testStatsd) Timing(name string, value int64, rate float32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timings[name]++
+	return nil
+}
+
+func (s *testStatsd) TimingDuration(name string, value time.Duration, rate float32) error {
+	return s.Timing(name, int64(value/time.Millisecond), rate)
+}
+
+func (s *testStatsd) Set(string, string, float32) error                   { return nil }
+func (s *testStatsd) SetInt(string, int64, float32) error                 { return nil }
+func (s *testStatsd) Raw(string, string, float32) error                   { return nil }
@@ -5,81 +5,188 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/Jeffail/gabs"
 )
 
 type StringWriter interface {
 	WriteString(string) (int, error)
 }
 
+// The syslog input reads at most this many bytes of a packet
+const maxSyslogPacketSize = 9000
+
 type Syslog struct {
 	Port int
 
+	// Address to bind, eg. "127.0.0.1" or "::1". Empty binds all interfaces.
+	BindAddress string
+
 	Messages chan Message
 
-	close chan bool
+	// Number of goroutines reading the port, each with its own
+	// SO_REUSEPORT socket if there are more than one
+	Readers int
+
+	listener *UDPListener
+
+	// Unix datagram socket where local programs can log, eg. /dev/log.
+	// Empty to only listen to the port.
+	SocketPath string
+
+	socket *UnixgramListener
 
 	Statsd StatisticsSender
+
+	// Stats counts the received packets and parse failures, can be nil
+	Stats *Stats
+
+	// ACL limits the senders which are accepted, nil accepts all
+	ACL *ACL
+
+	// Fields where the sender address is stored
+	SourceFields SourceFields
+}
+
+// Start listens to Port and sends the messages into messages.
+func (s *Syslog) Start(messages chan Message) error {
+	s.Messages = messages
+	return s.Init(s.Port)
 }
 
 func (s *Syslog) Init(port int) error {
 	s.Port = port
-	s.close = make(chan bool)
 
-	ServerAddr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(port))
+	ServerAddr, err := ResolveListenAddr(s.BindAddress, port)
 	if err != nil {
 		return err
 	}
 
-	ServerConn, err := net.ListenUDP("udp", ServerAddr)
+	s.listener = &UDPListener{
+		Addr:       ServerAddr,
+		Readers:    s.Readers,
+		BufferSize: maxSyslogPacketSize,
+		Handle: func(buffer []byte, addr *net.UDPAddr) {
+			if s.Messages != nil {
+				s.HandlePacket(buffer, addr)
+			}
+		},
+	}
+
+	err = s.listener.Start()
 	if err != nil {
 		return err
 	}
 
-	buf := make([]byte, 9000)
-
-	go func() {
-		for {
-			select {
-			case val, ok := <-s.close:
-				if val == true || ok == false {
-					return
-				}
-				break
-			default:
-
-				ServerConn.SetDeadline(time.Now().Add(time.Millisecond * 100))
-				n, _, err := ServerConn.ReadFromUDP(buf)
-
-				if s.Messages != nil && err == nil {
-
-					msg, err := ParseSyslogMessage(buf[0:n])
-					if err == nil {
-						s.Messages <- msg
-					} else {
-						if s.Statsd != nil {
-							s.Statsd.Inc("logs2kafka.invalid_messages", 1, 0.1)
-						}
-						fmt.Fprintf(os.Stderr, "Error parsing json message: %s\n", err)
-					}
+	if s.SocketPath != "" {
+		s.socket = &UnixgramListener{
+			Path:       s.SocketPath,
+			BufferSize: maxSyslogPacketSize,
+			Handle: func(buffer []byte) {
+				if s.Messages != nil {
+					s.HandleLocalPacket(buffer)
 				}
-			}
+			},
 		}
-	}()
+		err = s.socket.Start()
+		if err != nil {
+			s.listener.Close()
+			return err
+		}
+	}
 
 	return nil
+}
+
+// HandlePacket parses a syslog packet received from addr and sends the
+// message forward, unless the ACL rejects the sender.
+func (s *Syslog) HandlePacket(buffer []byte, addr *net.UDPAddr) {
+	s.Stats.Add("logs2kafka.input.packets,input=syslog", 1)
+	s.Stats.Add("logs2kafka.input.bytes,input=syslog", int64(len(buffer)))
+
+	if addr != nil && !s.ACL.Allowed(addr.IP) {
+		if s.Statsd != nil {
+			s.Statsd.Inc("logs2kafka.rejected_packets,input=syslog", 1, 1)
+		}
+		return
+	}
+
+	msg, err := ParseSyslogMessage(buffer)
+	if err == nil {
+		msg.Source = "syslog"
+		msg.ReceivedAt = time.Now()
+		s.SourceFields.Set(&msg, addr)
+		s.Stats.Add("logs2kafka.input.messages,input=syslog", 1)
+		s.Messages <- msg
+	} else {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=syslog,reason="+SyslogParseErrorReason(err), 1)
+		if s.Statsd != nil {
+			s.Statsd.Inc("logs2kafka.invalid_messages", 1, 0.1)
+		}
+		fmt.Fprintf(os.Stderr, "Error parsing json message: %s\n", err)
+	}
+}
+
+// HandleLocalPacket parses a packet received from the unix socket and
+// sends the message forward.
+func (s *Syslog) HandleLocalPacket(buffer []byte) {
+	s.Stats.Add("logs2kafka.input.packets,input=socket", 1)
+	s.Stats.Add("logs2kafka.input.bytes,input=socket", int64(len(buffer)))
+
+	msg, err := ParseGenericSyslogMessage(buffer)
+	if err == nil {
+		msg.Source = "syslog"
+		msg.ReceivedAt = time.Now()
+		s.Stats.Add("logs2kafka.input.messages,input=socket", 1)
+		s.Messages <- msg
+	} else {
+		s.Stats.Add("logs2kafka.input.parse_errors,input=socket,reason="+SyslogParseErrorReason(err), 1)
+		if s.Statsd != nil {
+			s.Statsd.Inc("logs2kafka.invalid_messages", 1, 0.1)
+		}
+		fmt.Fprintf(os.Stderr, "Error parsing syslog message: %s\n", err)
+	}
+}
 
+// SyslogParseErrorReason classifies the errors of ParseSyslogMessage for
+// the parse_errors metric.
+func SyslogParseErrorReason(err error) string {
+	switch err {
+	case errEmptyPacket:
+		return "empty"
+	case errNoPriorityStart, errPriorityTooLong, errPriorityTooShort, errPriorityNotDigit, errNoPriorityEnd:
+		return "priority"
+	case errMalformedISO8601Tags, errMalformedLegacyHeader, errMalformedLegacyTags,
+		errRFC5424HeaderTooShort, errRFC5424StructuredData:
+		return "header"
+	}
+	return "other"
 }
 
 func (s *Syslog) Close() {
-	s.close <- true
+	s.listener.Close()
+	if s.socket != nil {
+		s.socket.Close()
+	}
 }
 
+var (
+	errEmptyPacket = errors.New("Empty packet")
+
+	errNoPriorityStart  = errors.New("No priority start character")
+	errPriorityTooLong  = errors.New("No priority end character or priority too long")
+	errPriorityTooShort = errors.New("Priority too short")
+	errPriorityNotDigit = errors.New("Priority was not valid digit")
+	errNoPriorityEnd    = errors.New("No end found")
+
+	errMalformedISO8601Tags  = errors.New("Malformed input on phase 2, assuming ISO8601 date format")
+	errMalformedLegacyHeader = errors.New("Malformed input on phase 1, assuming legacy date format")
+	errMalformedLegacyTags   = errors.New("Malformed input on phase 2, assuming legacy date format")
+	errRFC5424HeaderTooShort = errors.New("Malformed input, RFC 5424 header is too short")
+	errRFC5424StructuredData = errors.New("Malformed input, invalid RFC 5424 structured data")
+)
+
 type Priority struct {
 	Priority int
 	Facility int
@@ -108,30 +215,30 @@ func ExtractPriority(buffer []byte, cursor *int, l int) (Priority, error) {
 	priority := Priority{}
 
 	// Skip numbers and spaces before priority
-	for (buffer[*cursor] >= '0' && buffer[*cursor] <= '9') || buffer[*cursor] == ' ' {
+	for *cursor < l && ((buffer[*cursor] >= '0' && buffer[*cursor] <= '9') || buffer[*cursor] == ' ') {
 		*cursor = *cursor + 1
 	}
 
-	if buffer[*cursor] != '<' {
-		return priority, errors.New("No priority start character")
+	if *cursor >= l || buffer[*cursor] != '<' {
+		return priority, errNoPriorityStart
 	}
 
 	i := 1 // Start after '<'
 	priDigit := 0
 
-	for i < l {
+	for *cursor+i < l {
 		if i >= 5 {
-			return priority, errors.New("No priority end character or priority too long")
+			return priority, errPriorityTooLong
 		}
 
 		c := buffer[*cursor+i]
 
 		if c == '>' {
 			if i == 1 {
-				return priority, errors.New("Priority too short")
+				return priority, errPriorityTooShort
 			}
 
-			*cursor = i + 1
+			*cursor = *cursor + i + 1
 			priority.Priority = priDigit
 			priority.Facility = priDigit / 8
 			priority.Severity = priDigit % 8
@@ -147,13 +254,13 @@ func ExtractPriority(buffer []byte, cursor *int, l int) (Priority, error) {
 			priDigit = (priDigit * 10) + v
 		} else {
 			//fmt.Printf("Priority: %s\n", string(c))
-			return priority, errors.New("Priority was not valid digit")
+			return priority, errPriorityNotDigit
 		}
 
 		i++
 	}
 
-	return priority, errors.New("No end found")
+	return priority, errNoPriorityEnd
 }
 
 func ParseSyslogMessage(buffer []byte) (Message, error) {
@@ -166,6 +273,9 @@ func ParseSyslogMessage(buffer []byte) (Message, error) {
 
 	cursor := 0
 	l := len(buffer)
+	if l == 0 {
+		return m, errEmptyPacket
+	}
 
 	_, err = ExtractPriority(buffer, &cursor, l)
 	if err != nil {
@@ -175,6 +285,14 @@ func ParseSyslogMessage(buffer []byte) (Message, error) {
 	stringbuffer := strings.TrimSpace(string(buffer[cursor:]))
 
 	parts = strings.SplitN(stringbuffer, " ", 7)
+
+	// RFC 3164 pads days 1-9 with a space ("Aug  7"), which gives an empty
+	// part. Two digit days ("Aug 17") don't have it, so add one to find
+	// the tag from the same position.
+	if len(parts) > 1 && len(parts[0]) == 3 && !IsDigit(parts[0][0]) &&
+		len(parts[1]) == 2 && IsDigit(parts[1][0]) && IsDigit(parts[1][1]) {
+		parts = append([]string{parts[0], ""}, strings.SplitN(stringbuffer, " ", 6)[1:]...)
+	}
 	//for i := 0; i < len(parts); i++ {
 	//	fmt.Printf("parts[%d]: %s\n", i, parts[i])
 	//}
@@ -185,70 +303,288 @@ func ParseSyslogMessage(buffer []byte) (Message, error) {
 		tags = strings.SplitN(parts[2], "/", 4)
 		//fmt.Printf("ISO8601 tags: %+v, len: %d\n", tags, len(tags))
 		if len(tags) != 4 {
-			return m, errors.New("Malformed input on phase 2, assuming ISO8601 date format")
+			return m, errMalformedISO8601Tags
 		}
 		payload = strings.SplitN(stringbuffer, " ", 4)[3]
 
 	} else {
 		if len(parts) < 6 {
-			return m, errors.New("Malformed input on phase 1, assuming legacy date format")
+			return m, errMalformedLegacyHeader
 		}
 
 		// Add docker/ to tag string if it's missing (as is the case with k8s, for example)
-		var match, _ = regexp.MatchString("^docker", parts[5])
-		if !match {
+		if !strings.HasPrefix(parts[5], "docker") {
 			parts[5] = "docker/" + parts[5]
 		}
 
 		tags = strings.SplitN(parts[5], "/", 4)
 		//fmt.Printf("tags: %+v, len: %d\n", tags, len(tags))
 		if len(tags) != 4 {
-			return m, errors.New("Malformed input on phase 2, assuming legacy date format")
+			return m, errMalformedLegacyTags
 		}
 
 		payload = parts[6]
+
+		// RFC 5424 messages of the Docker syslog driver have "-" as the
+		// STRUCTURED-DATA before the message. Old Docker versions left it
+		// out.
+		if parts[0] == "1" {
+			if payload == "-" {
+				payload = ""
+			} else if strings.HasPrefix(payload, "- ") {
+				payload = payload[2:]
+			}
+		}
 	}
 
 	//fmt.Printf("Payload after detection: %+v\n", payload)
 
-	// Simple JSON detection
-	if payload[0] == '{' {
-		m = JSONToMessage(payload)
-		err := m.ParseJSON()
-		if err != nil {
-			m.Container = gabs.New()
-			m.Container.Set(payload, "msg")
-		}
-
-	} else if len(payload) > 25 && payload[10] == 'T' && payload[24] == '{' { // Detect payload which has ISO8601 timestamp in the beginning
-		m = JSONToMessage(payload[24:])
-		err = m.ParseJSON()
-		if err != nil {
-			m.Container = gabs.New()
-			m.Container.Set(payload, "msg")
-		}
-	} else {
-		m.Container = gabs.New()
-		m.Container.Set(payload, "msg")
-	}
+	m = PayloadToMessage(payload)
 
 	// if the container_name includes periods (as with k8s), use only the first part
 	var nameParts = strings.Split(tags[1], ".")
 	if len(nameParts) > 1 {
-		m.Container.Set(nameParts[0], "container_name")
-		m.Container.Set(tags[1], "pod_name")
+		m.SetField("container_name", nameParts[0])
+		m.SetField("pod_name", tags[1])
 	} else {
-		m.Container.Set(tags[1], "container_name")
+		m.SetField("container_name", tags[1])
 	}
 
-	m.Container.Set(tags[2], "container_id")
+	m.SetField("container_id", tags[2])
 
 	n := strings.Index(tags[3], "[")
 	if n != -1 {
-		m.Container.Set(tags[3][0:n], "docker_image")
+		m.SetField("docker_image", tags[3][0:n])
+	} else {
+		m.SetField("docker_image", tags[3])
+	}
+
+	return m, nil
+}
+
+// The levels of the syslog severities
+var syslogSeverityLevels = [...]string{"ERROR", "ERROR", "ERROR", "ERROR", "WARN", "INFO", "INFO", "DEBUG"}
+
+// ParseGenericSyslogMessage parses a syslog message of any program, such
+// as the messages written to the local syslog socket or sent by network
+// appliances. Messages are parsed in the RFC 3164 format the C library
+// writes, with or without the hostname, or in the RFC 5424 format:
+//
+//    <38>Oct 19 10:00:00 sshd[123]: Accepted publickey for root
+//    <34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - 'su root' failed
+//
+// The program is stored in "program" and "pid", and it's used as the
+// "service" and the severity as the "level" if the message doesn't have
+// them. The hostname of the sender is stored in "host". RFC 5424 messages
+// also get the "msgid" and the raw "structured_data".
+//
+// Messages of the Docker syslog driver, which have the hostname and a tag
+// accepted by isDockerSyslogTag, are parsed with ParseSyslogMessage.
+func ParseGenericSyslogMessage(buffer []byte) (Message, error) {
+	m := Message{}
+	if len(buffer) == 0 {
+		return m, errEmptyPacket
+	}
+
+	cursor := 0
+	priority, err := ExtractPriority(buffer, &cursor, len(buffer))
+	if err != nil {
+		return m, err
+	}
+
+	line := strings.TrimRight(string(buffer[strings.IndexByte(string(buffer), '>')+1:]), "\n\x00")
+
+	var header syslogHeader
+	var payload string
+	if strings.HasPrefix(line, "1 ") {
+		header, payload, err = parseRFC5424Header(line[2:])
+		if err != nil {
+			return m, err
+		}
 	} else {
-		m.Container.Set(tags[3], "docker_image")
+		header, payload = parseRFC3164Header(line)
+	}
+
+	if header.Host != "" && isDockerSyslogTag(header.Program) {
+		if docker, err := ParseSyslogMessage(buffer); err == nil {
+			return docker, nil
+		}
+	}
+
+	m = PayloadToMessage(payload)
+
+	if header.Program != "" {
+		m.SetField("program", header.Program)
+		if !m.HasField("service") {
+			m.SetField("service", header.Program)
+		}
+	}
+	if header.Pid != "" {
+		m.SetField("pid", header.Pid)
+	}
+	if header.Host != "" {
+		m.SetField("host", header.Host)
+	}
+	if header.MsgID != "" {
+		m.SetField("msgid", header.MsgID)
+	}
+	if header.StructuredData != "" {
+		m.SetField("structured_data", header.StructuredData)
+	}
+	if !m.HasField("level") {
+		m.SetField("level", syslogSeverityLevels[priority.Severity])
 	}
 
 	return m, nil
 }
+
+// isDockerSyslogTag returns true if the tag is in the format the Docker
+// syslog driver is configured with, "docker/<name>/<id>/<image>", where
+// the "docker/" prefix is optional and id is the short or full hex
+// container id. Other programs' tags, such as "app" or "kernel", are never
+// parsed as Docker messages.
+func isDockerSyslogTag(tag string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(tag, "docker/"), "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return false
+	}
+
+	id := parts[1]
+	if len(id) != 12 && len(id) != 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if !IsDigit(id[i]) && (id[i] < 'a' || id[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// syslogHeader holds the header fields of a generic syslog message, empty
+// when the message doesn't have them.
+type syslogHeader struct {
+	Host           string
+	Program        string
+	Pid            string
+	MsgID          string
+	StructuredData string
+}
+
+// parseRFC3164Header parses the header after the priority:
+// "Oct 19 10:00:00 [host] program[pid]: ".
+func parseRFC3164Header(line string) (syslogHeader, string) {
+	header := syslogHeader{}
+
+	// Timestamp, "Oct 19 10:00:00" or ISO8601
+	if len(line) > 16 && line[3] == ' ' && line[6] == ' ' && line[15] == ' ' {
+		line = line[16:]
+	} else if i := strings.IndexByte(line, ' '); i > 18 && line[10] == 'T' {
+		line = line[i+1:]
+	}
+
+	// The tag ends with a colon and is preceded by the hostname if the
+	// header has two words
+	i := strings.Index(line, ": ")
+	if i == -1 || strings.Count(line[:i], " ") > 1 {
+		return header, line
+	}
+
+	tag := line[:i]
+	if j := strings.IndexByte(tag, ' '); j != -1 {
+		header.Host = tag[:j]
+		tag = tag[j+1:]
+	}
+	header.Program = tag
+	if j := strings.IndexByte(tag, '['); j != -1 && strings.HasSuffix(tag, "]") {
+		header.Program = tag[:j]
+		header.Pid = tag[j+1 : len(tag)-1]
+	}
+
+	return header, line[i+2:]
+}
+
+// parseRFC5424Header parses the header after the priority and version:
+// "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA ". Fields
+// which are "-" are left empty.
+func parseRFC5424Header(line string) (syslogHeader, string, error) {
+	header := syslogHeader{}
+
+	parts := strings.SplitN(line, " ", 6)
+	if len(parts) < 6 {
+		return header, "", errRFC5424HeaderTooShort
+	}
+
+	nilValue := func(s string) string {
+		if s == "-" {
+			return ""
+		}
+		return s
+	}
+	header.Host = nilValue(parts[1])
+	header.Program = nilValue(parts[2])
+	header.Pid = nilValue(parts[3])
+	header.MsgID = nilValue(parts[4])
+
+	// Structured data is "-" or elements like [id key="value"], where the
+	// values can contain escaped quotes and brackets
+	rest := parts[5]
+	end := 0
+	if strings.HasPrefix(rest, "-") {
+		end = 1
+	} else {
+		inValue := false
+		for end < len(rest) {
+			c := rest[end]
+			if inValue {
+				if c == '\\' {
+					end++
+				} else if c == '"' {
+					inValue = false
+				}
+			} else if c == '"' {
+				inValue = true
+			} else if c == ']' && (end+1 == len(rest) || rest[end+1] != '[') {
+				end++
+				break
+			}
+			end++
+		}
+		if end > len(rest) || rest[0] != '[' || rest[end-1] != ']' {
+			return header, "", errRFC5424StructuredData
+		}
+		header.StructuredData = rest[:end]
+	}
+
+	payload := strings.TrimPrefix(rest[end:], " ")
+	payload = strings.TrimPrefix(payload, "\xef\xbb\xbf")
+
+	return header, payload, nil
+}
+
+// PayloadToMessage converts a log line written by an application into a
+// message. JSON documents (optionally prefixed with an ISO8601 timestamp) are
+// parsed as-is and other lines are placed into the "msg" field.
+func PayloadToMessage(payload string) Message {
+	m := Message{}
+
+	// Simple JSON detection
+	if len(payload) > 0 && payload[0] == '{' {
+		m = JSONToMessage(payload)
+		err := m.ParseFields()
+		if err != nil {
+			m = TextToMessage(payload)
+		}
+
+	} else if len(payload) > 25 && payload[10] == 'T' && payload[24] == '{' { // Detect payload which has ISO8601 timestamp in the beginning
+		m = JSONToMessage(payload[24:])
+		err := m.ParseFields()
+		if err != nil {
+			m = TextToMessage(payload)
+		}
+	} else {
+		m = TextToMessage(payload)
+	}
+
+	return m
+}
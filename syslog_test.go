@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"net"
 	"testing"
 
@@ -24,34 +26,73 @@ func TestParseSyslogMessage(t *testing.T) {
 	m, err := ParseSyslogMessage([]byte("<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:12341234[9103]: Hello from Docker."))
 	assert.Nil(t, err)
 
-	value, ok := m.Container.Path("container_name").Data().(string)
+	value, ok := m.FieldString("container_name")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "container-name")
 
-	value, ok = m.Container.Path("container_id").Data().(string)
+	value, ok = m.FieldString("container_id")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "id")
 
-	value, ok = m.Container.Path("docker_image").Data().(string)
+	value, ok = m.FieldString("docker_image")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "registry:5000/foobar:12341234")
 
 }
 
+func TestParseSyslogMessageTwoDigitDay(t *testing.T) {
+
+	m, err := ParseSyslogMessage([]byte("<27>Aug 17 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:12341234[9103]: Hello from Docker."))
+	assert.Nil(t, err)
+
+	value, ok := m.FieldString("container_name")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "container-name")
+
+	value, ok = m.FieldString("docker_image")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "registry:5000/foobar:12341234")
+
+	value, ok = m.FieldString("msg")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "Hello from Docker.")
+
+	// The tag without the docker/ prefix, as with k8s
+	m, err = ParseSyslogMessage([]byte("<27>Dec 31 18:33:19 HOSTNAME container-name/id/registry:5000/foobar:12341234[9103]: Hello from Docker."))
+	assert.Nil(t, err)
+
+	value, ok = m.FieldString("container_id")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "id")
+
+	value, ok = m.FieldString("msg")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "Hello from Docker.")
+
+	// Single digit days are parsed as before
+	m, err = ParseSyslogMessage([]byte("<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:12341234[9103]: Hello from Docker."))
+	assert.Nil(t, err)
+
+	value, ok = m.FieldString("msg")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, value, "Hello from Docker.")
+
+}
+
 func TestParseSyslogMessage2(t *testing.T) {
 
 	m, err := ParseSyslogMessage([]byte("<27>2016-06-09T04:47:45Z as-ads-brand-i-34d06ca8 docker/ads-publisher-sync/e3088a0601ea/registry.applifier.info:5000/ads-publisher-sync:c48b56ff43e1cce471a19015515a3e4706277d06[1084]: 2016/06/09 04:47:45 Setting up publisher sync service with debugging: true"))
 	assert.Nil(t, err)
 
-	value, ok := m.Container.Path("container_name").Data().(string)
+	value, ok := m.FieldString("container_name")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "ads-publisher-sync")
 
-	value, ok = m.Container.Path("container_id").Data().(string)
+	value, ok = m.FieldString("container_id")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "e3088a0601ea")
 
-	value, ok = m.Container.Path("docker_image").Data().(string)
+	value, ok = m.FieldString("docker_image")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "registry.applifier.info:5000/ads-publisher-sync:c48b56ff43e1cce471a19015515a3e4706277d06")
 
@@ -61,38 +102,65 @@ func TestParseSyslogMessage3(t *testing.T) {
 	m, err := ParseSyslogMessage([]byte("436 <27>1 2017-03-28T10:04:48Z jami-k8s-test-worker-0 k8s_kube-proxy.2023dc8e_kube-proxy-172.16.1.234_kube-system_7daefb93d6c2ac8f5a79211bec23a3f4_11993b80/6bfc10ddb6e2/quay.io/coreos/hyperkube:v1.5.2_coreos.1 2177 k8s_kube-proxy.2023dc8e_kube-proxy-172.16.1.234_kube-system_7daefb93d6c2ac8f5a79211bec23a3f4_11993b80/6bfc10ddb6e2/quay.io/coreos/hyperkube:v1.5.2_coreos.1 I0328 10:04:48.569582       1 server.go:215] Using iptables Proxier."))
 	assert.Nil(t, err)
 
-	value, ok := m.Container.Path("container_name").Data().(string)
+	value, ok := m.FieldString("container_name")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "k8s_kube-proxy")
 
-	value, ok = m.Container.Path("pod_name").Data().(string)
+	value, ok = m.FieldString("pod_name")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "k8s_kube-proxy.2023dc8e_kube-proxy-172.16.1.234_kube-system_7daefb93d6c2ac8f5a79211bec23a3f4_11993b80")
 
-	value, ok = m.Container.Path("container_id").Data().(string)
+	value, ok = m.FieldString("container_id")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "6bfc10ddb6e2")
 
-	value, ok = m.Container.Path("docker_image").Data().(string)
+	value, ok = m.FieldString("docker_image")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "quay.io/coreos/hyperkube:v1.5.2_coreos.1")
 
 }
 
+func TestParseSyslogMessageRFC5424(t *testing.T) {
+	// As written by the Docker syslog driver with --log-opt syslog-format=rfc5424
+	m, err := ParseSyslogMessage([]byte(`<30>1 2017-10-19T10:00:00.123456+03:00 myhost web/e3088a0601ea/nginx:1.13 1234 web/e3088a0601ea/nginx:1.13 - {"service":"web","msg":"hi"}`))
+	assert.Nil(t, err)
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "hi", value)
+	value, _ = m.FieldString("service")
+	assert.Equal(t, "web", value)
+	value, _ = m.FieldString("container_id")
+	assert.Equal(t, "e3088a0601ea", value)
+	value, _ = m.FieldString("docker_image")
+	assert.Equal(t, "nginx:1.13", value)
+
+	// Also when octet counted
+	m, err = ParseSyslogMessage([]byte(`52 <30>1 2017-10-19T10:00:00Z myhost web/e3088a0601ea/nginx 1 web/e3088a0601ea/nginx - plain`))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "plain", value)
+
+	m, err = ParseGenericSyslogMessage([]byte(`<30>1 2017-10-19T10:00:00Z myhost web/e3088a0601ea/nginx 1 web/e3088a0601ea/nginx - {"msg":"hi"}`))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "hi", value)
+	value, _ = m.FieldString("container_name")
+	assert.Equal(t, "web", value)
+}
+
 func TestParseSyslogMessageJSON(t *testing.T) {
 
 	m, err := ParseSyslogMessage([]byte("<27>Aug  7 18:33:19 HOSTNAME docker/container-name/id/registry:5000/foobar:123412341234[9103]: {\"service\":\"foobar\",\"level\":\"DEBUG\",\"msg\":\"Hello, World!\\n\"}"))
 	assert.Nil(t, err)
 
-	value, ok := m.Container.Path("msg").Data().(string)
+	value, ok := m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "Hello, World!\n")
 
-	value, ok = m.Container.Path("level").Data().(string)
+	value, ok = m.FieldString("level")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "DEBUG")
 
-	value, ok = m.Container.Path("service").Data().(string)
+	value, ok = m.FieldString("service")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "foobar")
 }
@@ -102,7 +170,7 @@ func TestParseSyslogMessageWitthISOTimestamp(t *testing.T) {
 	m, err := ParseSyslogMessage([]byte("<27>2016-06-06T13:24:36Z hvm-ami-builder docker/dreamy_ramanujan/0fc5ec54111c/ubuntu:14.04[27481]: Hello, World!"))
 	assert.Nil(t, err)
 
-	value, ok := m.Container.Path("msg").Data().(string)
+	value, ok := m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "Hello, World!")
 
@@ -113,15 +181,15 @@ func TestParseSyslogMessageJSONWitthISOTimestamp(t *testing.T) {
 	m, err := ParseSyslogMessage([]byte("<27>2016-06-06T13:24:36Z hvm-ami-builder docker/dreamy_ramanujan/0fc5ec54111c/ubuntu:14.04[27481]: {\"service\":\"foobar\",\"level\":\"DEBUG\",\"msg\":\"Hello, World!\\n\"}"))
 	assert.Nil(t, err)
 
-	value, ok := m.Container.Path("msg").Data().(string)
+	value, ok := m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "Hello, World!\n")
 
-	value, ok = m.Container.Path("level").Data().(string)
+	value, ok = m.FieldString("level")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "DEBUG")
 
-	value, ok = m.Container.Path("service").Data().(string)
+	value, ok = m.FieldString("service")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "foobar")
 
@@ -132,15 +200,15 @@ func TestParseSyslogMessageJSONWitthISOTimestampAndMessageTimestamp(t *testing.T
 	m, err := ParseSyslogMessage([]byte("<27>2016-06-06T13:24:36Z hvm-ami-builder docker/dreamy_ramanujan/0fc5ec54111c/ubuntu:14.04[27481]: 2016-06-08T12:13:14.123 {\"service\":\"foobar\",\"level\":\"DEBUG\",\"msg\":\"Hello, World!\\n\"}"))
 	assert.Nil(t, err)
 
-	value, ok := m.Container.Path("msg").Data().(string)
+	value, ok := m.FieldString("msg")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "Hello, World!\n")
 
-	value, ok = m.Container.Path("level").Data().(string)
+	value, ok = m.FieldString("level")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "DEBUG")
 
-	value, ok = m.Container.Path("service").Data().(string)
+	value, ok = m.FieldString("service")
 	assert.Equal(t, ok, true)
 	assert.Equal(t, value, "foobar")
 
@@ -170,10 +238,157 @@ func TestSyslog(t *testing.T) {
 	Conn.Close()
 
 	msg := <-s.Messages
-	value, ok := msg.Container.Path("msg").Data().(string)
+	value, ok := msg.FieldString("msg")
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "Hello from Docker.", value)
 
 	s.Close()
 
 }
+
+func TestParseGenericSyslogMessage(t *testing.T) {
+
+	m, err := ParseGenericSyslogMessage([]byte("<38>Oct 19 10:00:00 sshd[123]: Accepted publickey for root\n"))
+	assert.Nil(t, err)
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "Accepted publickey for root", value)
+	value, _ = m.FieldString("program")
+	assert.Equal(t, "sshd", value)
+	value, _ = m.FieldString("pid")
+	assert.Equal(t, "123", value)
+	value, _ = m.FieldString("service")
+	assert.Equal(t, "sshd", value)
+	value, _ = m.FieldString("level")
+	assert.Equal(t, "INFO", value)
+
+	// With the hostname and an ISO8601 timestamp
+	m, err = ParseGenericSyslogMessage([]byte("<11>2016-06-06T13:24:36Z myhost cron: job failed"))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("host")
+	assert.Equal(t, "myhost", value)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "job failed", value)
+	value, _ = m.FieldString("program")
+	assert.Equal(t, "cron", value)
+	assert.False(t, m.HasField("pid"))
+	value, _ = m.FieldString("level")
+	assert.Equal(t, "ERROR", value)
+
+	// The fields of JSON payloads are kept
+	m, err = ParseGenericSyslogMessage([]byte(`<15>Oct  9 10:00:00 app[1]: {"service":"foo","level":"WARN","msg":"hi"}`))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("service")
+	assert.Equal(t, "foo", value)
+	value, _ = m.FieldString("level")
+	assert.Equal(t, "WARN", value)
+	value, _ = m.FieldString("program")
+	assert.Equal(t, "app", value)
+
+	// Messages of the Docker syslog driver are parsed as from the port
+	m, err = ParseGenericSyslogMessage([]byte("<27>Aug  7 18:33:19 HOSTNAME docker/container-name/e3088a0601ea/registry:5000/foobar:12341234[9103]: Hello"))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("container_name")
+	assert.Equal(t, "container-name", value)
+	value, _ = m.FieldString("container_id")
+	assert.Equal(t, "e3088a0601ea", value)
+	assert.False(t, m.HasField("program"))
+
+	// Paths in the messages of other programs aren't taken for Docker tags
+	m, err = ParseGenericSyslogMessage([]byte("<38>Oct  9 10:00:00 app: /var/lib/docker/overlay2 is full"))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "/var/lib/docker/overlay2 is full", value)
+	value, _ = m.FieldString("program")
+	assert.Equal(t, "app", value)
+	assert.False(t, m.HasField("container_id"))
+	assert.False(t, m.HasField("docker_image"))
+
+	m, err = ParseGenericSyslogMessage([]byte("<38>Oct  9 10:00:00 myhost app: docker/foo/bar/baz is gone"))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "docker/foo/bar/baz is gone", value)
+	assert.False(t, m.HasField("container_id"))
+
+	// Without a tag the whole line is the message
+	m, err = ParseGenericSyslogMessage([]byte("<13>Oct 19 10:00:00 just a message"))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "just a message", value)
+	assert.False(t, m.HasField("program"))
+
+	_, err = ParseGenericSyslogMessage([]byte("no priority"))
+	assert.NotNil(t, err)
+}
+
+func TestParseGenericSyslogMessageRFC5424(t *testing.T) {
+
+	m, err := ParseGenericSyslogMessage([]byte("<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \xef\xbb\xbf'su root' failed for lonvick on /dev/pts/8"))
+	assert.Nil(t, err)
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "'su root' failed for lonvick on /dev/pts/8", value)
+	value, _ = m.FieldString("host")
+	assert.Equal(t, "mymachine.example.com", value)
+	value, _ = m.FieldString("program")
+	assert.Equal(t, "su", value)
+	value, _ = m.FieldString("msgid")
+	assert.Equal(t, "ID47", value)
+	value, _ = m.FieldString("level")
+	assert.Equal(t, "ERROR", value)
+	assert.False(t, m.HasField("pid"))
+	assert.False(t, m.HasField("structured_data"))
+
+	m, err = ParseGenericSyslogMessage([]byte(`<165>1 2003-10-11T22:14:15.003Z fw01 evntslog 1234 - [exampleSDID@32473 iut="3" eventSource="App\"lication\]"][examplePriority@32473 class="high"] An application event`))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "An application event", value)
+	value, _ = m.FieldString("structured_data")
+	assert.Equal(t, `[exampleSDID@32473 iut="3" eventSource="App\"lication\]"][examplePriority@32473 class="high"]`, value)
+	value, _ = m.FieldString("pid")
+	assert.Equal(t, "1234", value)
+	value, _ = m.FieldString("level")
+	assert.Equal(t, "INFO", value)
+
+	// Structured data without a message
+	m, err = ParseGenericSyslogMessage([]byte(`<165>1 2003-10-11T22:14:15.003Z fw01 app - - [id a="b"]`))
+	assert.Nil(t, err)
+	value, _ = m.FieldString("structured_data")
+	assert.Equal(t, `[id a="b"]`, value)
+
+	_, err = ParseGenericSyslogMessage([]byte(`<165>1 2003-10-11T22:14:15.003Z fw01`))
+	assert.NotNil(t, err)
+	_, err = ParseGenericSyslogMessage([]byte(`<165>1 2003-10-11T22:14:15.003Z fw01 app - - [id a="b" msg`))
+	assert.NotNil(t, err)
+}
+
+func TestSyslogBindAndSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := Syslog{Stats: NewStats()}
+	s.Messages = make(chan Message, 10)
+	s.BindAddress = "127.0.0.1"
+	s.SocketPath = dir + "/log"
+
+	err = s.Init(0)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", s.listener.conns[0].LocalAddr().(*net.UDPAddr).IP.String())
+
+	conn, err := net.Dial("unixgram", s.SocketPath)
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte("<12>Oct 19 10:00:00 kernel: disk is full"))
+	assert.Nil(t, err)
+	conn.Close()
+
+	msg := <-s.Messages
+	value, _ := msg.FieldString("msg")
+	assert.Equal(t, "disk is full", value)
+	value, _ = msg.FieldString("level")
+	assert.Equal(t, "WARN", value)
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.input.messages,input=socket"))
+
+	s.Close()
+	_, err = os.Stat(s.SocketPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The client certificate modes of SyslogTLS
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequired = "required"
+)
+
+// RFC 5425 requires receivers to accept messages of 2048 bytes and
+// recommends 8192
+const DefaultMaxTLSSyslogMessageSize = 64 * 1024
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Connections which don't send anything for DefaultTLSIdleTimeout are
+// closed, and at most DefaultMaxTLSConnections are kept open, so that idle
+// clients can't use up the memory of the readers
+const (
+	DefaultTLSIdleTimeout    = 5 * time.Minute
+	DefaultMaxTLSConnections = 1000
+)
+
+// SyslogTLS receives syslog messages over TLS (RFC 5425). Messages are
+// framed with octet counting ("<length> <message>") as in RFC 5425, or
+// delimited with newlines as many senders do (RFC 6587). They are parsed
+// with ParseGenericSyslogMessage.
+//
+// Client certificates are verified against the CA bundle when ClientAuth
+// is "optional" or "required", and the identity of a verified client is
+// stored in IdentityField of each message it sends. The field is removed
+// from the messages of other clients, so it can't be spoofed. Set the same
+// field in Pipeline.IdentityField to remove it from the other inputs too.
+type SyslogTLS struct {
+	Port int
+
+	// Address to bind, eg. "127.0.0.1" or "::1". Empty binds all interfaces.
+	BindAddress string
+
+	CertFile string
+	KeyFile  string
+
+	// PEM bundle of the CAs which sign the client certificates
+	CAFile string
+
+	// ClientAuthNone, ClientAuthOptional or ClientAuthRequired
+	ClientAuth string
+
+	// Field where the identity of a verified client is stored, empty to
+	// leave out
+	IdentityField string
+
+	// Longer messages close the connection, DefaultMaxTLSSyslogMessageSize
+	// if 0
+	MaxMessageSize int
+
+	// Connections which are idle for longer are closed,
+	// DefaultTLSIdleTimeout if 0
+	IdleTimeout time.Duration
+
+	// Further connections are closed right away, DefaultMaxTLSConnections
+	// if 0
+	MaxConnections int
+
+	Messages chan Message
+
+	Statsd StatisticsSender
+
+	// Stats counts the connections, messages and failures, can be nil
+	Stats *Stats
+
+	// ACL limits the senders which are accepted, nil accepts all
+	ACL *ACL
+
+	// Fields where the sender address is stored
+	SourceFields SourceFields
+
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+	done     sync.WaitGroup
+}
+
+// TLSConfig loads the certificates into a server configuration.
+func (s *SyslogTLS) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading certificate: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.CAFile != "" {
+		pem, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle: %s", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", s.CAFile)
+		}
+	}
+
+	switch s.ClientAuth {
+	case "", ClientAuthNone:
+		config.ClientAuth = tls.NoClientCert
+	case ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequired:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Invalid client auth %s, valid values are %s, %s and %s", s.ClientAuth, ClientAuthNone, ClientAuthOptional, ClientAuthRequired)
+	}
+
+	if config.ClientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, fmt.Errorf("Client certificates can't be verified without a CA bundle")
+	}
+
+	return config, nil
+}
+
+// Start listens to Port and sends the messages into messages.
+func (s *SyslogTLS) Start(messages chan Message) error {
+	s.Messages = messages
+	return s.Init()
+}
+
+func (s *SyslogTLS) Init() error {
+	config, err := s.TLSConfig()
+	if err != nil {
+		return err
+	}
+
+	addr, err := ResolveListenAddr(s.BindAddress, s.Port)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+	if err != nil {
+		return err
+	}
+
+	s.listener = tls.NewListener(listener, config)
+	s.conns = make(map[net.Conn]bool)
+
+	s.done.Add(1)
+	go s.accept()
+
+	return nil
+}
+
+// Addr returns the address the listener is bound to, which is useful when
+// the listener was started on port 0.
+func (s *SyslogTLS) Addr() *net.TCPAddr {
+	return s.listener.Addr().(*net.TCPAddr)
+}
+
+func (s *SyslogTLS) accept() {
+	defer s.done.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Error accepting syslog TLS connection: %s\n", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+		if addr != nil && !s.ACL.Allowed(addr.IP) {
+			if s.Statsd != nil {
+				s.Statsd.Inc("logs2kafka.rejected_packets,input=tls", 1, 1)
+			}
+			conn.Close()
+			continue
+		}
+
+		maxConns := s.MaxConnections
+		if maxConns <= 0 {
+			maxConns = DefaultMaxTLSConnections
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		if len(s.conns) >= maxConns {
+			s.mutex.Unlock()
+			s.Stats.Add("logs2kafka.input.connections_rejected,input=tls", 1)
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = true
+		s.mutex.Unlock()
+
+		s.done.Add(1)
+		go s.handle(conn.(*tls.Conn))
+	}
+}
+
+func (s *SyslogTLS) handle(conn *tls.Conn) {
+	defer s.done.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+		s.Stats.AddGauge("logs2kafka.input.connections_open,input=tls", -1)
+	}()
+	s.Stats.AddGauge("logs2kafka.input.connections_open,input=tls", 1)
+	s.Stats.Add("logs2kafka.input.connections,input=tls", 1)
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := conn.Handshake()
+	if err != nil {
+		s.Stats.Add("logs2kafka.input.tls_handshake_errors", 1)
+		fmt.Fprintf(os.Stderr, "TLS handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	idleTimeout := s.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultTLSIdleTimeout
+	}
+
+	identity := TLSClientIdentity(conn.ConnectionState())
+
+	var source *net.UDPAddr
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		source = &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	}
+
+	maxSize := s.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxTLSSyslogMessageSize
+	}
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		frame, err := ReadSyslogFrame(reader, maxSize)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.Stats.Add("logs2kafka.input.connections_idle_closed,input=tls", 1)
+			} else if err != io.EOF {
+				s.Stats.Add("logs2kafka.input.parse_errors,input=tls,reason=framing", 1)
+				fmt.Fprintf(os.Stderr, "Error reading syslog TLS connection from %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(frame) == 0 {
+			continue
+		}
+
+		s.Stats.Add("logs2kafka.input.packets,input=tls", 1)
+		s.Stats.Add("logs2kafka.input.bytes,input=tls", int64(len(frame)))
+
+		msg, err := ParseGenericSyslogMessage(frame)
+		if err != nil {
+			s.Stats.Add("logs2kafka.input.parse_errors,input=tls,reason="+SyslogParseErrorReason(err), 1)
+			if s.Statsd != nil {
+				s.Statsd.Inc("logs2kafka.invalid_messages", 1, 0.1)
+			}
+			fmt.Fprintf(os.Stderr, "Error parsing syslog message: %s\n", err)
+			continue
+		}
+
+		msg.Source = "syslog"
+		msg.ReceivedAt = time.Now()
+		s.SourceFields.Set(&msg, source)
+		if s.IdentityField != "" {
+			if identity != "" {
+				msg.Identity = identity
+				msg.SetField(s.IdentityField, identity)
+			} else {
+				msg.DeleteField(s.IdentityField)
+			}
+		}
+		s.Stats.Add("logs2kafka.input.messages,input=tls", 1)
+		s.Messages <- msg
+	}
+}
+
+// TLSClientIdentity returns the common name of a verified client
+// certificate, or its first DNS name, IP address or email address if
+// the common name is empty. Unverified clients don't have an identity.
+func TLSClientIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := state.PeerCertificates[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.IPAddresses) > 0:
+		return cert.IPAddresses[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+var errSyslogFrameTooLong = errors.New("Syslog message is too long")
+
+// ReadSyslogFrame reads one message of a syslog stream. Frames which start
+// with a digit are octet counted ("<length> <message>"), others end with a
+// newline. Messages longer than maxSize are an error.
+func ReadSyslogFrame(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsDigit(first[0]) {
+		length := 0
+		for i := 0; ; i++ {
+			c, err := reader.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if c == ' ' {
+				break
+			}
+			if !IsDigit(c) || i >= 10 {
+				return nil, fmt.Errorf("Invalid syslog message length")
+			}
+			length = length*10 + int(c-'0')
+			if length > maxSize {
+				return nil, errSyslogFrameTooLong
+			}
+		}
+
+		frame := make([]byte, length)
+		_, err = io.ReadFull(reader, frame)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return frame, nil
+	}
+
+	frame := []byte{}
+	for {
+		line, err := reader.ReadSlice('\n')
+		frame = append(frame, line...)
+		if len(frame)-trailingNewline(frame) > maxSize {
+			return nil, errSyslogFrameTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(frame) > 0 {
+			// The last message doesn't need a newline
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	frame = frame[:len(frame)-trailingNewline(frame)]
+	return frame, nil
+}
+
+func trailingNewline(frame []byte) int {
+	n := 0
+	if len(frame) > 0 && frame[len(frame)-1] == '\n' {
+		n++
+		if len(frame) > 1 && frame[len(frame)-2] == '\r' {
+			n++
+		}
+	}
+	return n
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Close stops accepting connections and closes the open ones.
+func (s *SyslogTLS) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.listener.Close()
+	s.done.Wait()
+}
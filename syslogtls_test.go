@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self
+// signed CA if parent is nil.
+func newTestCertificate(t *testing.T, parent *testCertificate, cn string, dnsNames ...string) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCertificate{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCertificate) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+type testTLSSetup struct {
+	dir    string
+	ca     *testCertificate
+	server *testCertificate
+}
+
+func newTestTLSSetup(t *testing.T) *testTLSSetup {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+
+	s := &testTLSSetup{dir: dir}
+	s.ca = newTestCertificate(t, nil, "Test CA")
+	s.server = newTestCertificate(t, s.ca, "localhost", "localhost")
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/ca.pem", s.ca.pem, 0644))
+	assert.Nil(t, ioutil.WriteFile(dir+"/server.pem", s.server.pem, 0644))
+	assert.Nil(t, ioutil.WriteFile(dir+"/server.key", s.server.keyPEM(t), 0600))
+	return s
+}
+
+func (s *testTLSSetup) listener(t *testing.T, clientAuth string) *SyslogTLS {
+	l := s.config(clientAuth)
+	assert.Nil(t, l.Init())
+	return l
+}
+
+// config returns a listener which isn't started yet
+func (s *testTLSSetup) config(clientAuth string) *SyslogTLS {
+	return &SyslogTLS{
+		BindAddress:   "127.0.0.1",
+		CertFile:      s.dir + "/server.pem",
+		KeyFile:       s.dir + "/server.key",
+		CAFile:        s.dir + "/ca.pem",
+		ClientAuth:    clientAuth,
+		IdentityField: "tls_client",
+		Messages:      make(chan Message, 10),
+		Stats:         NewStats(),
+		SourceFields:  SourceFields{IP: "source_ip"},
+	}
+}
+
+func (s *testTLSSetup) dial(t *testing.T, l *SyslogTLS, client *testCertificate) (*tls.Conn, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.ca.cert)
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if client != nil {
+		cert, err := tls.X509KeyPair(client.pem, client.keyPEM(t))
+		assert.Nil(t, err)
+		config.Certificates = []tls.Certificate{cert}
+	}
+	conn, err := tls.Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, conn.Handshake()
+}
+
+func receiveTestMessage(t *testing.T, messages chan Message) *Message {
+	select {
+	case m := <-messages:
+		return &m
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message received")
+	}
+	return nil
+}
+
+func TestSyslogTLS(t *testing.T) {
+	setup := newTestTLSSetup(t)
+	defer os.RemoveAll(setup.dir)
+
+	l := setup.listener(t, ClientAuthRequired)
+	defer l.Close()
+
+	client := newTestCertificate(t, setup.ca, "fw01.example.com")
+	conn, err := setup.dial(t, l, client)
+	assert.Nil(t, err)
+
+	// Octet counted and newline delimited messages can be mixed
+	first := `<34>1 2003-10-11T22:14:15.003Z fw01 su - ID47 - {"msg":"first","tls_client":"spoofed"}`
+	conn.Write([]byte(strconv.Itoa(len(first)) + " " + first))
+	conn.Write([]byte("<38>Oct 19 10:00:00 fw01 sshd[1]: second\r\n"))
+	conn.Close()
+
+	m := receiveTestMessage(t, l.Messages)
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "first", value)
+	value, _ = m.FieldString("tls_client")
+	assert.Equal(t, "fw01.example.com", value)
+	value, _ = m.FieldString("source_ip")
+	assert.Equal(t, "127.0.0.1", value)
+
+	m = receiveTestMessage(t, l.Messages)
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "second", value)
+	value, _ = m.FieldString("program")
+	assert.Equal(t, "sshd", value)
+
+	// Clients without a certificate, or with one from another CA, are
+	// rejected. With TLS 1.3 the client only notices it when reading.
+	other := newTestCertificate(t, newTestCertificate(t, nil, "Other CA"), "intruder")
+	for _, client := range []*testCertificate{nil, other} {
+		conn, err = setup.dial(t, l, client)
+		if err == nil {
+			conn.Write([]byte("<38>Oct 19 10:00:00 app: rejected\n"))
+			conn.Close()
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Stats.Counter("logs2kafka.input.tls_handshake_errors") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(2), l.Stats.Counter("logs2kafka.input.tls_handshake_errors"))
+	assert.Equal(t, int64(2), l.Stats.Counter("logs2kafka.input.messages,input=tls"))
+	assert.Equal(t, 0, len(l.Messages))
+}
+
+func TestSyslogTLSOptionalClientAuth(t *testing.T) {
+	setup := newTestTLSSetup(t)
+	defer os.RemoveAll(setup.dir)
+
+	l := setup.listener(t, ClientAuthOptional)
+	defer l.Close()
+
+	// Without a certificate the identity field is removed
+	conn, err := setup.dial(t, l, nil)
+	assert.Nil(t, err)
+	conn.Write([]byte("<38>Oct 19 10:00:00 app: {\"msg\":\"anonymous\",\"tls_client\":\"spoofed\"}\n"))
+	conn.Close()
+
+	m := receiveTestMessage(t, l.Messages)
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "anonymous", value)
+	assert.False(t, m.HasField("tls_client"))
+
+	// The first subject alternative name is used without a common name
+	client := newTestCertificate(t, setup.ca, "", "appliance.example.com")
+	conn, err = setup.dial(t, l, client)
+	assert.Nil(t, err)
+	conn.Write([]byte("<38>Oct 19 10:00:00 app: verified"))
+	conn.Close()
+
+	m = receiveTestMessage(t, l.Messages)
+	value, _ = m.FieldString("tls_client")
+	assert.Equal(t, "appliance.example.com", value)
+}
+
+func waitStatsCounter(stats *Stats, name string, value int64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for stats.Counter(name) < value && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyslogTLSConnectionLimits(t *testing.T) {
+	setup := newTestTLSSetup(t)
+	defer os.RemoveAll(setup.dir)
+
+	l := setup.config(ClientAuthNone)
+	l.IdleTimeout = 200 * time.Millisecond
+	l.MaxConnections = 1
+	assert.Nil(t, l.Init())
+	defer l.Close()
+
+	idle, err := setup.dial(t, l, nil)
+	assert.Nil(t, err)
+	defer idle.Close()
+
+	// The connection over the limit is closed before the handshake
+	_, err = setup.dial(t, l, nil)
+	assert.NotNil(t, err)
+	waitStatsCounter(l.Stats, "logs2kafka.input.connections_rejected,input=tls", 1)
+	assert.Equal(t, int64(1), l.Stats.Counter("logs2kafka.input.connections_rejected,input=tls"))
+
+	// The idle connection is closed, which leaves room for a new one
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), l.Stats.Counter("logs2kafka.input.connections_idle_closed,input=tls"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Stats.Gauge("logs2kafka.input.connections_open,input=tls") > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := setup.dial(t, l, nil)
+	assert.Nil(t, err)
+	conn.Write([]byte("<38>Oct 19 10:00:00 app: after the idle one\n"))
+	conn.Close()
+
+	m := receiveTestMessage(t, l.Messages)
+	value, _ := m.FieldString("msg")
+	assert.Equal(t, "after the idle one", value)
+}
+
+func TestSyslogTLSConfig(t *testing.T) {
+	setup := newTestTLSSetup(t)
+	defer os.RemoveAll(setup.dir)
+
+	l := &SyslogTLS{CertFile: setup.dir + "/server.pem", KeyFile: setup.dir + "/server.key"}
+	_, err := l.TLSConfig()
+	assert.Nil(t, err)
+
+	l.ClientAuth = ClientAuthRequired
+	_, err = l.TLSConfig()
+	assert.NotNil(t, err)
+
+	l.ClientAuth = "sometimes"
+	l.CAFile = setup.dir + "/ca.pem"
+	_, err = l.TLSConfig()
+	assert.NotNil(t, err)
+
+	l = &SyslogTLS{CertFile: setup.dir + "/missing.pem", KeyFile: setup.dir + "/server.key"}
+	_, err = l.TLSConfig()
+	assert.NotNil(t, err)
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("5 hello10 <13>a\nb c\n<13>line\n\n<13>last"))
+
+	frame, err := ReadSyslogFrame(reader, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(frame))
+
+	frame, err = ReadSyslogFrame(reader, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, "<13>a\nb c\n", string(frame))
+
+	frame, err = ReadSyslogFrame(reader, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, "<13>line", string(frame))
+
+	frame, err = ReadSyslogFrame(reader, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, "", string(frame))
+
+	frame, err = ReadSyslogFrame(reader, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, "<13>last", string(frame))
+
+	_, err = ReadSyslogFrame(reader, 100)
+	assert.NotNil(t, err)
+
+	_, err = ReadSyslogFrame(bufio.NewReader(strings.NewReader("101 <13>")), 100)
+	assert.NotNil(t, err)
+	_, err = ReadSyslogFrame(bufio.NewReader(strings.NewReader("<13>"+strings.Repeat("a", 100)+"\n")), 100)
+	assert.NotNil(t, err)
+	_, err = ReadSyslogFrame(bufio.NewReader(strings.NewReader("10 short")), 100)
+	assert.NotNil(t, err)
+	_, err = ReadSyslogFrame(bufio.NewReader(strings.NewReader("1x <13>")), 100)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Kafka's limit for the length of a topic name
+const DefaultMaxTopicLength = 249
+
+// The policies of TopicSanitiser for the "." and "_" characters, which
+// collide in Kafka's metric names: "foo.bar" and "foo_bar" can't both exist.
+const (
+	TopicCollisionsKeep       = "keep"
+	TopicCollisionsUnderscore = "underscore"
+	TopicCollisionsDot        = "dot"
+)
+
+// TopicSanitiser turns service names into valid Kafka topic names. The
+// characters Kafka doesn't allow are replaced, and names which are too long
+// are shortened and suffixed with a hash of the full name so that they stay
+// distinct. Names which can't be made valid are replaced with the default
+// topic.
+type TopicSanitiser struct {
+	// Replaces each character other than [a-zA-Z0-9._-], empty to remove them
+	Replacement string
+
+	// TopicCollisionsKeep, TopicCollisionsUnderscore replaces "." with "_"
+	// or TopicCollisionsDot replaces "_" with "." in the service names. The
+	// prefix is left as is.
+	Collisions string
+
+	// Maximum length of a topic including the prefix
+	MaxLength int
+
+	// Stats counts the sanitised, shortened and rejected names, can be nil
+	Stats *Stats
+}
+
+func NewTopicSanitiser(replacement string, collisions string, maxLength int) (*TopicSanitiser, error) {
+	for i := 0; i < len(replacement); i++ {
+		if !isTopicChar(replacement[i]) {
+			return nil, fmt.Errorf("Invalid topic replacement '%s', only [a-zA-Z0-9._-] are allowed", replacement)
+		}
+	}
+
+	switch collisions {
+	case "":
+		collisions = TopicCollisionsKeep
+	case TopicCollisionsKeep, TopicCollisionsUnderscore, TopicCollisionsDot:
+	default:
+		return nil, fmt.Errorf("Invalid topic collision policy %s, valid values are %s, %s and %s", collisions, TopicCollisionsKeep, TopicCollisionsUnderscore, TopicCollisionsDot)
+	}
+
+	if maxLength <= 0 || maxLength > DefaultMaxTopicLength {
+		maxLength = DefaultMaxTopicLength
+	}
+
+	return &TopicSanitiser{
+		Replacement: replacement,
+		Collisions:  collisions,
+		MaxLength:   maxLength,
+	}, nil
+}
+
+func isTopicChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || IsDigit(c) || c == '.' || c == '_' || c == '-'
+}
+
+// ValidateTopic checks that Kafka accepts the topic name.
+func ValidateTopic(topic string) error {
+	if topic == "" || topic == "." || topic == ".." {
+		return fmt.Errorf("Invalid topic name '%s'", topic)
+	}
+	if len(topic) > DefaultMaxTopicLength {
+		return fmt.Errorf("Topic name '%s' is longer than %d characters", topic, DefaultMaxTopicLength)
+	}
+	for i := 0; i < len(topic); i++ {
+		if !isTopicChar(topic[i]) {
+			return fmt.Errorf("Topic name '%s' has invalid character '%c'", topic, topic[i])
+		}
+	}
+	return nil
+}
+
+// Topic returns the topic "<prefix>.<name>" with the name sanitised, or
+// "<prefix>.<defaultName>" if the name can't be used.
+func (s *TopicSanitiser) Topic(prefix string, name string, defaultName string) string {
+	topic, err := s.topic(prefix, name)
+	if err == nil {
+		return topic
+	}
+
+	s.Stats.Add("logs2kafka.topic,outcome=rejected", 1)
+	topic, err = s.topic(prefix, defaultName)
+	if err != nil {
+		return prefix + "." + defaultName
+	}
+	return topic
+}
+
+func (s *TopicSanitiser) topic(prefix string, name string) (string, error) {
+	sanitised := s.sanitise(name)
+	if sanitised == "" {
+		return "", fmt.Errorf("Topic name '%s' has no valid characters", name)
+	}
+	if sanitised != name {
+		s.Stats.Add("logs2kafka.topic,outcome=sanitised", 1)
+	}
+
+	topic := prefix + "." + sanitised
+	if len(topic) > s.MaxLength {
+		topic = s.shorten(prefix, topic)
+		if topic == "" {
+			return "", fmt.Errorf("Topic prefix '%s' is too long", prefix)
+		}
+		s.Stats.Add("logs2kafka.topic,outcome=shortened", 1)
+	}
+
+	return topic, ValidateTopic(topic)
+}
+
+func (s *TopicSanitiser) sanitise(name string) string {
+	valid := true
+	for i := 0; i < len(name); i++ {
+		if !isTopicChar(name[i]) {
+			valid = false
+			break
+		}
+	}
+
+	if !valid {
+		buf := make([]byte, 0, len(name))
+		for i := 0; i < len(name); i++ {
+			if isTopicChar(name[i]) {
+				buf = append(buf, name[i])
+			} else {
+				buf = append(buf, s.Replacement...)
+			}
+		}
+		name = string(buf)
+	}
+
+	switch s.Collisions {
+	case TopicCollisionsUnderscore:
+		name = strings.Replace(name, ".", "_", -1)
+	case TopicCollisionsDot:
+		name = strings.Replace(name, "_", ".", -1)
+	}
+
+	return name
+}
+
+// shorten cuts the topic to MaxLength, replacing the end with a hash of the
+// full name. Returns "" if the prefix doesn't leave room for the name.
+func (s *TopicSanitiser) shorten(prefix string, topic string) string {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(topic))
+	suffix := fmt.Sprintf("-%08x", hasher.Sum32())
+
+	keep := s.MaxLength - len(suffix)
+	if keep <= len(prefix)+1 {
+		return ""
+	}
+	return topic[:keep] + suffix
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTopic(t *testing.T) {
+	assert.Nil(t, ValidateTopic("service.foo-bar_1"))
+	assert.NotNil(t, ValidateTopic(""))
+	assert.NotNil(t, ValidateTopic("."))
+	assert.NotNil(t, ValidateTopic(".."))
+	assert.NotNil(t, ValidateTopic("service.foo/bar"))
+	assert.NotNil(t, ValidateTopic("service.foo bar"))
+	assert.NotNil(t, ValidateTopic(strings.Repeat("a", 250)))
+	assert.Nil(t, ValidateTopic(strings.Repeat("a", 249)))
+}
+
+func TestNewTopicSanitiser(t *testing.T) {
+	s, err := NewTopicSanitiser("_", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, TopicCollisionsKeep, s.Collisions)
+	assert.Equal(t, DefaultMaxTopicLength, s.MaxLength)
+
+	_, err = NewTopicSanitiser("/", TopicCollisionsKeep, 0)
+	assert.NotNil(t, err)
+
+	_, err = NewTopicSanitiser("_", "merge", 0)
+	assert.NotNil(t, err)
+
+	s, err = NewTopicSanitiser("", TopicCollisionsDot, 300)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultMaxTopicLength, s.MaxLength)
+}
+
+func TestTopicSanitiserReplacement(t *testing.T) {
+	s, _ := NewTopicSanitiser("_", TopicCollisionsKeep, 0)
+	s.Stats = NewStats()
+
+	assert.Equal(t, "service.foo", s.Topic("service", "foo", "unknown"))
+	assert.Equal(t, "service.registry_5000_foo_1.2", s.Topic("service", "registry:5000/foo:1.2", "unknown"))
+	assert.Equal(t, "service.my_app_", s.Topic("service", "my app!", "unknown"))
+	assert.Equal(t, int64(2), s.Stats.Counter("logs2kafka.topic,outcome=sanitised"))
+
+	s, _ = NewTopicSanitiser("", TopicCollisionsKeep, 0)
+	s.Stats = NewStats()
+	assert.Equal(t, "service.foobar", s.Topic("service", "foo/bar", "unknown"))
+
+	// Nothing is left of the name
+	assert.Equal(t, "service.unknown", s.Topic("service", "/::/", "unknown"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.topic,outcome=rejected"))
+}
+
+func TestTopicSanitiserCollisions(t *testing.T) {
+	s, _ := NewTopicSanitiser("_", TopicCollisionsUnderscore, 0)
+	assert.Equal(t, "service.foo_bar_baz", s.Topic("service", "foo.bar_baz", "unknown"))
+	assert.Equal(t, "service.foo_bar", s.Topic("service", "foo:bar", "unknown"))
+
+	s, _ = NewTopicSanitiser("_", TopicCollisionsDot, 0)
+	assert.Equal(t, "service.foo.bar.baz", s.Topic("service", "foo.bar_baz", "unknown"))
+
+	// The replacement characters are also subject to the policy
+	assert.Equal(t, "service.foo.bar", s.Topic("service", "foo:bar", "unknown"))
+}
+
+func TestTopicSanitiserMaxLength(t *testing.T) {
+	s, _ := NewTopicSanitiser("_", TopicCollisionsKeep, 0)
+	s.Stats = NewStats()
+
+	long := s.Topic("service", strings.Repeat("a", 300), "unknown")
+	assert.Equal(t, DefaultMaxTopicLength, len(long))
+	assert.True(t, strings.HasPrefix(long, "service.aaaa"), long)
+	assert.Nil(t, ValidateTopic(long))
+
+	// Names with a common start stay distinct
+	other := s.Topic("service", strings.Repeat("a", 299)+"b", "unknown")
+	assert.Equal(t, DefaultMaxTopicLength, len(other))
+	assert.NotEqual(t, long, other)
+	assert.Equal(t, long[:240], other[:240])
+
+	// The same name always gets the same topic
+	assert.Equal(t, long, s.Topic("service", strings.Repeat("a", 300), "unknown"))
+	assert.Equal(t, int64(3), s.Stats.Counter("logs2kafka.topic,outcome=shortened"))
+
+	s.MaxLength = 20
+	assert.Equal(t, "service.foo", s.Topic("service", "foo", "unknown"))
+	assert.Equal(t, 20, len(s.Topic("service", "foobarbazfoobar", "unknown")))
+
+	// The prefix leaves no room for the name
+	assert.Equal(t, "a-very-long-prefix.unknown", s.Topic("a-very-long-prefix", "foobarbazfoobar", "unknown"))
+	assert.Equal(t, int64(1), s.Stats.Counter("logs2kafka.topic,outcome=rejected"))
+}
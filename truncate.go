@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// Truncator shortens messages whose serialised size is over MaxSize, so
+// that a single huge field doesn't make the broker reject the whole
+// message. Fields are truncated from the largest to the smallest until
+// the message fits, so usually only the one huge msg or dump is
+// affected. Fields which aren't strings are replaced with their truncated
+// JSON.
+//
+// Truncated messages are marked with "truncated": true and
+// "original_size".
+type Truncator struct {
+	MaxSize int
+
+	Statsd StatisticsSender
+}
+
+// Fields which are never truncated as they are needed for routing
+var truncateProtectedFields = map[string]bool{
+	"ts":      true,
+	"service": true,
+	"level":   true,
+	"host":    true,
+}
+
+const truncateSuffix = "..."
+
+// Room for the marker fields, eg. `,"truncated":true,"original_size":123456789`
+const truncateMarkerSize = 48
+
+type truncateCandidate struct {
+	key   string
+	value string
+	size  int
+}
+
+// Truncate returns true if the message was truncated.
+func (s *Truncator) Truncate(m *Message) bool {
+	if s.MaxSize <= 0 || m.ParseFields() != nil {
+		return false
+	}
+
+	size := len(m.Bytes())
+	if size <= s.MaxSize {
+		return false
+	}
+
+	// Only the oversized messages are decoded
+	if m.ParseJSON() != nil {
+		return false
+	}
+
+	children, err := m.Container.ChildrenMap()
+	if err != nil {
+		return false
+	}
+
+	candidates := make([]truncateCandidate, 0, len(children))
+	for key, child := range children {
+		if truncateProtectedFields[key] {
+			continue
+		}
+
+		value, ok := child.Data().(string)
+		if !ok {
+			value = child.String()
+		}
+		candidates = append(candidates, truncateCandidate{key: key, value: value, size: len(value)})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].size != candidates[j].size {
+			return candidates[i].size > candidates[j].size
+		}
+		// Prefer msg on ties, otherwise keep the order stable
+		if candidates[i].key == "msg" || candidates[j].key == "msg" {
+			return candidates[i].key == "msg"
+		}
+		return candidates[i].key < candidates[j].key
+	})
+
+	current := size
+	for _, c := range candidates {
+		value := c.value
+		for current+truncateMarkerSize > s.MaxSize && len(value) > 0 {
+			// Removing the excess raw bytes is usually enough, but values
+			// which weren't strings get new escapes, so check again.
+			cut := len(value) - (current + truncateMarkerSize - s.MaxSize) - len(truncateSuffix)
+			if cut < 0 {
+				cut = 0
+			}
+			for cut > 0 && !utf8.RuneStart(value[cut]) {
+				cut--
+			}
+			value = value[:cut]
+
+			m.Container.Set(value+truncateSuffix, c.key)
+			current = len(m.Container.Bytes())
+		}
+	}
+
+	m.Container.Set(true, "truncated")
+	m.Container.Set(float64(size), "original_size")
+
+	if s.Statsd != nil {
+		service, _ := m.FieldString("service")
+		s.Statsd.Inc(fmt.Sprintf("logs2kafka.truncated,service=%s", service), 1, 1)
+	}
+
+	return true
+}
+
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncatorSmallMessage(t *testing.T) {
+	s := Truncator{MaxSize: 1000}
+
+	m := JSONToMessage(`{"service":"foo","msg":"hello"}`)
+	m.ParseJSON()
+	assert.Equal(t, false, s.Truncate(&m))
+	assert.Equal(t, `{"msg":"hello","service":"foo"}`, m.Container.String())
+}
+
+func TestTruncatorMsg(t *testing.T) {
+	statsd := newTestStatsd()
+	s := Truncator{MaxSize: 1000, Statsd: statsd}
+
+	m := JSONToMessage(`{"service":"foo","level":"INFO","ts":"2017-05-19T06:05:22Z","msg":"` + strings.Repeat("ä", 2000) + `","other":"small"}`)
+	m.ParseJSON()
+	original := len(m.Container.Bytes())
+
+	assert.Equal(t, true, s.Truncate(&m))
+	assert.True(t, len(m.Container.Bytes()) <= 1000)
+
+	msg, _ := m.FieldString("msg")
+	assert.True(t, strings.HasPrefix(msg, "ää"))
+	assert.True(t, strings.HasSuffix(msg, "ä..."))
+	value, _ := m.FieldString("other")
+	assert.Equal(t, "small", value)
+	value, _ = m.FieldString("service")
+	assert.Equal(t, "foo", value)
+	value, _ = m.FieldString("truncated")
+	assert.Equal(t, "true", value)
+	value, _ = m.FieldString("original_size")
+	assert.Equal(t, strconv.Itoa(original), value)
+	assert.Equal(t, int64(1), statsd.Counter("logs2kafka.truncated,service=foo"))
+}
+
+func TestTruncatorOtherFields(t *testing.T) {
+	s := Truncator{MaxSize: 1000}
+
+	m := JSONToMessage(`{"service":"foo","msg":"short","stacktrace":"` + strings.Repeat("\\n\\t", 100) + `","dump":{"data":"` + strings.Repeat("x", 2000) + `"}}`)
+	m.ParseJSON()
+
+	assert.Equal(t, true, s.Truncate(&m))
+	assert.True(t, len(m.Container.Bytes()) <= 1000)
+
+	// The largest field is truncated and replaced with a string
+	value, _ := m.FieldString("dump")
+	assert.True(t, strings.HasPrefix(value, `{"data":"xxx`))
+	assert.True(t, strings.HasSuffix(value, `xxx...`))
+
+	// The others are kept if there is enough room after that
+	value, _ = m.FieldString("msg")
+	assert.Equal(t, "short", value)
+	value, _ = m.FieldString("stacktrace")
+	assert.Equal(t, strings.Repeat("\n\t", 100), value)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UDPListener reads packets from an UDP port with one or more reader
+// goroutines, each with its own buffer. With more than one reader each
+// reader has its own SO_REUSEPORT socket, so the kernel spreads the load
+// between them. Packets of one sender always go to the same socket.
+//
+// Handle is called concurrently from the readers and must not keep the
+// buffer after it returns.
+type UDPListener struct {
+	Addr *net.UDPAddr
+
+	// Number of reader goroutines, defaults to one
+	Readers int
+
+	// Size of the read buffer, longer packets are truncated
+	BufferSize int
+
+	Handle func(buffer []byte, addr *net.UDPAddr)
+
+	conns []*net.UDPConn
+	close chan bool
+	done  sync.WaitGroup
+}
+
+// ResolveListenAddr returns the address an input binds to. An empty
+// address binds all interfaces. IPv6 addresses can be given with or without
+// brackets, eg. "::1" or "[::1]".
+func ResolveListenAddr(address string, port int) (*net.UDPAddr, error) {
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(address, strconv.Itoa(port)))
+}
+
+func (l *UDPListener) Start() error {
+	readers := l.Readers
+	if readers < 1 {
+		readers = 1
+	}
+
+	if readers == 1 {
+		conn, err := net.ListenUDP("udp", l.Addr)
+		if err != nil {
+			return err
+		}
+		l.conns = []*net.UDPConn{conn}
+	} else {
+		addr := *l.Addr
+		for i := 0; i < readers; i++ {
+			conn, err := listenUDPReusePort(&addr)
+			if err != nil && i == 0 {
+				// The readers share one socket when SO_REUSEPORT isn't available
+				fmt.Fprintf(os.Stderr, "Error opening SO_REUSEPORT socket on %s, using one socket for %d readers: %s\n", l.Addr, readers, err)
+				conn, err = net.ListenUDP("udp", l.Addr)
+				if err != nil {
+					return err
+				}
+				l.conns = []*net.UDPConn{conn}
+				break
+			}
+			if err != nil {
+				l.closeConns()
+				return err
+			}
+			l.conns = append(l.conns, conn)
+
+			// With port 0 the other sockets are bound to the port the
+			// first one got
+			addr.Port = conn.LocalAddr().(*net.UDPAddr).Port
+		}
+	}
+
+	l.close = make(chan bool)
+	for i := 0; i < readers; i++ {
+		l.done.Add(1)
+		go l.read(l.conns[i%len(l.conns)])
+	}
+
+	return nil
+}
+
+func (l *UDPListener) read(conn *net.UDPConn) {
+	defer l.done.Done()
+
+	bufferSize := l.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 65535
+	}
+	buf := make([]byte, bufferSize)
+
+	for {
+		select {
+		case <-l.close:
+			return
+		default:
+			conn.SetDeadline(time.Now().Add(time.Millisecond * 100))
+			n, addr, err := conn.ReadFromUDP(buf)
+
+			if err == nil {
+				l.Handle(buf[0:n], addr)
+			}
+		}
+	}
+}
+
+// Port returns the port the listener is bound to, which is useful when
+// the listener was started on port 0.
+func (l *UDPListener) Port() int {
+	return l.conns[0].LocalAddr().(*net.UDPAddr).Port
+}
+
+// Close stops the readers and closes the sockets.
+func (l *UDPListener) Close() {
+	close(l.close)
+	l.done.Wait()
+	l.closeConns()
+}
+
+func (l *UDPListener) closeConns() {
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+// UDPDrops returns the number of packets the kernel has dropped from the
+// sockets bound to the port because their receive buffers were full. It
+// reads /proc/net/udp and /proc/net/udp6, so it only works on Linux.
+func UDPDrops(port int) (int64, error) {
+	var drops int64
+	found := false
+
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		d, err := parseProcNetUDPDrops(f, port)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		drops += d
+		found = true
+	}
+
+	if !found {
+		return 0, fmt.Errorf("UDP socket statistics are not available")
+	}
+	return drops, nil
+}
+
+// parseProcNetUDPDrops sums the drops column of the sockets whose local
+// address has the port, eg.
+//
+//   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+//   12: 00000000:0202 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12345 2 0000000000000000 17
+func parseProcNetUDPDrops(r io.Reader, port int) (int64, error) {
+	var drops int64
+
+	scanner := bufio.NewScanner(r)
+	header := true
+	for scanner.Scan() {
+		if header {
+			header = false
+			continue
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+
+		local := fields[1]
+		i := strings.LastIndex(local, ":")
+		if i < 0 {
+			continue
+		}
+		localPort, err := strconv.ParseInt(local[i+1:], 16, 32)
+		if err != nil || int(localPort) != port {
+			continue
+		}
+
+		d, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid drops column in socket statistics: %s", fields[len(fields)-1])
+		}
+		drops += d
+	}
+
+	return drops, scanner.Err()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPListenerReaders(t *testing.T) {
+	var mutex sync.Mutex
+	received := map[string]int{}
+
+	l := UDPListener{
+		Addr:       &net.UDPAddr{IP: net.ParseIP("127.0.0.1")},
+		Readers:    4,
+		BufferSize: 100,
+		Handle: func(buffer []byte, addr *net.UDPAddr) {
+			mutex.Lock()
+			received[string(buffer)]++
+			mutex.Unlock()
+		},
+	}
+	err := l.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(l.conns))
+
+	// Packets from different senders are spread between the sockets, but
+	// all of them must arrive
+	for i := 0; i < 8; i++ {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: l.Port()})
+		assert.Nil(t, err)
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		count := received["hello"]
+		mutex.Unlock()
+		if count == 8 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	assert.Equal(t, 8, received["hello"])
+	mutex.Unlock()
+
+	l.Close()
+}
+
+func TestParseProcNetUDPDrops(t *testing.T) {
+	stats := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  12: 00000000:0202 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1234 2 0000000000000000 17
+  13: 00000000:0202 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1235 2 0000000000000000 3
+  14: 0100007F:3039 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1236 2 0000000000000000 100
+`
+	drops, err := parseProcNetUDPDrops(strings.NewReader(stats), 514)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), drops)
+
+	drops, err = parseProcNetUDPDrops(strings.NewReader(stats), 12345)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), drops)
+
+	drops, err = parseProcNetUDPDrops(strings.NewReader(stats), 80)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), drops)
+}
+
+func TestResolveListenAddr(t *testing.T) {
+	addr, err := ResolveListenAddr("", 514)
+	assert.Nil(t, err)
+	assert.Nil(t, addr.IP)
+	assert.Equal(t, 514, addr.Port)
+
+	addr, err = ResolveListenAddr("127.0.0.1", 514)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:514", addr.String())
+
+	addr, err = ResolveListenAddr("::1", 514)
+	assert.Nil(t, err)
+	assert.Equal(t, "[::1]:514", addr.String())
+
+	addr, err = ResolveListenAddr("[::1]", 514)
+	assert.Nil(t, err)
+	assert.Equal(t, "[::1]:514", addr.String())
+
+	_, err = ResolveListenAddr("not an address", 514)
+	assert.NotNil(t, err)
+}
+
+func TestUDPListenerIPv6(t *testing.T) {
+	for _, readers := range []int{1, 2} {
+		received := make(chan string, 1)
+		l := UDPListener{
+			Addr:    &net.UDPAddr{IP: net.ParseIP("::1")},
+			Readers: readers,
+			Handle: func(buffer []byte, addr *net.UDPAddr) {
+				received <- addr.IP.String() + " " + string(buffer)
+			},
+		}
+		err := l.Start()
+		if err != nil {
+			t.Skipf("IPv6 is not available: %s", err)
+		}
+
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("::1"), Port: l.Port()})
+		assert.Nil(t, err)
+		conn.Write([]byte("hello"))
+		conn.Close()
+
+		select {
+		case value := <-received:
+			assert.Equal(t, "::1 hello", value)
+		case <-time.After(2 * time.Second):
+			t.Errorf("No packet received with %d readers", readers)
+		}
+
+		// Not reachable from IPv4
+		assert.Equal(t, "::1", l.conns[0].LocalAddr().(*net.UDPAddr).IP.String())
+		l.Close()
+	}
+}
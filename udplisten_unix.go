@@ -0,0 +1,90 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDPReusePort opens a UDP socket with SO_REUSEPORT, so that several
+// sockets can be bound to the same port. The kernel spreads the packets
+// between them by the sender address.
+func listenUDPReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	family := unix.AF_INET
+	if addr.IP == nil || addr.IP.To4() == nil {
+		family = unix.AF_INET6
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	if err != nil && family == unix.AF_INET6 && addr.IP == nil {
+		// IPv6 is disabled, listen to IPv4 only
+		family = unix.AF_INET
+		fd, err = unix.Socket(family, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	}
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(fd)
+
+	err = setReusePort(fd, family, addr)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// The file gets a duplicate of the descriptor
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("udp:%s", addr))
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Socket bound to %s is not an UDP socket", addr)
+	}
+	return udp, nil
+}
+
+func setReusePort(fd int, family int, addr *net.UDPAddr) error {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if err != nil {
+		return err
+	}
+	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	if err != nil {
+		return err
+	}
+
+	if family == unix.AF_INET {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		if addr.IP != nil {
+			copy(sa.Addr[:], addr.IP.To4())
+		}
+		return unix.Bind(fd, sa)
+	}
+
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		// Accept also IPv4 packets like net.ListenUDP does
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+		if err != nil {
+			return err
+		}
+	}
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	if addr.IP != nil {
+		copy(sa.Addr[:], addr.IP.To16())
+	}
+	if addr.Zone != "" {
+		if iface, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(iface.Index)
+		}
+	}
+	return unix.Bind(fd, sa)
+}
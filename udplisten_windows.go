@@ -0,0 +1,14 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenUDPReusePort is not supported on Windows. UDPListener shares one
+// socket between the readers instead.
+func listenUDPReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT is not supported on Windows")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// UnixgramListener reads packets from a unix datagram socket, eg. /dev/log.
+// The socket file is created by Start and removed by Close.
+//
+// Handle must not keep the buffer after it returns.
+type UnixgramListener struct {
+	Path string
+
+	// Permissions of the socket file, defaults to 0666 so that any local
+	// program can write to it
+	Mode os.FileMode
+
+	// Size of the read buffer, longer packets are truncated
+	BufferSize int
+
+	Handle func(buffer []byte)
+
+	conn  *net.UnixConn
+	close chan bool
+	done  sync.WaitGroup
+}
+
+func (l *UnixgramListener) Start() error {
+	// A socket left behind by a previous run would make the bind fail,
+	// but other files are not removed
+	if info, err := os.Lstat(l.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", l.Path)
+		}
+		os.Remove(l.Path)
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: l.Path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+
+	mode := l.Mode
+	if mode == 0 {
+		mode = 0666
+	}
+	err = os.Chmod(l.Path, mode)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	l.conn = conn
+	l.close = make(chan bool)
+	l.done.Add(1)
+	go l.read()
+
+	return nil
+}
+
+func (l *UnixgramListener) read() {
+	defer l.done.Done()
+
+	bufferSize := l.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 65535
+	}
+	buf := make([]byte, bufferSize)
+
+	for {
+		select {
+		case <-l.close:
+			return
+		default:
+			l.conn.SetDeadline(time.Now().Add(time.Millisecond * 100))
+			n, _, err := l.conn.ReadFromUnix(buf)
+
+			if err == nil {
+				l.Handle(buf[0:n])
+			}
+		}
+	}
+}
+
+// Close stops the reader and removes the socket.
+func (l *UnixgramListener) Close() {
+	close(l.close)
+	l.done.Wait()
+	l.conn.Close()
+	os.Remove(l.Path)
+}
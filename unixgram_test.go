@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixgramListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs2kafka")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := dir + "/log"
+	received := make(chan string, 10)
+	l := UnixgramListener{
+		Path: path,
+		Handle: func(buffer []byte) {
+			received <- string(buffer)
+		},
+	}
+	assert.Nil(t, l.Start())
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0666), info.Mode().Perm())
+
+	conn, err := net.Dial("unixgram", path)
+	assert.Nil(t, err)
+	conn.Write([]byte("hello"))
+	conn.Close()
+
+	select {
+	case value := <-received:
+		assert.Equal(t, "hello", value)
+	case <-time.After(2 * time.Second):
+		t.Error("No packet received")
+	}
+
+	l.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// A socket left behind is replaced, other files are not
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Nil(t, err)
+	stale.Close()
+	assert.Nil(t, l.Start())
+	l.Close()
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("data"), 0644))
+	assert.NotNil(t, l.Start())
+}